@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// assets copies the local files that the output references into the assets directory
+type assets struct {
+	outputDir    string
+	viewLocation string
+	root         string
+	hash         bool
+	copied       map[string]string
+}
+
+func newAssets(outputDir, viewLocation string, opts RenderOptions) *assets {
+	return &assets{
+		outputDir:    outputDir,
+		viewLocation: viewLocation,
+		root:         opts.Root,
+		hash:         opts.HashAssets,
+		copied:       make(map[string]string),
+	}
+}
+
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// templatePattern matches the css @param@, html {param} and js $param$ templates, a reference with
+// one in it is only known once the component is instanced
+var templatePattern = regexp.MustCompile(`@[0-9a-zA-Z_-]+@|{[_a-zA-Z][_a-zA-Z0-9]*}|\$[_a-zA-Z][_a-zA-Z0-9]*\$`)
+
+// url copies the file a reference points to and returns the url it is served from, references
+// to remote files, data, the site root or templates are returned as they are
+func (a *assets) url(ref, dir string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" ||
+		strings.HasPrefix(ref, "/") ||
+		strings.HasPrefix(ref, "#") ||
+		schemePattern.MatchString(ref) ||
+		templatePattern.MatchString(ref) {
+		return ref, nil
+	}
+
+	file, suffix := ref, ""
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		file, suffix = ref[:i], ref[i:]
+	}
+
+	path := filepath.Join(dir, file)
+	if url, ok := a.copied[path]; ok {
+		return url + suffix, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to copy asset %s, %s", ref, err)
+	}
+
+	// keep the layout of the project so files with the same name don't clash
+	parts := strings.Split(relPath(a.root, path), "/")
+	for i, part := range parts {
+		if part == ".." {
+			parts[i] = "_"
+		}
+	}
+	name := strings.Join(parts, "/")
+	if a.hash {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + hashID(8, string(data)) + ext
+	}
+
+	dest := a.outputDir + "/assets/" + name
+	err = os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = WriteFile(dest, string(data))
+	if err != nil {
+		return "", err
+	}
+
+	url := a.viewLocation + "/assets/" + name
+	a.copied[path] = url
+	return url + suffix, nil
+}
+
+// assetAttrs are the attributes of each tag that reference files
+var assetAttrs = map[string][]string{
+	"img":    []string{"src", "srcset"},
+	"source": []string{"src", "srcset"},
+	"video":  []string{"src", "poster"},
+	"audio":  []string{"src"},
+	"track":  []string{"src"},
+	"embed":  []string{"src"},
+	"object": []string{"data"},
+	"input":  []string{"src"},
+	"link":   []string{"href"},
+}
+
+// assetLinks are the link rel values that point to an asset rather than a page or stylesheet
+var assetLinks = []string{"icon", "apple-touch-icon", "mask-icon", "manifest"}
+
+// copyAttrAssets copies the files referenced by element attributes into the output, paths are
+// resolved from the file the element was defined in, or the file that passed the parameter
+// the path starts with, and the attributes rewritten to match
+func copyAttrAssets(root Node, files *assets) error {
+	for _, node := range Descendants(root) {
+		base, ok := node.(*BaseNode)
+		if !ok || node.Type() != BaseType {
+			continue
+		}
+
+		tag := strings.ToLower(node.Data())
+		if tag == "link" && !isAssetLink(node) {
+			continue
+		}
+
+		for _, key := range assetAttrs[tag] {
+			ok, attr := GetAttr(node, key)
+			if !ok {
+				continue
+			}
+
+			rewrite := files.url
+			if key == "srcset" {
+				rewrite = files.srcset
+			}
+			dir := base.dir
+			if paramDir, ok := base.attrDirs[key]; ok {
+				dir = paramDir
+			}
+			val, err := rewrite(attr.Val, dir)
+			if err != nil {
+				return fmt.Errorf("error at node %s, %s", node, err)
+			}
+			attr.Val = val
+		}
+	}
+	return nil
+}
+
+func isAssetLink(node Node) bool {
+	ok, rel := GetAttr(node, "rel")
+	if !ok {
+		return false
+	}
+	for _, val := range strings.Fields(strings.ToLower(rel.Val)) {
+		for _, check := range assetLinks {
+			if val == check {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// srcset copies every image in a srcset list, each candidate is a url and an optional descriptor
+func (a *assets) srcset(val, dir string) (string, error) {
+	ret := []string{}
+	for _, candidate := range strings.Split(val, ",") {
+		parts := strings.Fields(candidate)
+		if len(parts) == 0 {
+			continue
+		}
+		url, err := a.url(parts[0], dir)
+		if err != nil {
+			return "", err
+		}
+		ret = append(ret, strings.Join(append([]string{url}, parts[1:]...), " "))
+	}
+	return strings.Join(ret, ", "), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"KISS/css"
 	"fmt"
 	"regexp"
 	"strings"
@@ -98,15 +99,21 @@ type Node interface {
 // ParseNodeContext passes contextual infromation from parent to child nodes durring parsing
 type ParseNodeContext struct {
 	path       string
+	root       string
+	file       string
 	ImportTags []ImportTag
 	depth      int
+	targets    []css.Target
+	scripts    []string
 }
 
 // TODO: why is compScope lower case but parameters is not?
 
 // InstNodeContext passes contextual infromation from parent to child nodes durring instancing
 type InstNodeContext struct {
+	componentClass string
 	componentScope string
+	instances      map[string]int
 	Parameters     map[string][]Node
 }
 
@@ -118,23 +125,30 @@ type RenderNodeContext struct {
 
 // ImportTag represents an import tag
 type ImportTag struct {
-	tag  string
-	root Node
-	path string
+	tag   string
+	root  Node
+	path  string
+	lazy  bool
+	class string
 }
 
 // Clone clones a parse node context
 func (ctx ParseNodeContext) Clone() ParseNodeContext {
 	ret := ParseNodeContext{
-		path: ctx.path,
+		path:    ctx.path,
+		root:    ctx.root,
+		file:    ctx.file,
+		targets: ctx.targets,
 	}
 
 	for _, tag := range ctx.ImportTags {
 		ret.ImportTags = append(ret.ImportTags,
 			ImportTag{
-				tag:  tag.tag,
-				root: tag.root,
-				path: tag.path,
+				tag:   tag.tag,
+				root:  tag.root,
+				path:  tag.path,
+				lazy:  tag.lazy,
+				class: tag.class,
 			},
 		)
 	}
@@ -149,6 +163,8 @@ type BaseNode struct {
 	visible                                      bool
 	data                                         string
 	attr                                         []*html.Attribute
+	dir                                          string
+	attrDirs                                     map[string]string
 }
 
 // NewNode creates a new node
@@ -307,6 +323,12 @@ func Detach(node Node) Node {
 func (node *BaseNode) Clone() Node {
 	clone := NewNode(node.data, node.nType, cloneAttrs(node.attr)...)
 	clone.SetVisible(node.Visible())
+	if base, ok := clone.(*BaseNode); ok {
+		base.dir = node.dir
+		for key, dir := range node.attrDirs {
+			base.setAttrDir(key, dir)
+		}
+	}
 
 	for _, child := range Children(node) {
 		AppendChild(clone, child.Clone())
@@ -317,6 +339,8 @@ func (node *BaseNode) Clone() Node {
 
 // Parse builds the nodes structure and then calls parse on all it's child nodes
 func (node *BaseNode) Parse(ctx ParseNodeContext) error {
+	// remember where the node was defined so relative asset paths can be resolved
+	node.dir = ctx.path
 	for _, child := range Children(node) {
 		err := child.Parse(ctx)
 		if err != nil {
@@ -328,6 +352,7 @@ func (node *BaseNode) Parse(ctx ParseNodeContext) error {
 
 // Instance takes parameters from the node context and replaces template parameteres
 func (node *BaseNode) Instance(ctx InstNodeContext) error {
+	AddClass(node, ctx.componentClass)
 	AddClass(node, ctx.componentScope)
 	re := regexp.MustCompile(`{[_a-zA-Z][_a-zA-Z0-9]*}`)
 	for _, attr := range node.Attrs() {
@@ -345,6 +370,10 @@ func (node *BaseNode) Instance(ctx InstNodeContext) error {
 				if len(pnode) == 1 && pnode[0].Type() != TextType {
 					return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
 				}
+				// a path that starts with a parameter is relative to where the parameter was written
+				if dir, ok := nodeDir(pnode); ok && strings.HasPrefix(attr.Val, string(match)) {
+					node.setAttrDir(attr.Key, dir)
+				}
 			}
 			attr.Val = strings.ReplaceAll(attr.Val, string(match), param)
 		}
@@ -360,7 +389,29 @@ func (node *BaseNode) Instance(ctx InstNodeContext) error {
 	return nil
 }
 
-// Render converts a node into a textual representation
+// setAttrDir sets the directory that an attribute's path is relative to when it isn't the
+// directory the node was defined in
+func (node *BaseNode) setAttrDir(key, dir string) {
+	if node.attrDirs == nil {
+		node.attrDirs = make(map[string]string)
+	}
+	node.attrDirs[key] = dir
+}
+
+// nodeDir returns the directory a text parameter was written in
+func nodeDir(param []Node) (string, bool) {
+	if len(param) != 1 {
+		return "", false
+	}
+	if text, ok := param[0].(*TextNode); ok {
+		return text.dir, true
+	}
+	return "", false
+}
+
+var attrEscaper = strings.NewReplacer("&", "&amp;", "\"", "&quot;")
+
+// Render converts a node into a textual representation, attribute values are escaped for html
 func (node *BaseNode) Render() string {
 	ret := ""
 	if node.visible {
@@ -373,7 +424,7 @@ func (node *BaseNode) Render() string {
 			if len(attr.Namespace) > 0 {
 				ret += attr.Namespace + ":"
 			}
-			ret += attr.Key + "=\"" + attr.Val + "\""
+			ret += attr.Key + "=\"" + attrEscaper.Replace(attr.Val) + "\""
 		}
 		ret += ">"
 	}
@@ -499,6 +550,10 @@ func GetAttr(node Node, key string) (bool, *html.Attribute) {
 
 // AddClass adds the class string to the nodes class attribute
 func AddClass(node Node, class string) {
+	if class == "" {
+		return
+	}
+
 	classes := []string{}
 	for _, attr := range node.Attrs() {
 		if attr.Key == "class" {
@@ -525,6 +580,21 @@ func AddClass(node Node, class string) {
 	}
 }
 
+// AddStyle appends an inline style declaration to a node's style attribute
+func AddStyle(node Node, style string) {
+	ok, attr := GetAttr(node, "style")
+	if !ok {
+		node.SetAttrs(append(node.Attrs(), &html.Attribute{Key: "style", Val: style}))
+		return
+	}
+
+	val := strings.TrimSpace(attr.Val)
+	if val != "" && !strings.HasSuffix(val, ";") {
+		val += ";"
+	}
+	attr.Val = val + style
+}
+
 // FindNodes finds all child nodes of the root of a given NodeType
 func FindNodes(root Node, nType NodeType) []Node {
 	ret := []Node{}
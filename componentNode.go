@@ -1,8 +1,10 @@
 package main
 
 import (
+	"KISS/css"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -11,6 +13,9 @@ type ComponentNode struct {
 	BaseNode
 	TempNodes []Node
 	TempAttr  []Node
+	Lazy      bool
+	Class     string
+	Scope     string
 }
 
 // Parse uses the it's class to add a root component and then calls parse on all it's children
@@ -28,6 +33,8 @@ func (node *ComponentNode) Parse(ctx ParseNodeContext) error {
 			AppendChild(node, root)
 
 			ctx.path = tag.path
+			node.Lazy = tag.lazy
+			node.Class = tag.class
 			break
 		}
 	}
@@ -44,25 +51,47 @@ func (node *ComponentNode) Instance(ctx InstNodeContext) error {
 	for _, attr := range node.Attrs() {
 		matches := re.FindAll([]byte(attr.Val), -1)
 		for _, match := range matches {
-			node, ok := ctx.Parameters[string(match[1:len(match)-1])]
+			pnode, ok := ctx.Parameters[string(match[1:len(match)-1])]
 			if ok {
-				if len(node) != 1 || node[0].Type() != TextType {
+				if len(pnode) != 1 || pnode[0].Type() != TextType {
 					return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
 				}
-				attr.Val = strings.ReplaceAll(attr.Val, string(match), node[0].Data())
+				if dir, ok := nodeDir(pnode); ok && strings.HasPrefix(attr.Val, string(match)) {
+					node.setAttrDir(attr.Key, dir)
+				}
+				attr.Val = strings.ReplaceAll(attr.Val, string(match), pnode[0].Data())
 			}
 		}
 	}
 
-	ctx.componentScope = "k-" + randomID(6)
+	ctx.componentClass = node.Class
+	ctx.instances[node.Class]++
+	ctx.componentScope = "k-" + hashID(6, node.Class, strconv.Itoa(ctx.instances[node.Class]))
+	node.Scope = ctx.componentScope
 	ctx.Parameters = make(map[string][]Node)
 
+	// text parameters remember the file they were written in so paths in them resolve from there
 	for _, attr := range node.Attrs() {
-		ctx.Parameters[strings.ToLower(attr.Key)] = []Node{NewNode(attr.Val, TextType)}
+		text := NewNode(attr.Val, TextType).(*TextNode)
+		text.dir = node.dir
+		if dir, ok := node.attrDirs[attr.Key]; ok {
+			text.dir = dir
+		}
+		ctx.Parameters[strings.ToLower(attr.Key)] = []Node{text}
 	}
 
+	// Check the styles before instancing scopes them
+	var root Node
+	var hasHost bool
 	for _, child := range Children(node) {
 		if child.Data() == "root" {
+			root = child
+			var hasInstance bool
+			hasHost, hasInstance = componentStyles(child)
+			if !hasInstance && !componentScripts(child) {
+				// only scope elements to this instance if there are styles or scripts that need it
+				ctx.componentScope = ""
+			}
 			err := child.Instance(ctx)
 			if err != nil {
 				return err
@@ -72,13 +101,37 @@ func (node *ComponentNode) Instance(ctx InstNodeContext) error {
 		ctx.Parameters[strings.ToLower(child.Data())] = Children(child)
 	}
 
+	// The root has already been instanced above
 	for _, child := range Children(node) {
+		if child == root {
+			continue
+		}
 		err := child.Instance(ctx)
 		if err != nil {
 			return err
 		}
 	}
 
+	if hasHost {
+		for _, host := range hostNodes(root) {
+			AddClass(host, ctx.componentClass+"-host")
+			if ctx.componentScope != "" {
+				AddClass(host, ctx.componentScope+"-host")
+			}
+		}
+	}
+
+	// Parameters read with var() in the component styles become custom properties on the instance
+	props, err := componentProps(root, ctx.Parameters)
+	if err != nil {
+		return fmt.Errorf("error at node %s, %s", node, err)
+	}
+	if props != "" {
+		for _, host := range hostNodes(root) {
+			AddStyle(host, props)
+		}
+	}
+
 	// Hide all the parameters
 	for _, child := range Children(node) {
 		if child.Data() == "root" {
@@ -93,6 +146,112 @@ func (node *ComponentNode) Instance(ctx InstNodeContext) error {
 	return nil
 }
 
+// componentStyles checks if any of the components styles target the component host
+// or use templates that need to be scoped to each instance of the component
+func componentStyles(root Node) (bool, bool) {
+	var host, instance bool
+	for _, node := range FindNodes(root, CSSType) {
+		cssNode := node.(*CSSNode)
+		if cssNode.Script.HasHost() || cssNode.InstScript.HasHost() {
+			host = true
+		}
+		if !cssNode.InstScript.Empty() {
+			instance = true
+		}
+	}
+	return host, instance
+}
+
+// componentScripts checks if a component has scripts of its own, they find the instance they
+// belong to by its scope class
+func componentScripts(root Node) bool {
+	for _, child := range Children(root) {
+		switch child.Type() {
+		case ComponentType:
+			continue
+		case JSType:
+			if jsNode := child.(*JSNode); !jsNode.Remote && !jsNode.Module {
+				return true
+			}
+		default:
+			if componentScripts(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// componentProps builds the custom property declarations for every text parameter that the
+// component's styles read with var(--param), a parameter that isn't a valid css value on its own
+// could end the declaration and add others so it is an error
+func componentProps(root Node, params map[string][]Node) (string, error) {
+	ret := []string{}
+	for _, name := range componentVars(root) {
+		param, ok := params[strings.ToLower(name)]
+		if !ok || len(param) != 1 || param[0].Type() != TextType {
+			continue
+		}
+		if !css.ValidValue(param[0].Data()) {
+			return "", fmt.Errorf("parameter %s can not be used as the css value %q", name, param[0].Data())
+		}
+		ret = append(ret, "--"+name+":"+param[0].Data())
+	}
+	return strings.Join(ret, ";"), nil
+}
+
+// componentVars finds the custom properties read by a component's own styles, styles from
+// nested components are skipped since they set their own properties
+func componentVars(root Node) []string {
+	ret := []string{}
+	if root == nil {
+		return ret
+	}
+
+	for _, child := range Children(root) {
+		names := []string{}
+		switch child.Type() {
+		case ComponentType:
+			continue
+		case CSSType:
+			cssNode := child.(*CSSNode)
+			names = append(cssNode.Script.Vars(), cssNode.InstScript.Vars()...)
+		default:
+			names = componentVars(child)
+		}
+
+		for _, name := range names {
+			found := false
+			for _, check := range ret {
+				if check == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				ret = append(ret, name)
+			}
+		}
+	}
+	return ret
+}
+
+// hostNodes finds the top level elements that will be rendered for a component
+func hostNodes(root Node) []Node {
+	ret := []Node{}
+	for _, child := range Children(root) {
+		switch {
+		case child.Type() == CSSType || child.Type() == JSType || child.Type() == TSType:
+			continue
+		case child.Visible() && child.Type() == BaseType:
+			ret = append(ret, child)
+		case !child.Visible():
+			ret = append(ret, hostNodes(child)...)
+		}
+	}
+	return ret
+}
+
 func collectNodes(node *ComponentNode, root Node) *ComponentNode {
 	// Collect all the attributes here
 	re := regexp.MustCompile(`{[_a-zA-Z][_a-zA-Z0-9]*}`)
@@ -114,7 +273,10 @@ func collectNodes(node *ComponentNode, root Node) *ComponentNode {
 // Clone creates a deep copy of a node, but does not copy over the connections to the original parent and siblings
 func (node *ComponentNode) Clone() Node {
 	clone := &ComponentNode{
-		BaseNode: BaseNode{data: node.Data(), attr: cloneAttrs(node.Attrs()), nType: node.Type(), visible: node.Visible()},
+		BaseNode: BaseNode{data: node.Data(), attr: cloneAttrs(node.Attrs()), nType: node.Type(), visible: node.Visible(), dir: node.dir},
+		Lazy:     node.Lazy,
+		Class:    node.Class,
+		Scope:    node.Scope,
 	}
 
 	var root Node
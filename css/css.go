@@ -3,6 +3,7 @@ package css
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -18,96 +19,58 @@ const (
 	pseudoElm
 	property
 	whiteSpace
-	newLine
 	comma
 	semiColon
 	attrBlock
-	openAttrBlock
-	closeAttrBlock
 	star
+	nesting
 	child
 	nextChild
-	beginWith
 	preceded
-	equal
-	openFn
-	closeFn
-	function
 	keyframe
+	atRule
 	percentage
-	pixels
-	color
 	value
-	template
-	comment
 	any
 )
 
-type tokenPattern struct {
-	tType   tokenType
-	pattern *regexp.Regexp
-}
-
-var tokenPatterns = []tokenPattern{
-	tokenPattern{whiteSpace, regexp.MustCompile(`^[ \t]`)},
-	tokenPattern{newLine, regexp.MustCompile(`^[\n\r]+`)},
-	tokenPattern{closeFn, regexp.MustCompile(`^\)`)},
-	tokenPattern{openFn, regexp.MustCompile(`^(attr|calc|cubic-bezier|hsl|hsla|linear-gradient|radial-gradient|repeating-linear-gradient|repeating-radial-gradient|rgb|rgba|var|url)\(`)},
-	tokenPattern{elmName, regexp.MustCompile(`^(html|body|h[1-6]|div|hr|li|ol|p|ul|a|code|em|span|img|svg|canvas|table|tbody|td|tfoot|th|thead|tr|button|form|input|label|select|textarea)[ {>\.\[:~\+]`)},
-	tokenPattern{color, regexp.MustCompile(`^#[0-9a-fA-F]{3,8}`)},
-	tokenPattern{beginWith, regexp.MustCompile(`^[\^|]`)},
-	tokenPattern{closeBlock, regexp.MustCompile(`^}`)},
-	tokenPattern{openBlock, regexp.MustCompile(`^{`)},
-	tokenPattern{equal, regexp.MustCompile(`^=`)},
-	tokenPattern{template, regexp.MustCompile(`^"@[0-9a-zA-Z_-][0-9a-zA-Z_-]*@"`)},
-	tokenPattern{closeAttrBlock, regexp.MustCompile(`^\]`)},
-	tokenPattern{openAttrBlock, regexp.MustCompile(`^\[`)},
-	tokenPattern{child, regexp.MustCompile(`^>`)},
-	tokenPattern{nextChild, regexp.MustCompile(`^\+`)},
-	tokenPattern{comma, regexp.MustCompile(`^,`)},
-	tokenPattern{preceded, regexp.MustCompile(`^~`)},
-	tokenPattern{semiColon, regexp.MustCompile(`^;`)},
-	tokenPattern{star, regexp.MustCompile(`^\*`)},
-	tokenPattern{keyframe, regexp.MustCompile(`^@keyframes [a-zA-Z0-9_-]+`)},
-	tokenPattern{percentage, regexp.MustCompile(`^\d{0,3}%`)},
-	tokenPattern{pixels, regexp.MustCompile(`^\d+px`)},
-	tokenPattern{idName, regexp.MustCompile(`^#[a-zA-Z0-9_-]+`)},
-	tokenPattern{className, regexp.MustCompile(`^\.[a-zA-Z0-9_-]+`)},
-	tokenPattern{pseudoClass, regexp.MustCompile(`^:[a-zA-Z0-9_\(\)-]+`)},
-	tokenPattern{pseudoElm, regexp.MustCompile(`^::[a-zA-Z0-9_-]+`)},
-	tokenPattern{property, regexp.MustCompile(`^[a-zA-Z0-9_-]+:`)},
-	tokenPattern{comment, regexp.MustCompile(`(?ms)^/\*.*\*/`)},
-	// Catchall must be the last thing we match
-	tokenPattern{any, regexp.MustCompile(`^.`)},
-}
-
-// Token is a css token type and value
+// Token is a css token type and value, LineNum is the line in the source css
 type Token struct {
-	Type  tokenType
-	Value string
+	Type    tokenType
+	Value   string
+	LineNum int
 }
 
-// Style is a css propery and value
+// Style is a css propery and value, Line is the line it was declared on in the source css
 type Style struct {
 	Prop, Val string
+	Line      int
 }
 
-// Rule is a css block with a selector and a set of styles
+// Rule is a css block with a selector and a set of styles, Line is the line of the selector and
+// Order is its position among the rules, animations and at-rules of its script
 type Rule struct {
 	Selectors []Selector
 	Styles    []Style
+	Line      int
+	Order     int
 }
 
-// Selector is a css selector
+// Selector is a compound css selector, Comb is the combinator that joins it to the
+// previous selector in the rule ("" for descendant, ">", "+", "~" or "," for a new selector)
 type Selector struct {
 	Sel     string
 	PostSel string
+	Comb    string
 }
 
-// Anim is a css keyframe animation
+// Anim is a css keyframe animation, Prefix is the vendor prefix of the keyframes rule if it has one
+// and Order is its position in its script like a rule
 type Anim struct {
 	Name   string
+	Prefix string
 	Frames []Frame
+	Order  int
 }
 
 // Frame is a block inside a css keyframe animation
@@ -116,40 +79,64 @@ type Frame struct {
 	Styles []Style
 }
 
+// AtRule is a css at-rule, statements like @import only have a prelude, @font-face and @page
+// hold a block of styles and conditional rules like @media hold a nested script, Order is its
+// position in its script like a rule
+type AtRule struct {
+	Name    string
+	Prelude string
+	Styles  []Style
+	Script  *Script
+	Order   int
+}
+
+// styleAtRules are the at-rules that hold a block of styles rather than nested rules
+var styleAtRules = []string{"font-face", "page", "counter-style", "property", "font-palette-values", "viewport"}
+
+func isStyleAtRule(name string) bool {
+	for _, check := range styleAtRules {
+		if name == check {
+			return true
+		}
+	}
+	return false
+}
+
 // Script is a parsed css script
 type Script struct {
-	Rules []Rule
-	Anims []Anim
+	Rules   []Rule
+	Anims   []Anim
+	AtRules []AtRule
 }
 
 // Clone creates a deep clone of a script
 func (script *Script) Clone() *Script {
 	ret := &Script{}
 	for _, rule := range script.Rules {
-		add := Rule{}
+		add := Rule{Line: rule.Line, Order: rule.Order}
 		for _, sel := range rule.Selectors {
 			add.Selectors = append(
 				add.Selectors,
-				Selector{sel.Sel, sel.PostSel},
+				Selector{sel.Sel, sel.PostSel, sel.Comb},
 			)
 		}
 		for _, style := range rule.Styles {
 			add.Styles = append(
 				add.Styles,
-				Style{style.Prop, style.Val},
+				Style{style.Prop, style.Val, style.Line},
 			)
 		}
 		ret.Rules = append(ret.Rules, add)
 	}
 
 	for _, anim := range script.Anims {
-		add := Anim{Name: anim.Name}
+		add := Anim{Name: anim.Name, Prefix: anim.Prefix, Order: anim.Order}
 		for _, frame := range anim.Frames {
 			addFrame := Frame{Time: frame.Time}
 			for _, style := range frame.Styles {
 				addFrame.Styles = append(
 					addFrame.Styles,
-					Style{style.Prop, style.Val},
+					Style{style.Prop, style.Val, style.Line},
 				)
 			}
 			add.Frames = append(
@@ -160,27 +147,77 @@ func (script *Script) Clone() *Script {
 		ret.Anims = append(ret.Anims, add)
 	}
 
+	for _, at := range script.AtRules {
+		ret.AtRules = append(ret.AtRules, at.Clone())
+	}
+
 	return ret
 }
 
+// Clone creates a deep clone of an at-rule
+func (at AtRule) Clone() AtRule {
+	ret := AtRule{Name: at.Name, Prelude: at.Prelude, Order: at.Order}
+	for _, style := range at.Styles {
+		ret.Styles = append(ret.Styles, Style{style.Prop, style.Val, style.Line})
+	}
+	if at.Script != nil {
+		ret.Script = at.Script.Clone()
+	}
+	return ret
+}
+
+func (at AtRule) String() string {
+	ret := "@" + at.Name
+	if at.Prelude != "" {
+		ret += " " + at.Prelude
+	}
+
+	if at.Script != nil {
+		return ret + "{" + at.Script.String() + "}"
+	}
+
+	if isStyleAtRule(at.Name) {
+		props := []string{}
+		for _, prop := range at.Styles {
+			props = append(props, prop.Prop+":"+prop.Val)
+		}
+		return ret + "{" + strings.Join(props, ";") + "}"
+	}
+
+	return ret + ";"
+}
+
+// leadingAtRules are the at-rules that are ignored unless they come before every other rule
+var leadingAtRules = []string{"charset", "import", "namespace"}
+
+// String renders the script in source order so the cascade is kept, @charset, @import and
+// @namespace are always rendered first since browsers ignore them anywhere else
 func (script *Script) String() string {
-	ret := ""
-	for _, rule := range script.Rules {
-		sels := []string{}
-		for _, sel := range rule.Selectors {
-			sels = append(sels, sel.Sel+sel.PostSel)
+	type item struct {
+		order int
+		value string
+	}
+	items := []item{}
+	for _, at := range script.AtRules {
+		for _, check := range leadingAtRules {
+			if at.Name == check {
+				items = append(items, item{-1, at.String()})
+			}
 		}
-		ret += strings.Join(sels, " ") + "{"
+	}
+
+	for _, rule := range script.Rules {
+		ret := selectorString(rule.Selectors) + "{"
 
 		props := []string{}
 		for _, prop := range rule.Styles {
 			props = append(props, prop.Prop+":"+prop.Val)
 		}
-		ret += strings.Join(props, ";") + "}"
+		items = append(items, item{rule.Order, ret + strings.Join(props, ";") + "}"})
 	}
 
 	for _, anim := range script.Anims {
-		ret += "@keyframes " + anim.Name + "{"
+		ret := "@" + anim.Prefix + "keyframes " + anim.Name + "{"
 
 		for _, frame := range anim.Frames {
 			ret += frame.Time + "{"
@@ -191,231 +228,1008 @@ func (script *Script) String() string {
 			ret += strings.Join(props, ";") + "}"
 		}
 
-		ret += "}"
+		items = append(items, item{anim.Order, ret + "}"})
 	}
 
+	for _, at := range script.AtRules {
+		leading := false
+		for _, check := range leadingAtRules {
+			leading = leading || at.Name == check
+		}
+		if !leading {
+			items = append(items, item{at.Order, at.String()})
+		}
+	}
+
+	// stable so the prefixed copies of a rule stay in front of it
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].order < items[j].order
+	})
+
+	ret := ""
+	for _, add := range items {
+		ret += add.value
+	}
 	return ret
 }
 
-// AddClass add the class to all selectors in the script
-func (script *Script) AddClass(class string) {
-	if class == "" {
-		return
+// selectorString joins a list of selectors with their combinators
+func selectorString(sels []Selector) string {
+	ret := ""
+	for i, sel := range sels {
+		if i > 0 {
+			if sel.Comb == "" {
+				ret += " "
+			}
+			ret += sel.Comb
+		}
+		ret += sel.Sel + sel.PostSel
 	}
+	return ret
+}
+
+// AddClass scopes every compound selector in the script to the class, :global(...) selectors
+// are left unscoped and :host(...) selectors target the top level elements of the component
+func (script *Script) AddClass(class string) {
 	for i := 0; i < len(script.Rules); i++ {
 		for ii := 0; ii < len(script.Rules[i].Selectors); ii++ {
-			script.Rules[i].Selectors[ii].Sel += "." + class
+			script.Rules[i].Selectors[ii] = scopeSelector(script.Rules[i].Selectors[ii], class)
+		}
+	}
+
+	for _, at := range script.AtRules {
+		if at.Script != nil {
+			at.Script.AddClass(class)
 		}
 	}
 }
 
-// Lex will produce tokens from a string of css rules
-func Lex(css string) []Token {
-	tokens := []Token{}
-	i := 0
-	for i < len(css) {
-		for _, token := range tokenPatterns {
-			index := token.pattern.FindIndex([]byte(css[i:]))
-			if index != nil {
-				add := Token{
-					Type:  token.tType,
-					Value: css[i : i+index[1]],
-				}
+// HasHost returns true if any of the scripts selectors target the component host
+func (script *Script) HasHost() bool {
+	for _, rule := range script.Rules {
+		for _, sel := range rule.Selectors {
+			if _, _, ok := pseudoArgs(sel.PostSel, ":host"); ok {
+				return true
+			}
+		}
+	}
 
-				// if we overmatch the elmName so we need to give 1 char back
-				if token.tType == elmName {
-					old := len(add.Value)
-					add.Value = strings.Trim(add.Value, " {>.[:~+")
-					if len(add.Value) < old {
-						i--
-					}
+	for _, at := range script.AtRules {
+		if at.Script != nil && at.Script.HasHost() {
+			return true
+		}
+	}
+	return false
+}
+
+// AllStyles returns every style in the script including those nested in animations and at-rules
+func (script *Script) AllStyles() []*Style {
+	ret := []*Style{}
+	for i := range script.Rules {
+		for ii := range script.Rules[i].Styles {
+			ret = append(ret, &script.Rules[i].Styles[ii])
+		}
+	}
+
+	for i := range script.Anims {
+		for ii := range script.Anims[i].Frames {
+			for iii := range script.Anims[i].Frames[ii].Styles {
+				ret = append(ret, &script.Anims[i].Frames[ii].Styles[iii])
+			}
+		}
+	}
+
+	for i := range script.AtRules {
+		for ii := range script.AtRules[i].Styles {
+			ret = append(ret, &script.AtRules[i].Styles[ii])
+		}
+		if script.AtRules[i].Script != nil {
+			ret = append(ret, script.AtRules[i].Script.AllStyles()...)
+		}
+	}
+
+	return ret
+}
+
+var varPattern = regexp.MustCompile(`var\(\s*--([0-9a-zA-Z_-]+)`)
+
+// Vars returns the names of all the custom properties the script reads with var(), without the leading '--'
+func (script *Script) Vars() []string {
+	ret := []string{}
+	for _, style := range script.AllStyles() {
+		for _, match := range varPattern.FindAllStringSubmatch(style.Val, -1) {
+			found := false
+			for _, check := range ret {
+				if check == match[1] {
+					found = true
+					break
 				}
+			}
+			if !found {
+				ret = append(ret, match[1])
+			}
+		}
+	}
+	return ret
+}
 
-				tokens = append(tokens, add)
-				i += index[1]
-				break
+// ValidValue checks if text can be used as the value of a declaration on its own, it must not
+// end the declaration early with a ; or a block, or leave a string, comment or bracket open that
+// would take in what comes after it
+func ValidValue(text string) bool {
+	// a value that is complete ends at the semicolon added after it
+	raw := tokenize(text + ";")
+	depth := 0
+	for i, tok := range raw {
+		switch tok.Type {
+		case functionToken, openParenToken, openSquareToken:
+			depth++
+		case closeParenToken, closeSquareToken:
+			depth--
+			if depth < 0 {
+				return false
+			}
+		case openCurlyToken, closeCurlyToken, badStringToken, badURLToken:
+			return false
+		case semicolonToken:
+			if depth == 0 {
+				return i == len(raw)-1
 			}
 		}
 	}
+	return false
+}
 
-	// filter the results and lex attrBlocks
-	ret := []Token{}
-	i = 0
-	for i < len(tokens) {
-		if tokens[i].Type == comment || tokens[i].Type == newLine {
-			i++
+// pseudoArgs removes every name or name(...) pseudo-class from a selector, it returns what is
+// left, the arguments of each one and if there were any, brackets nested in the arguments like
+// :global(.a:not(.b)) are matched so the arguments are kept whole
+func pseudoArgs(sel, name string) (string, []string, bool) {
+	rest, args, found := "", []string{}, false
+	for {
+		i := strings.Index(sel, name)
+		if i < 0 {
+			return rest + sel, args, found
+		}
+		end := i + len(name)
+		if end < len(sel) && isNameChar(sel[end]) {
+			// a longer name like :host-context
+			rest += sel[:end]
+			sel = sel[end:]
 			continue
 		}
 
-		if tokens[i].Type == property {
-			tokens[i].Value = strings.Trim(tokens[i].Value, ":")
-			ret = append(ret, tokens[i])
-			i++
+		found = true
+		rest += sel[:i]
+		if end < len(sel) && sel[end] == '(' {
+			depth, j := 0, end
+			for ; j < len(sel); j++ {
+				if sel[j] == '(' {
+					depth++
+				}
+				if sel[j] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j == len(sel) {
+				args = append(args, sel[end+1:])
+				end = j
+			} else {
+				args = append(args, sel[end+1:j])
+				end = j + 1
+			}
+		}
+		sel = sel[end:]
+	}
+}
+
+func scopeSelector(sel Selector, class string) Selector {
+	if rest, args, ok := pseudoArgs(sel.PostSel, ":global"); ok && len(args) > 0 {
+		sel.Sel += strings.Join(args, "")
+		sel.PostSel = rest
+		return sel
+	}
+	if class == "" {
+		return sel
+	}
+
+	if rest, args, ok := pseudoArgs(sel.PostSel, ":host"); ok {
+		sel.Sel += "." + class + "-host" + strings.Join(args, "")
+		sel.PostSel = rest
+		return sel
+	}
+
+	// the document root can never be part of a component so leave it unscoped
+	elm := strings.ToLower(sel.Sel)
+	if elm == "html" || elm == "body" || (elm == "" && strings.HasPrefix(sel.PostSel, ":root")) {
+		return sel
+	}
+
+	sel.Sel += "." + class
+	return sel
+}
+
+var templatePattern = regexp.MustCompile(`"@[0-9a-zA-Z_-][0-9a-zA-Z_-]*@"`)
+
+// SplitTemplates removes all the styles that use "@param@" templates from the script and
+// returns them as a new script, rules and animations left without styles are dropped
+func (script *Script) SplitTemplates() Script {
+	ret := Script{}
+
+	rules := []Rule{}
+	for _, rule := range script.Rules {
+		static, templated := splitStyles(rule.Styles)
+		if len(templated) > 0 {
+			ret.Rules = append(ret.Rules, Rule{Selectors: cloneSelectors(rule.Selectors), Styles: templated, Line: rule.Line, Order: rule.Order})
+		}
+		if len(static) > 0 || len(templated) == 0 {
+			rules = append(rules, Rule{Selectors: rule.Selectors, Styles: static, Line: rule.Line, Order: rule.Order})
+		}
+	}
+	script.Rules = rules
+
+	// keyframes can't be split so any templated animation moves over whole
+	anims := []Anim{}
+	for _, anim := range script.Anims {
+		templated := false
+		for _, frame := range anim.Frames {
+			_, styles := splitStyles(frame.Styles)
+			if len(styles) > 0 {
+				templated = true
+			}
+		}
+		if templated {
+			ret.Anims = append(ret.Anims, anim)
+			continue
+		}
+		anims = append(anims, anim)
+	}
+	script.Anims = anims
+
+	atRules := []AtRule{}
+	for _, at := range script.AtRules {
+		if at.Script != nil {
+			templated := at.Script.SplitTemplates()
+			if !templated.Empty() {
+				ret.AtRules = append(ret.AtRules, AtRule{Name: at.Name, Prelude: at.Prelude, Script: &templated, Order: at.Order})
+			}
+			if !at.Script.Empty() || templated.Empty() {
+				atRules = append(atRules, at)
+			}
 			continue
 		}
 
-		if tokens[i].Type == openFn {
-			count, fn := lexFn(tokens[i:])
-			ret = append(ret, fn)
-			i += count
+		// like keyframes, style blocks move over whole
+		_, styles := splitStyles(at.Styles)
+		if len(styles) > 0 {
+			ret.AtRules = append(ret.AtRules, at)
 			continue
 		}
+		atRules = append(atRules, at)
+	}
+	script.AtRules = atRules
 
-		if tokens[i].Type == openAttrBlock {
-			count, block := lexAttrBlock(tokens[i:])
-			ret = append(ret, block)
-			i += count
+	return ret
+}
+
+// Empty returns true if the script has no rules, animations or at-rules
+func (script *Script) Empty() bool {
+	return len(script.Rules) == 0 && len(script.Anims) == 0 && len(script.AtRules) == 0
+}
+
+func splitStyles(styles []Style) ([]Style, []Style) {
+	static, templated := []Style{}, []Style{}
+	for _, style := range styles {
+		if templatePattern.MatchString(style.Val) {
+			templated = append(templated, style)
 			continue
 		}
+		static = append(static, style)
+	}
+	return static, templated
+}
 
-		ret = append(ret, tokens[i])
-		i++
+func cloneSelectors(sels []Selector) []Selector {
+	ret := []Selector{}
+	for _, sel := range sels {
+		ret = append(ret, Selector{sel.Sel, sel.PostSel, sel.Comb})
 	}
+	return ret
+}
 
-	// lex property values
-	tokens = ret
-	ret = []Token{}
-	i = 0
-	for i < len(tokens) {
-		if tokens[i].Type == whiteSpace {
-			if i+1 < len(tokens) && tokens[i+1].Type == openBlock {
-				i++
-				continue
+// Lex will produce tokens from a string of css rules
+func Lex(css string) []Token {
+	l := lexer{raw: tokenize(css)}
+	l.lexRules(false)
+	return l.tokens
+}
+
+// lexer groups raw tokens into the selector, property and value tokens used by the parser,
+// line is the source line of the item that is being lexed
+type lexer struct {
+	raw    []rawToken
+	pos    int
+	line   int
+	tokens []Token
+}
+
+func (l *lexer) done() bool {
+	return l.pos >= len(l.raw)
+}
+
+func (l *lexer) peek() rawToken {
+	if l.done() {
+		return rawToken{Type: whitespaceToken}
+	}
+	return l.raw[l.pos]
+}
+
+func (l *lexer) emit(tType tokenType, value string) {
+	l.tokens = append(l.tokens, Token{Type: tType, Value: value, LineNum: l.line})
+}
+
+// skipSpace moves past any whitespace, comments and html comment markers
+func (l *lexer) skipSpace() {
+	for !l.done() {
+		switch l.peek().Type {
+		case whitespaceToken, commentToken, cdoToken, cdcToken:
+			l.pos++
+		default:
+			return
+		}
+	}
+}
+
+// lexRules lexes a list of rules and at-rules, nested lists end at the closing bracket
+func (l *lexer) lexRules(nested bool) {
+	for {
+		l.skipSpace()
+		if l.done() {
+			return
+		}
+
+		switch l.peek().Type {
+		case closeCurlyToken:
+			if nested {
+				return
 			}
-			// just set this to be not a selector type
-			prev := any
-			if i > 0 {
-				prev = tokens[i-1].Type
-			}
-			if prev != elmName &&
-				prev != className &&
-				prev != idName &&
-				prev != pseudoClass &&
-				prev != pseudoElm &&
-				prev != attrBlock &&
-				prev != closeAttrBlock {
-				i++
+			l.pos++
+		case semicolonToken:
+			l.pos++
+		case atKeywordToken:
+			l.lexAtRule(false)
+		default:
+			l.lexRule()
+		}
+	}
+}
+
+// lexRule lexes a selector and the block of styles and nested rules that follows it
+func (l *lexer) lexRule() {
+	l.line = l.peek().Line
+	l.lexSelector()
+	if l.done() {
+		return
+	}
+	l.line = l.peek().Line
+	l.pos++
+	l.emit(openBlock, "{")
+	l.lexStyles()
+	l.closeBlock()
+}
+
+func (l *lexer) closeBlock() {
+	if !l.done() {
+		l.line = l.peek().Line
+		l.pos++
+		l.emit(closeBlock, "}")
+	}
+}
+
+// lexAtRule lexes an at-rule, the blocks of at-rules nested in a rule hold styles as well as rules
+func (l *lexer) lexAtRule(nested bool) {
+	l.line = l.peek().Line
+	name := strings.ToLower(l.peek().Name)
+	l.pos++
+
+	if strings.HasSuffix(name, "keyframes") {
+		l.emit(keyframe, "@"+name+" "+l.collect(false))
+		if l.done() || l.peek().Type != openCurlyToken {
+			return
+		}
+		l.line = l.peek().Line
+		l.pos++
+		l.emit(openBlock, "{")
+		l.lexFrames()
+		l.closeBlock()
+		return
+	}
+
+	l.emit(atRule, strings.TrimSpace("@"+name+" "+l.collect(false)))
+	if l.done() {
+		return
+	}
+	if l.peek().Type == semicolonToken {
+		l.line = l.peek().Line
+		l.pos++
+		l.emit(semiColon, ";")
+		return
+	}
+
+	l.line = l.peek().Line
+	l.pos++
+	l.emit(openBlock, "{")
+	if isStyleAtRule(name) || nested {
+		l.lexStyles()
+	} else {
+		l.lexRules(true)
+	}
+	l.closeBlock()
+}
+
+// lexFrames lexes the frames inside a keyframes block
+func (l *lexer) lexFrames() {
+	for {
+		l.skipSpace()
+		if l.done() || l.peek().Type == closeCurlyToken {
+			return
+		}
+
+		l.line = l.peek().Line
+		time := strings.ReplaceAll(l.collect(false), ", ", ",")
+		if l.done() || l.peek().Type != openCurlyToken {
+			l.pos++
+			continue
+		}
+		l.emit(percentage, time)
+		l.line = l.peek().Line
+		l.pos++
+		l.emit(openBlock, "{")
+		l.lexStyles()
+		l.closeBlock()
+	}
+}
+
+// lexStyles lexes a block of property value pairs and nested rules, invalid declarations are dropped
+func (l *lexer) lexStyles() {
+	for {
+		l.skipSpace()
+		if l.done() || l.peek().Type == closeCurlyToken {
+			return
+		}
+
+		if l.peek().Type == atKeywordToken {
+			l.lexAtRule(true)
+			continue
+		}
+		if l.nestedRule() {
+			l.lexRule()
+			continue
+		}
+
+		if l.peek().Type == identToken {
+			l.line = l.peek().Line
+			prop := l.peek().Value
+			start := l.pos
+			l.pos++
+			l.skipSpace()
+			if !l.done() && l.peek().Type == colonToken {
+				l.pos++
+				l.emit(property, prop)
+				l.emit(value, l.collect(true))
+				if !l.done() && l.peek().Type == semicolonToken {
+					l.pos++
+				}
 				continue
 			}
+			l.pos = start
 		}
 
-		if tokens[i].Type == property {
-			ret = append(ret, tokens[i])
-			i++
-			count, val := lexValue(tokens[i:])
-			ret = append(ret, val)
-			i += count
-			continue
+		l.collect(true)
+		if !l.done() && l.peek().Type == semicolonToken {
+			l.pos++
 		}
+	}
+}
 
-		ret = append(ret, tokens[i])
-		i++
+// nestedRule looks ahead to check if the next item in a block is a nested rule rather than
+// a declaration, rules are followed by a block before the end of the declaration
+func (l *lexer) nestedRule() bool {
+	if strings.HasPrefix(l.peek().Value, "--") {
+		// custom properties can hold blocks
+		return false
 	}
 
-	return ret
+	depth := 0
+	for _, tok := range l.raw[l.pos:] {
+		switch tok.Type {
+		case functionToken, openParenToken, openSquareToken:
+			depth++
+		case closeParenToken, closeSquareToken:
+			depth--
+		case openCurlyToken:
+			return depth <= 0
+		case semicolonToken, closeCurlyToken:
+			if depth <= 0 {
+				return false
+			}
+		}
+	}
+	return false
 }
 
-func lexFn(css []Token) (int, Token) {
-	ret := Token{Type: function, Value: css[0].Value}
-	i := 1
-	for i < len(css) {
-		tok := css[i].Type
-		ret.Value += css[i].Value
-		i++
-		if tok == closeFn {
-			return i, ret
+// collect returns the source text up to the next top level semicolon or bracket with all
+// comments removed and whitespace collapsed, a closing bracket always ends the text but an
+// opening bracket is only included when inBlock is set
+func (l *lexer) collect(inBlock bool) string {
+	ret := ""
+	depth := 0
+	space := false
+	for !l.done() {
+		tok := l.peek()
+		switch tok.Type {
+		case functionToken, openParenToken, openSquareToken:
+			depth++
+		case closeParenToken, closeSquareToken:
+			depth--
+		case openCurlyToken:
+			if depth <= 0 && !inBlock {
+				return strings.TrimSpace(ret)
+			}
+			depth++
+		case closeCurlyToken:
+			if depth <= 0 {
+				return strings.TrimSpace(ret)
+			}
+			depth--
+		case semicolonToken:
+			if depth <= 0 {
+				return strings.TrimSpace(ret)
+			}
+		case whitespaceToken, commentToken:
+			space = true
+			l.pos++
+			continue
 		}
+
+		if space && ret != "" {
+			ret += " "
+		}
+		space = false
+		ret += tok.Value
+		l.pos++
 	}
-	return 0, Token{}
+	return strings.TrimSpace(ret)
 }
 
-func lexValue(css []Token) (int, Token) {
-	ret := Token{Type: value}
-	leading := true
-	i := 0
-	for i < len(css) {
-		tok := css[i].Type
-		if tok == whiteSpace && leading {
-			i++
+// lexSelector lexes the selector tokens up to the opening bracket of a rule
+func (l *lexer) lexSelector() {
+	space := false
+	for !l.done() {
+		tok := l.peek()
+		if tok.Type == openCurlyToken {
+			return
+		}
+		if tok.Type == whitespaceToken || tok.Type == commentToken {
+			space = true
+			l.pos++
 			continue
 		}
-		leading = false
 
-		if tok == semiColon {
-			ret.Value = strings.TrimSpace(ret.Value)
-			return i + 1, ret
+		if space && len(l.tokens) > 0 {
+			switch l.tokens[len(l.tokens)-1].Type {
+			case elmName, className, idName, pseudoClass, pseudoElm, attrBlock, star, nesting:
+				l.emit(whiteSpace, " ")
+			}
 		}
-		if tok == property || tok == closeBlock {
-			ret.Value = strings.TrimSpace(ret.Value)
-			return i, ret
+		space = false
+		l.line = tok.Line
+		l.pos++
+
+		switch tok.Type {
+		case identToken:
+			l.emit(elmName, tok.Value)
+		case hashToken:
+			l.emit(idName, tok.Value)
+		case commaToken:
+			l.emit(comma, ",")
+		case openSquareToken:
+			l.emit(attrBlock, "["+l.collectBlock(closeSquareToken)+"]")
+		case colonToken:
+			l.lexPseudo()
+		case delimToken:
+			switch tok.Value {
+			case ".":
+				if !l.done() && l.peek().Type == identToken {
+					l.emit(className, "."+l.peek().Value)
+					l.pos++
+					continue
+				}
+				l.emit(any, tok.Value)
+			case "*":
+				l.emit(star, tok.Value)
+			case "&":
+				l.emit(nesting, tok.Value)
+			case ">":
+				l.emit(child, tok.Value)
+			case "+":
+				l.emit(nextChild, tok.Value)
+			case "~":
+				l.emit(preceded, tok.Value)
+			default:
+				l.emit(any, tok.Value)
+			}
+		default:
+			l.emit(any, tok.Value)
 		}
+	}
+}
 
-		ret.Value += css[i].Value
-		i++
+// lexPseudo lexes a pseudo class or element, the leading colon has already been consumed
+func (l *lexer) lexPseudo() {
+	tType, prefix := pseudoClass, ":"
+	if !l.done() && l.peek().Type == colonToken {
+		tType, prefix = pseudoElm, "::"
+		l.pos++
+	}
+	if l.done() {
+		l.emit(any, prefix)
+		return
+	}
+
+	tok := l.peek()
+	l.pos++
+	switch tok.Type {
+	case identToken:
+		l.emit(tType, prefix+tok.Value)
+	case functionToken:
+		l.emit(tType, prefix+tok.Value+l.collectBlock(closeParenToken)+")")
+	default:
+		l.emit(any, prefix+tok.Value)
 	}
-	return 0, Token{}
 }
 
-func lexAttrBlock(css []Token) (int, Token) {
-	ret := Token{Type: attrBlock, Value: css[0].Value}
-	i := 1
-	for i < len(css) {
-		tok := css[i].Type
-		ret.Value += css[i].Value
-		i++
-		if tok == closeAttrBlock {
-			return i, ret
+// collectBlock returns the source text up to the matching closing token, which is consumed
+func (l *lexer) collectBlock(end rawType) string {
+	ret := ""
+	depth := 0
+	space := false
+	for !l.done() {
+		tok := l.peek()
+		l.pos++
+		switch tok.Type {
+		case functionToken, openParenToken, openSquareToken:
+			depth++
+		case closeParenToken, closeSquareToken:
+			if depth == 0 && tok.Type == end {
+				return strings.TrimSpace(ret)
+			}
+			depth--
+		case whitespaceToken, commentToken:
+			space = true
+			continue
+		}
+
+		if space && ret != "" {
+			ret += " "
 		}
+		space = false
+		ret += tok.Value
 	}
-	return 0, Token{}
+	return strings.TrimSpace(ret)
 }
 
 // Parse will parse a serise of tokens generated by the lexer into a Script object
 func Parse(css []Token) (Script, error) {
+	i, ret, err := parseScript(css)
+	if err != nil {
+		return Script{}, err
+	}
+	if i < len(css) {
+		return Script{}, fmt.Errorf("failed to parse css token, '%s'", css[i].Value)
+	}
+
+	return ret, nil
+}
+
+// parseScript parses tokens into a Script until it reaches the end of the tokens or a closing block
+func parseScript(css []Token) (int, Script, error) {
 	ret := Script{}
 	i := 0
 	start := 0
 	for i < len(css) {
 		start = i
 
+		if css[i].Type == closeBlock {
+			return i, ret, nil
+		}
+
 		count, anim := parseAnim(css[i:])
 		if count > 0 {
 			i += count
+			anim.Order = ret.next()
 			ret.Anims = append(ret.Anims, anim)
 			continue
 		}
 
-		count, rule := parseRule(css[i:])
+		count, at, err := parseAtRule(css[i:], nil)
+		if err != nil {
+			return 0, Script{}, err
+		}
 		if count > 0 {
 			i += count
-			ret.Rules = append(ret.Rules, rule)
+			at.Order = ret.next()
+			ret.AtRules = append(ret.AtRules, at)
+			continue
+		}
+
+		count, rules, err := parseRule(css[i:], nil)
+		if err != nil {
+			return 0, Script{}, err
+		}
+		if count > 0 {
+			i += count
+			ret.merge(rules)
 			continue
 		}
 
 		if i == start {
-			return Script{}, fmt.Errorf("failed to parse css token, '%s'", css[i].Value)
+			return 0, Script{}, fmt.Errorf("failed to parse css token, '%s'", css[i].Value)
 		}
 	}
 
-	return ret, nil
+	return i, ret, nil
+}
+
+// parseAtRule parses an at-rule, the block of an at-rule nested inside a rule is parsed as
+// though it was the block of the parent rule
+func parseAtRule(css []Token, parents []Selector) (int, AtRule, error) {
+	if css[0].Type != atRule {
+		return 0, AtRule{}, nil
+	}
+
+	ret := AtRule{}
+	parts := strings.SplitN(css[0].Value[1:], " ", 2)
+	ret.Name = strings.ToLower(parts[0])
+	if len(parts) > 1 {
+		ret.Prelude = parts[1]
+	}
+
+	if len(css) < 2 {
+		return 1, ret, nil
+	}
+	if css[1].Type == semiColon {
+		return 2, ret, nil
+	}
+	if css[1].Type != openBlock {
+		return 0, AtRule{}, fmt.Errorf("failed to parse at-rule '%s'", css[0].Value)
+	}
+
+	if isStyleAtRule(ret.Name) {
+		count, styles := parseBlock(css[1:])
+		if count == 0 {
+			return 0, AtRule{}, fmt.Errorf("failed to parse at-rule '%s'", css[0].Value)
+		}
+		ret.Styles = styles
+		return count + 1, ret, nil
+	}
+
+	if parents != nil {
+		count, script, err := parseNested(css[1:], parents)
+		if err != nil {
+			return 0, AtRule{}, err
+		}
+		if count == 0 {
+			return 0, AtRule{}, fmt.Errorf("missing closing bracket for at-rule '%s'", css[0].Value)
+		}
+		ret.Script = &script
+		return count + 1, ret, nil
+	}
+
+	count, script, err := parseScript(css[2:])
+	if err != nil {
+		return 0, AtRule{}, err
+	}
+	if 2+count >= len(css) {
+		return 0, AtRule{}, fmt.Errorf("missing closing bracket for at-rule '%s'", css[0].Value)
+	}
+	ret.Script = &script
+
+	// +3 for the at-rule, the opening bracket and the closing bracket
+	return count + 3, ret, nil
+}
+
+// parseRule parses a rule and flattens any rules nested inside it, the first rule in the
+// returned script is always the rule itself
+func parseRule(css []Token, parents []Selector) (int, Script, error) {
+	i, sels := parseSelector(css)
+	if i == 0 {
+		return 0, Script{}, nil
+	}
+	if parents != nil {
+		sels = nestSelectors(parents, sels)
+	}
+
+	count, ret, err := parseNested(css[i:], sels)
+	if err != nil {
+		return 0, Script{}, err
+	}
+	if count == 0 {
+		return 0, Script{}, nil
+	}
+
+	return i + count, ret, nil
+}
+
+// parseNested parses the block of a rule, the styles go into a rule with the given selectors
+// and nested rules and at-rules are flattened out along side it
+func parseNested(css []Token, sels []Selector) (int, Script, error) {
+	rule := Rule{Selectors: cloneSelectors(sels), Line: css[0].LineNum}
+	nested := Script{}
+
+	// Expect the first token to be '{'
+	i := 1
+	add := Style{}
+	for i < len(css) {
+		switch css[i].Type {
+		case property:
+			add.Prop = css[i].Value
+			add.Line = css[i].LineNum
+			i++
+		case value:
+			add.Val = css[i].Value
+			rule.Styles = append(rule.Styles, add)
+			add = Style{}
+			i++
+		case closeBlock:
+			ret := Script{}
+			if len(rule.Styles) > 0 || nested.Empty() {
+				ret.Rules = append(ret.Rules, rule)
+			}
+			ret.merge(nested)
+			return i + 1, ret, nil
+		case keyframe:
+			count, anim := parseAnim(css[i:])
+			if count == 0 {
+				return 0, Script{}, fmt.Errorf("failed to parse css token, '%s'", css[i].Value)
+			}
+			anim.Order = nested.next()
+			nested.Anims = append(nested.Anims, anim)
+			i += count
+		case atRule:
+			count, at, err := parseAtRule(css[i:], sels)
+			if err != nil {
+				return 0, Script{}, err
+			}
+			at.Order = nested.next()
+			nested.AtRules = append(nested.AtRules, at)
+			i += count
+		default:
+			count, rules, err := parseRule(css[i:], sels)
+			if err != nil {
+				return 0, Script{}, err
+			}
+			if count == 0 {
+				return 0, Script{}, fmt.Errorf("failed to parse css token, '%s'", css[i].Value)
+			}
+			nested.merge(rules)
+			i += count
+		}
+	}
+	return 0, Script{}, nil
+}
+
+// merge appends all the rules, animations and at-rules from another script, they are ordered
+// after everything already in the script
+func (script *Script) merge(add Script) {
+	next := script.next()
+	for _, rule := range add.Rules {
+		rule.Order += next
+		script.Rules = append(script.Rules, rule)
+	}
+	for _, anim := range add.Anims {
+		anim.Order += next
+		script.Anims = append(script.Anims, anim)
+	}
+	for _, at := range add.AtRules {
+		at.Order += next
+		script.AtRules = append(script.AtRules, at)
+	}
 }
 
-func parseRule(css []Token) (int, Rule) {
-	ret := Rule{}
+// next returns the order that comes after every rule, animation and at-rule in the script
+func (script *Script) next() int {
+	ret := 0
+	for _, rule := range script.Rules {
+		if rule.Order >= ret {
+			ret = rule.Order + 1
+		}
+	}
+	for _, anim := range script.Anims {
+		if anim.Order >= ret {
+			ret = anim.Order + 1
+		}
+	}
+	for _, at := range script.AtRules {
+		if at.Order >= ret {
+			ret = at.Order + 1
+		}
+	}
+	return ret
+}
+
+// nestSelectors resolves the selectors of a nested rule against the selectors of its parent,
+// the nesting selector '&' is replaced by the parent and selectors without one are treated
+// as descendants of the parent
+func nestSelectors(parents, sels []Selector) []Selector {
+	ret := []Selector{}
+	for _, parent := range splitSelectors(parents) {
+		for _, sel := range splitSelectors(sels) {
+			nested := nestSelector(parent, sel)
+			if len(ret) > 0 {
+				nested[0].Comb = ","
+			}
+			ret = append(ret, nested...)
+		}
+	}
+	return ret
+}
+
+func nestSelector(parent, sel []Selector) []Selector {
+	ret := []Selector{}
+	found := false
+	for _, part := range sel {
+		if !strings.Contains(part.Sel, "&") {
+			ret = append(ret, part)
+			continue
+		}
 
-	i, count := 0, 0
-	count, ret.Selectors = parseSelector(css)
-	i += count
+		// the parent's last compound selector is merged with the compound holding the '&'
+		found = true
+		last := parent[len(parent)-1]
+		outer := cloneSelectors(parent[:len(parent)-1])
+		merged := Selector{
+			Sel:     strings.ReplaceAll(part.Sel, "&", last.Sel),
+			PostSel: last.PostSel + part.PostSel,
+			Comb:    last.Comb,
+		}
+		if len(outer) > 0 {
+			outer[0].Comb = part.Comb
+		} else {
+			merged.Comb = part.Comb
+		}
+		ret = append(ret, outer...)
+		ret = append(ret, merged)
+	}
+	if found {
+		return ret
+	}
 
-	count, ret.Styles = parseBlock(css[i:])
-	i += count
+	// relative selectors like '> p' keep their combinator, everything else is a descendant
+	return append(cloneSelectors(parent), sel...)
+}
 
-	return i, ret
+// splitSelectors splits a selector list into its complex selectors, the comma combinator
+// is removed from the start of each one
+func splitSelectors(sels []Selector) [][]Selector {
+	ret := [][]Selector{}
+	for _, sel := range sels {
+		if sel.Comb == "," || len(ret) == 0 {
+			if sel.Comb == "," {
+				sel.Comb = ""
+			}
+			ret = append(ret, []Selector{})
+		}
+		ret[len(ret)-1] = append(ret[len(ret)-1], sel)
+	}
+	return ret
 }
 
 func parseSelector(css []Token) (int, []Selector) {
 	ret := []Selector{}
-	selectorTokens := []tokenType{star, elmName, className, idName, attrBlock}
+	selectorTokens := []tokenType{star, nesting, elmName, className, idName, attrBlock}
 	postSelectorTokens := []tokenType{pseudoClass, pseudoElm}
 	connectTokens := []tokenType{child, nextChild, preceded}
 
@@ -445,7 +1259,11 @@ func parseSelector(css []Token) (int, []Selector) {
 			}
 		}
 		if found {
-			add.Sel += css[i].Value
+			if add.Sel != "" || add.PostSel != "" {
+				ret = append(ret, add)
+				add = Selector{}
+			}
+			add.Comb = css[i].Value
 			i++
 			continue
 		}
@@ -464,14 +1282,27 @@ func parseSelector(css []Token) (int, []Selector) {
 		}
 
 		if tok == whiteSpace {
-			ret = append(ret, add)
-			add = Selector{}
+			if add.Sel != "" || add.PostSel != "" {
+				ret = append(ret, add)
+				add = Selector{}
+			}
+			i++
+			continue
+		}
+
+		if tok == comma {
+			if add.Sel != "" || add.PostSel != "" {
+				ret = append(ret, add)
+			}
+			add = Selector{Comb: ","}
 			i++
 			continue
 		}
 
 		if tok == openBlock {
-			ret = append(ret, add)
+			if add.Sel != "" || add.PostSel != "" {
+				ret = append(ret, add)
+			}
 			return i, ret
 		}
 
@@ -491,6 +1322,7 @@ func parseBlock(css []Token) (int, []Style) {
 
 		if tok == property {
 			add.Prop = css[i].Value
+			add.Line = css[i].LineNum
 			i++
 			continue
 		}
@@ -517,8 +1349,13 @@ func parseAnim(css []Token) (int, Anim) {
 		return 0, Anim{}
 	}
 
-	ret := Anim{Name: css[0].Value[11:]} // @keyframes [name is here]
-	i := 2                               //first two tokens should be 1) keyframe 2) openBlock
+	// @[prefix]keyframes [name is here]
+	parts := strings.SplitN(css[0].Value[1:], " ", 2)
+	ret := Anim{Prefix: strings.TrimSuffix(parts[0], "keyframes")}
+	if len(parts) > 1 {
+		ret.Name = parts[1]
+	}
+	i := 2 //first two tokens should be 1) keyframe 2) openBlock
 	var count int
 	for i < len(css) {
 		if css[i].Type != percentage {
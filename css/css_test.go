@@ -5,6 +5,11 @@ import (
 )
 
 func TestLex(t *testing.T) {
+	// the tokens are checked without their line numbers, TestLexLines covers those
+	type Token struct {
+		Type  tokenType
+		Value string
+	}
 	type test struct {
 		css   string
 		check []Token
@@ -188,6 +193,29 @@ func TestLex(t *testing.T) {
 				Token{closeBlock, "}"},
 			},
 		},
+		test{ // Test 7
+			css: `section > nav, my-element .icon\31 x:not(.a, .b) {
+				content: "a { b }"; /* comment } */
+				background: url(img/bg.png?a=1;b=2) no-repeat;
+			}`,
+			check: []Token{
+				Token{elmName, "section"},
+				Token{whiteSpace, " "},
+				Token{child, ">"},
+				Token{elmName, "nav"},
+				Token{comma, ","},
+				Token{elmName, "my-element"},
+				Token{whiteSpace, " "},
+				Token{className, ".icon\\31 x"},
+				Token{pseudoClass, ":not(.a, .b)"},
+				Token{openBlock, "{"},
+				Token{property, "content"},
+				Token{value, `"a { b }"`},
+				Token{property, "background"},
+				Token{value, "url(img/bg.png?a=1;b=2) no-repeat"},
+				Token{closeBlock, "}"},
+			},
+		},
 	}
 
 	for i, run := range tests {
@@ -212,6 +240,112 @@ func TestLex(t *testing.T) {
 	}
 }
 
+func TestLexLines(t *testing.T) {
+	type test struct {
+		css   string
+		lines []int
+	}
+
+	tests := []test{
+		test{
+			css:   "div {\n  color: red;\n\n  margin: 0;\n}",
+			lines: []int{1, 1, 2, 2, 4, 4, 5},
+		},
+		test{
+			css:   "/* a\n comment */ a,\nb {\n  color: \"a\\\nb\";\n}\n@media print {\n  a { top: 0 }\n}",
+			lines: []int{2, 2, 3, 3, 4, 4, 6, 7, 7, 8, 8, 8, 8, 8, 9},
+		},
+	}
+
+	for i, run := range tests {
+		tokens := Lex(run.css)
+		if len(tokens) != len(run.lines) {
+			t.Errorf("(%d): Incorect token count expected %d tokens but got %d", i, len(run.lines), len(tokens))
+			continue
+		}
+		for ii, tok := range tokens {
+			if tok.LineNum != run.lines[ii] {
+				t.Errorf("(%d|%d) Incorrect line for %s expected %d but got %d", i, ii, tok.Value, run.lines[ii], tok.LineNum)
+			}
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	type test struct {
+		css   string
+		check []rawToken
+	}
+
+	tests := []test{
+		test{
+			css: `#id.c>p{width:-1.5e2px;top:50%}`,
+			check: []rawToken{
+				rawToken{Type: hashToken, Value: "#id", Name: "id"},
+				rawToken{Type: delimToken, Value: "."},
+				rawToken{Type: identToken, Value: "c", Name: "c"},
+				rawToken{Type: delimToken, Value: ">"},
+				rawToken{Type: identToken, Value: "p", Name: "p"},
+				rawToken{Type: openCurlyToken, Value: "{"},
+				rawToken{Type: identToken, Value: "width", Name: "width"},
+				rawToken{Type: colonToken, Value: ":"},
+				rawToken{Type: dimensionToken, Value: "-1.5e2px"},
+				rawToken{Type: semicolonToken, Value: ";"},
+				rawToken{Type: identToken, Value: "top", Name: "top"},
+				rawToken{Type: colonToken, Value: ":"},
+				rawToken{Type: percentageToken, Value: "50%"},
+				rawToken{Type: closeCurlyToken, Value: "}"},
+			},
+		},
+		test{
+			css: `@media url( a.png ) url("b.png") 'it\'s' \@x`,
+			check: []rawToken{
+				rawToken{Type: atKeywordToken, Value: "@media", Name: "media"},
+				rawToken{Type: whitespaceToken, Value: " "},
+				rawToken{Type: urlToken, Value: "url( a.png )", Name: "url"},
+				rawToken{Type: whitespaceToken, Value: " "},
+				rawToken{Type: functionToken, Value: "url(", Name: "url"},
+				rawToken{Type: stringToken, Value: `"b.png"`},
+				rawToken{Type: closeParenToken, Value: ")"},
+				rawToken{Type: whitespaceToken, Value: " "},
+				rawToken{Type: stringToken, Value: `'it\'s'`},
+				rawToken{Type: whitespaceToken, Value: " "},
+				rawToken{Type: identToken, Value: `\@x`, Name: "@x"},
+			},
+		},
+		test{
+			css: "<!-- a\n\"broken\n-->",
+			check: []rawToken{
+				rawToken{Type: cdoToken, Value: "<!--"},
+				rawToken{Type: whitespaceToken, Value: " "},
+				rawToken{Type: identToken, Value: "a", Name: "a"},
+				rawToken{Type: whitespaceToken, Value: "\n"},
+				rawToken{Type: badStringToken, Value: `"broken`},
+				rawToken{Type: whitespaceToken, Value: "\n"},
+				rawToken{Type: cdcToken, Value: "-->"},
+			},
+		},
+	}
+
+	for i, run := range tests {
+		tokens := tokenize(run.css)
+
+		if len(tokens) != len(run.check) {
+			t.Errorf("(%d): Incorect token count expected %d tokens but got %d", i, len(run.check), len(tokens))
+		}
+
+		for ii, tok := range run.check {
+			if ii >= len(tokens) {
+				// prevent a crash when tokens have different counts
+				return
+			}
+			if tokens[ii].Type != tok.Type || tokens[ii].Value != tok.Value || tokens[ii].Name != tok.Name {
+				t.Errorf("(%d|%d) Incorrect token expected %v but got %v", i, ii, tok, tokens[ii])
+			}
+		}
+	}
+}
+
 func TestParseSelector(t *testing.T) {
 	type test struct {
 		css   string
@@ -242,7 +376,17 @@ func TestParseSelector(t *testing.T) {
 				Selector{Sel: "div"},
 				Selector{Sel: ".class"},
 				Selector{Sel: "a", PostSel: ":visited"},
-				Selector{Sel: "button>p", PostSel: "::before"},
+				Selector{Sel: "button"},
+				Selector{Sel: "p", PostSel: "::before", Comb: ">"},
+			},
+		},
+		test{
+			css: `html, body > div ~ :global(.outer .inner) {}`,
+			check: []Selector{
+				Selector{Sel: "html"},
+				Selector{Sel: "body", Comb: ","},
+				Selector{Sel: "div", Comb: ">"},
+				Selector{PostSel: ":global(.outer .inner)", Comb: "~"},
 			},
 		},
 	}
@@ -267,6 +411,10 @@ func TestParseSelector(t *testing.T) {
 			if sel.PostSel != run.check[ii].PostSel {
 				t.Errorf("(%d), post selector %d has a value of %s, was expecting %s", i, ii, sel.PostSel, run.check[ii].PostSel)
 			}
+
+			if sel.Comb != run.check[ii].Comb {
+				t.Errorf("(%d), combinator %d has a value of %s, was expecting %s", i, ii, sel.Comb, run.check[ii].Comb)
+			}
 		}
 	}
 }
@@ -376,7 +524,9 @@ func TestParseRule(t *testing.T) {
 			check: Rule{
 				Selectors: []Selector{
 					Selector{Sel: "select", PostSel: "::after"},
-					Selector{Sel: "table>tr+button"},
+					Selector{Sel: "table"},
+					Selector{Sel: "tr", Comb: ">"},
+					Selector{Sel: "button", Comb: "+"},
 				},
 				Styles: []Style{
 					Style{Prop: "position", Val: "absolute"},
@@ -390,7 +540,12 @@ func TestParseRule(t *testing.T) {
 
 	for i, run := range tests {
 		tokens := Lex(run.css)
-		_, rule := parseRule(tokens)
+		_, script, err := parseRule(tokens, nil)
+		if err != nil {
+			t.Errorf("(%d): failed to parse rule %s", i, err)
+			continue
+		}
+		rule := script.Rules[0]
 
 		if len(rule.Selectors) != len(run.check.Selectors) {
 			t.Errorf("(%d): Incorrect selector count expected %d tokens but got %d", i, len(run.check.Selectors), len(rule.Selectors))
@@ -942,6 +1097,65 @@ func TestAddClass(t *testing.T) {
 	}
 }
 
+func TestScope(t *testing.T) {
+	type test struct {
+		css   string
+		class string
+		check string
+	}
+
+	tests := []test{
+		test{
+			css:   `div > p::before { color: red; }`,
+			class: "k-x",
+			check: `div.k-x>p.k-x::before{color:red}`,
+		},
+		test{
+			css:   `a:hover, button + .btn:nth-child(2) { color: red; }`,
+			class: "k-x",
+			check: `a.k-x:hover,button.k-x+.btn.k-x:nth-child(2){color:red}`,
+		},
+		test{
+			css:   `html, body { margin: 0; }`,
+			class: "k-x",
+			check: `html,body{margin:0}`,
+		},
+		test{
+			css:   `:global(.theme-dark) div:global(.open) p { color: white; }`,
+			class: "k-x",
+			check: `.theme-dark div.open p.k-x{color:white}`,
+		},
+		test{
+			css:   `:host { display: block; } :host(.active) > span { color: red; }`,
+			class: "k-x",
+			check: `.k-x-host{display:block}.k-x-host.active>span.k-x{color:red}`,
+		},
+		test{
+			css:   `:global(h1) p { color: red; }`,
+			class: "",
+			check: `h1 p{color:red}`,
+		},
+		test{
+			css:   `:global(.a:not(.b)) p, :host(:not(.x)) span:hover { color: red; }`,
+			class: "k-x",
+			check: `.a:not(.b) p.k-x,.k-x-host:not(.x) span.k-x:hover{color:red}`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		script.AddClass(run.class)
+		scoped := script.String()
+		if scoped != run.check {
+			t.Errorf("(%d) scoped script got %s expected %s", i, scoped, run.check)
+		}
+	}
+}
+
 func TestString(t *testing.T) {
 	type test struct {
 		css   string
@@ -997,3 +1211,590 @@ func TestString(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitTemplates(t *testing.T) {
+	type test struct {
+		css       string
+		static    string
+		templated string
+	}
+
+	tests := []test{
+		test{
+			css: `div {
+				width: 100%;
+				border: 1px solid "@div_color@";
+			}
+			button {
+				color: "@txt_color@";
+			}
+			p {
+				margin: 0px;
+			}`,
+			static:    `div{width:100%}p{margin:0px}`,
+			templated: `div{border:1px solid "@div_color@"}button{color:"@txt_color@"}`,
+		},
+		test{
+			css: `@keyframes grow {
+				0% {
+					width: 0px;
+				}
+				100% {
+					width: "@width@";
+				}
+			}
+			@keyframes fade {
+				0% {
+					opacity: 0;
+				}
+			}`,
+			static:    `@keyframes fade{0%{opacity:0}}`,
+			templated: `@keyframes grow{0%{width:0px}100%{width:"@width@"}}`,
+		},
+		test{
+			css: `@media (max-width: 600px) {
+				div {
+					width: 100%;
+					color: "@color@";
+				}
+			}`,
+			static:    `@media (max-width: 600px){div{width:100%}}`,
+			templated: `@media (max-width: 600px){div{color:"@color@"}}`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		templated := script.SplitTemplates()
+		if script.String() != run.static {
+			t.Errorf("(%d) static script got %s expected %s", i, script.String(), run.static)
+		}
+		if templated.String() != run.templated {
+			t.Errorf("(%d) templated script got %s expected %s", i, templated.String(), run.templated)
+		}
+	}
+}
+
+func TestAtRules(t *testing.T) {
+	type test struct {
+		css    string
+		class  string
+		check  string
+		styles int
+	}
+
+	tests := []test{
+		test{
+			css: `@import url("theme.css") screen;
+			@charset "UTF-8";
+			div {
+				color: red !important;
+			}`,
+			check:  `@import url("theme.css") screen;@charset "UTF-8";div{color:red !important}`,
+			styles: 1,
+		},
+		test{
+			css: `@media screen and (max-width: 600px) {
+				div > p {
+					width: 100%;
+				}
+				@supports (display: grid) {
+					.grid {
+						display: grid;
+					}
+				}
+			}
+			p {
+				margin: 0px;
+			}`,
+			class:  "k-x",
+			check:  `@media screen and (max-width: 600px){div.k-x>p.k-x{width:100%}@supports (display: grid){.grid.k-x{display:grid}}}p.k-x{margin:0px}`,
+			styles: 3,
+		},
+		test{
+			css: `.a {
+				color: blue;
+			}
+			@media (min-width: 600px) {
+				.a {
+					color: red;
+				}
+			}
+			.a {
+				color: green;
+			}`,
+			check:  `.a{color:blue}@media (min-width: 600px){.a{color:red}}.a{color:green}`,
+			styles: 3,
+		},
+		test{
+			css: `@font-face {
+				font-family: "Open Sans";
+				src: url(/fonts/OpenSans.woff2) format("woff2");
+			}
+			@page :first {
+				margin: 1in;
+			}`,
+			class:  "k-x",
+			check:  `@font-face{font-family:"Open Sans";src:url(/fonts/OpenSans.woff2) format("woff2")}@page :first{margin:1in}`,
+			styles: 3,
+		},
+		test{
+			css: `@layer base, components;
+			@layer base {
+				html {
+					color: black;
+				}
+			}
+			@container card (min-width: 400px) {
+				h2 {
+					font-size: 2em;
+				}
+			}`,
+			class:  "k-x",
+			check:  `@layer base, components;@layer base{html{color:black}}@container card (min-width: 400px){h2.k-x{font-size:2em}}`,
+			styles: 2,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		if len(script.AllStyles()) != run.styles {
+			t.Errorf("(%d) wrong number of styles got %d expected %d", i, len(script.AllStyles()), run.styles)
+		}
+
+		clone := script.Clone()
+		script.AddClass(run.class)
+		if script.String() != run.check {
+			t.Errorf("(%d) scripts don't match got %s expected %s", i, script.String(), run.check)
+		}
+
+		clone.AddClass(run.class)
+		if clone.String() != run.check {
+			t.Errorf("(%d) cloned scripts don't match got %s expected %s", i, clone.String(), run.check)
+		}
+	}
+}
+
+func TestNesting(t *testing.T) {
+	type test struct {
+		css   string
+		class string
+		check string
+	}
+
+	tests := []test{
+		test{
+			css: `.card {
+				color: red;
+				& .title {
+					font-weight: bold;
+				}
+				&:hover, &.active {
+					color: blue;
+				}
+				> p {
+					margin: 0;
+				}
+				.page & {
+					color: green;
+				}
+			}`,
+			check: `.card{color:red}.card .title{font-weight:bold}.card:hover,.card.active{color:blue}.card>p{margin:0}.page .card{color:green}`,
+		},
+		test{
+			css: `ul li, ol li {
+				a {
+					color: red;
+					&:hover span {
+						color: blue;
+					}
+				}
+			}`,
+			class: "k-x",
+			check: `ul.k-x li.k-x a.k-x,ol.k-x li.k-x a.k-x{color:red}ul.k-x li.k-x a.k-x:hover span.k-x,ol.k-x li.k-x a.k-x:hover span.k-x{color:blue}`,
+		},
+		test{
+			css: `.card {
+				padding: 2em;
+				@media (max-width: 600px) {
+					padding: 1em;
+					& .title {
+						display: none;
+					}
+				}
+			}
+			@media print {
+				.card {
+					.title {
+						color: black;
+					}
+				}
+			}`,
+			class: "k-x",
+			check: `.card.k-x{padding:2em}@media (max-width: 600px){.card.k-x{padding:1em}.card.k-x .title.k-x{display:none}}@media print{.card.k-x .title.k-x{color:black}}`,
+		},
+		test{
+			css: `:root {
+				--theme: { color: red; };
+				a:hover { color: "@color@"; }
+			}`,
+			check: `:root{--theme:{ color: red; }}:root a:hover{color:"@color@"}`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		script.AddClass(run.class)
+		if script.String() != run.check {
+			t.Errorf("(%d) scripts don't match got %s expected %s", i, script.String(), run.check)
+		}
+	}
+}
+
+func TestVars(t *testing.T) {
+	type test struct {
+		css   string
+		check []string
+	}
+
+	tests := []test{
+		test{
+			css: `button {
+				color: var(--txt_color, black);
+				border: 1px solid var( --border-color );
+				@media print {
+					color: var(--txt_color);
+				}
+			}
+			@keyframes fade {
+				from { opacity: var(--from) }
+			}`,
+			check: []string{"txt_color", "border-color", "from"},
+		},
+		test{
+			css:   `button { color: "@color@"; --local: red; }`,
+			check: []string{},
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		vars := script.Vars()
+		if len(vars) != len(run.check) {
+			t.Errorf("(%d) wrong number of vars got %v expected %v", i, vars, run.check)
+			continue
+		}
+		for ii, name := range run.check {
+			if vars[ii] != name {
+				t.Errorf("(%d|%d) wrong var got %s expected %s", i, ii, vars[ii], name)
+			}
+		}
+	}
+}
+
+func TestValidValue(t *testing.T) {
+	type test struct {
+		val   string
+		check bool
+	}
+
+	tests := []test{
+		test{val: `red`, check: true},
+		test{val: `"Open Sans", serif`, check: true},
+		test{val: `calc(100% - 10px)`, check: true},
+		test{val: `url("a;b.png")`, check: true},
+		test{val: `red; background: url(evil.png)`, check: false},
+		test{val: `red"`, check: false},
+		test{val: `"red`, check: false},
+		test{val: `calc(1px`, check: false},
+		test{val: `1px)`, check: false},
+		test{val: `red } p { color: blue`, check: false},
+		test{val: `red /* open`, check: false},
+		test{val: `red\`, check: false},
+	}
+
+	for i, run := range tests {
+		if ValidValue(run.val) != run.check {
+			t.Errorf("(%d) expected %t for %s", i, run.check, run.val)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	type test struct {
+		css     string
+		targets string
+		check   string
+	}
+
+	tests := []test{
+		test{
+			css: `.box {
+				display: flex;
+				user-select: none;
+				-webkit-user-select: none;
+				transform: rotate(10deg);
+			}
+			input::placeholder {
+				color: gray;
+			}`,
+			targets: "safari 8, firefox 60",
+			check:   `.box{display:-webkit-flex;display:flex;-moz-user-select:none;user-select:none;-webkit-user-select:none;-webkit-transform:rotate(10deg);transform:rotate(10deg)}input::-webkit-input-placeholder{color:gray}input::placeholder{color:gray}`,
+		},
+		test{
+			css: `.box {
+				display: flex;
+				position: sticky;
+				animation: spin 1s;
+			}
+			@keyframes spin {
+				to { transform: rotate(360deg) }
+			}`,
+			targets: "chrome 100, safari 12",
+			check:   `.box{display:flex;position:-webkit-sticky;position:sticky;animation:spin 1s}@keyframes spin{to{transform:rotate(360deg)}}`,
+		},
+		test{
+			css: `@media print {
+				a:any-link::selection { hyphens: auto }
+			}
+			@keyframes fade {
+				from { opacity: 0 }
+			}`,
+			targets: "firefox 15",
+			check:   `@media print{a:any-link::-moz-selection{-moz-hyphens:auto;hyphens:auto}a:-moz-any-link::selection{-moz-hyphens:auto;hyphens:auto}a:any-link::selection{-moz-hyphens:auto;hyphens:auto}}@-moz-keyframes fade{from{opacity:0}}@keyframes fade{from{opacity:0}}`,
+		},
+		test{
+			css:     `.box { transform: none }`,
+			targets: "",
+			check:   `.box{transform:none}`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+		targets, err := ParseTargets(run.targets)
+		if err != nil {
+			t.Errorf("(%d) error parsing targets %s", i, err)
+		}
+
+		script.Prefix(targets)
+		if script.String() != run.check {
+			t.Errorf("(%d) scripts don't match got %s expected %s", i, script.String(), run.check)
+		}
+	}
+
+	bad := []string{"safari", "netscape 4", "chrome latest"}
+	for i, targets := range bad {
+		_, err := ParseTargets(targets)
+		if err == nil {
+			t.Errorf("(%d) expected an error parsing targets %s", i, targets)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	type test struct {
+		css   string
+		used  []string
+		check string
+	}
+
+	tests := []test{
+		test{
+			css: `div.card, p.unused { color: red }
+			.unused { color: blue }
+			#main.k-x\31 { width: 100% }
+			@media print {
+				.unused { display: none }
+			}
+			@media screen {
+				div[title=x] > .card:hover { color: green }
+			}
+			@import url("a.css");`,
+			used:  []string{"div", "card", "main", "k-x1"},
+			check: `@import url("a.css");div.card{color:red}#main.k-x\31 {width:100%}@media screen{div[title=x]>.card:hover{color:green}}`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		script.Prune(func(sel []Selector) bool {
+			for _, part := range sel {
+				compound := part.Compound()
+				names := append([]string{compound.Tag}, compound.IDs...)
+				names = append(names, compound.Classes...)
+				for _, name := range names {
+					if name == "" {
+						continue
+					}
+					found := false
+					for _, used := range run.used {
+						if name == used {
+							found = true
+						}
+					}
+					if !found {
+						return false
+					}
+				}
+			}
+			return true
+		})
+		if script.String() != run.check {
+			t.Errorf("(%d) scripts don't match got %s expected %s", i, script.String(), run.check)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	type test struct {
+		css    string
+		params []string
+		check  []Issue
+	}
+
+	tests := []test{
+		test{
+			css: `.card {
+				colr: red;
+				width: 10;
+				margin: 0 auto;
+				height: calc(100% - 2 * 10px);
+				line-height: 1.5;
+			}
+			.empty {}
+			.box {
+				display: -webkit-flex;
+				display: flex;
+				color: #12345;
+				background-color: bleu;
+				border: 1px solid #fff;
+				color: "@txt_color@";
+				-webkit-user-select: none;
+				--custom: 10;
+			}`,
+			params: []string{"color"},
+			check: []Issue{
+				Issue{2, "unknown property 'colr'"},
+				Issue{3, "length '10' for 'width' is missing a unit"},
+				Issue{8, "empty rule '.empty'"},
+				Issue{12, "invalid color '#12345'"},
+				Issue{13, "invalid color 'bleu'"},
+				Issue{15, "duplicate property 'color'"},
+				Issue{15, "template \"@txt_color@\" refers to an undeclared parameter"},
+			},
+		},
+		test{
+			css: `@media print {
+				a { color: RED; padding: 0 }
+			}
+			@keyframes fade {
+				to { opacity: 0; top: 5 }
+			}
+			@font-face {
+				font-family: "Open Sans";
+			}`,
+			check: []Issue{
+				Issue{5, "length '5' for 'top' is missing a unit"},
+			},
+		},
+		test{
+			css: `p {
+				color: #000000"@c@";
+				width: 100px;
+				width: calc(100% - 10px);
+				margin: "@gap@";
+			}`,
+			params: []string{"a", "c"},
+			check: []Issue{
+				Issue{5, "template \"@gap@\" refers to an undeclared parameter"},
+			},
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		issues := script.Lint(run.params)
+		if len(issues) != len(run.check) {
+			t.Errorf("(%d) wrong number of issues got %v expected %v", i, issues, run.check)
+			continue
+		}
+		for ii, issue := range run.check {
+			if issues[ii] != issue {
+				t.Errorf("(%d|%d) wrong issue got %s expected %s", i, ii, issues[ii], issue)
+			}
+		}
+	}
+}
+
+func TestRewriteURLs(t *testing.T) {
+	type test struct {
+		css   string
+		check string
+	}
+
+	tests := []test{
+		test{
+			css: `div {
+				background: url( img/bg.png ) no-repeat, url("img/b g.png");
+				cursor: url('cur.cur'), auto;
+			}
+			@font-face {
+				src: url(fonts/a.woff2) format("woff2");
+			}`,
+			check: `div{background:url(/assets/img/bg.png) no-repeat, url("/assets/img/b g.png");cursor:url('/assets/cur.cur'), auto}@font-face{src:url(/assets/fonts/a.woff2) format("woff2")}`,
+		},
+		test{
+			css: `@import url(theme.css) screen;
+			@import "print.css" print;
+			@supports (display: grid) {
+				@import 'grid.css';
+			}`,
+			check: `@import url(/assets/theme.css) screen;@import "/assets/print.css" print;@supports (display: grid){@import '/assets/grid.css';}`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := Parse(Lex(run.css))
+		if err != nil {
+			t.Errorf("(%d) error parsing script %s", i, err)
+		}
+
+		err = script.RewriteURLs(func(url string) (string, error) {
+			return "/assets/" + url, nil
+		})
+		if err != nil {
+			t.Errorf("(%d) error rewriting urls %s", i, err)
+		}
+		if script.String() != run.check {
+			t.Errorf("(%d) scripts don't match got %s expected %s", i, script.String(), run.check)
+		}
+	}
+}
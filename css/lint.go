@@ -0,0 +1,274 @@
+package css
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Issue is a problem found while linting a script, Line is the line in the source css
+type Issue struct {
+	Line int
+	Msg  string
+}
+
+func (issue Issue) String() string {
+	return fmt.Sprintf("line %d: %s", issue.Line, issue.Msg)
+}
+
+// knownProperties are the standard css properties, custom properties and vendor prefixed
+// properties are always allowed
+var knownProperties = strings.Fields(`
+	accent-color align-content align-items align-self align-tracks all anchor-name animation
+	animation-composition animation-delay animation-direction animation-duration animation-fill-mode
+	animation-iteration-count animation-name animation-play-state animation-range animation-timeline
+	animation-timing-function appearance aspect-ratio backdrop-filter backface-visibility background
+	background-attachment background-blend-mode background-clip background-color background-image
+	background-origin background-position background-position-x background-position-y background-repeat
+	background-size block-size border border-block border-block-color border-block-end
+	border-block-end-color border-block-end-style border-block-end-width border-block-start
+	border-block-start-color border-block-start-style border-block-start-width border-block-style
+	border-block-width border-bottom border-bottom-color border-bottom-left-radius
+	border-bottom-right-radius border-bottom-style border-bottom-width border-collapse border-color
+	border-end-end-radius border-end-start-radius border-image border-image-outset border-image-repeat
+	border-image-slice border-image-source border-image-width border-inline border-inline-color
+	border-inline-end border-inline-end-color border-inline-end-style border-inline-end-width
+	border-inline-start border-inline-start-color border-inline-start-style border-inline-start-width
+	border-inline-style border-inline-width border-left border-left-color border-left-style
+	border-left-width border-radius border-right border-right-color border-right-style
+	border-right-width border-spacing border-start-end-radius border-start-start-radius border-style
+	border-top border-top-color border-top-left-radius border-top-right-radius border-top-style
+	border-top-width border-width bottom box-decoration-break box-shadow box-sizing break-after
+	break-before break-inside caption-side caret-color clear clip clip-path clip-rule color
+	color-interpolation color-interpolation-filters color-scheme column-count column-fill column-gap
+	column-rule column-rule-color column-rule-style column-rule-width column-span column-width columns
+	contain contain-intrinsic-block-size contain-intrinsic-height contain-intrinsic-inline-size
+	contain-intrinsic-size contain-intrinsic-width container container-name container-type content
+	content-visibility counter-increment counter-reset counter-set cursor cx cy d direction display
+	dominant-baseline empty-cells fill fill-opacity fill-rule filter flex flex-basis flex-direction
+	flex-flow flex-grow flex-shrink flex-wrap float flood-color flood-opacity font font-display
+	font-family font-feature-settings font-kerning font-language-override font-optical-sizing
+	font-palette font-size font-size-adjust font-stretch font-style font-synthesis font-variant
+	font-variant-alternates font-variant-caps font-variant-east-asian font-variant-emoji
+	font-variant-ligatures font-variant-numeric font-variant-position font-variation-settings
+	font-weight forced-color-adjust gap grid grid-area grid-auto-columns grid-auto-flow grid-auto-rows
+	grid-column grid-column-end grid-column-gap grid-column-start grid-gap grid-row grid-row-end
+	grid-row-gap grid-row-start grid-template grid-template-areas grid-template-columns
+	grid-template-rows hanging-punctuation height hyphenate-character hyphens image-orientation
+	image-rendering inherits initial-letter initial-value inline-size inset inset-block inset-block-end
+	inset-block-start inset-inline inset-inline-end inset-inline-start isolation justify-content
+	justify-items justify-self left letter-spacing lighting-color line-break line-clamp line-height
+	list-style list-style-image list-style-position list-style-type margin margin-block
+	margin-block-end margin-block-start margin-bottom margin-inline margin-inline-end
+	margin-inline-start margin-left margin-right margin-top marker marker-end marker-mid marker-start
+	mask mask-border mask-clip mask-composite mask-image mask-mode mask-origin mask-position
+	mask-repeat mask-size mask-type math-depth math-style max-block-size max-height max-inline-size
+	max-width min-block-size min-height min-inline-size min-width mix-blend-mode object-fit
+	object-position offset offset-anchor offset-distance offset-path offset-position offset-rotate
+	opacity order orphans outline outline-color outline-offset outline-style outline-width overflow
+	overflow-anchor overflow-block overflow-clip-margin overflow-inline overflow-wrap overflow-x
+	overflow-y overscroll-behavior overscroll-behavior-block overscroll-behavior-inline
+	overscroll-behavior-x overscroll-behavior-y padding padding-block padding-block-end
+	padding-block-start padding-bottom padding-inline padding-inline-end padding-inline-start
+	padding-left padding-right padding-top page page-break-after page-break-before page-break-inside
+	paint-order perspective perspective-origin place-content place-items place-self pointer-events
+	position position-anchor print-color-adjust quotes r resize right rotate row-gap ruby-align
+	ruby-position rx ry scale scroll-behavior scroll-margin scroll-margin-block scroll-margin-block-end
+	scroll-margin-block-start scroll-margin-bottom scroll-margin-inline scroll-margin-inline-end
+	scroll-margin-inline-start scroll-margin-left scroll-margin-right scroll-margin-top scroll-padding
+	scroll-padding-block scroll-padding-block-end scroll-padding-block-start scroll-padding-bottom
+	scroll-padding-inline scroll-padding-inline-end scroll-padding-inline-start scroll-padding-left
+	scroll-padding-right scroll-padding-top scroll-snap-align scroll-snap-stop scroll-snap-type
+	scroll-timeline scrollbar-color scrollbar-gutter scrollbar-width shape-image-threshold
+	shape-margin shape-outside shape-rendering size speak src stop-color stop-opacity stroke
+	stroke-dasharray stroke-dashoffset stroke-linecap stroke-linejoin stroke-miterlimit stroke-opacity
+	stroke-width syntax tab-size table-layout text-align text-align-last text-anchor
+	text-combine-upright text-decoration text-decoration-color text-decoration-line
+	text-decoration-skip-ink text-decoration-style text-decoration-thickness text-emphasis
+	text-emphasis-color text-emphasis-position text-emphasis-style text-indent text-justify
+	text-orientation text-overflow text-rendering text-shadow text-size-adjust text-transform
+	text-underline-offset text-underline-position text-wrap top touch-action transform transform-box
+	transform-origin transform-style transition transition-behavior transition-delay
+	transition-duration transition-property transition-timing-function translate unicode-bidi
+	unicode-range user-select vector-effect vertical-align view-timeline view-transition-name
+	visibility white-space white-space-collapse widows width will-change word-break word-spacing
+	word-wrap writing-mode x y z-index zoom
+`)
+
+// colorProperties take a single color value
+var colorProperties = strings.Fields(`
+	color background-color border-color border-top-color border-right-color border-bottom-color
+	border-left-color outline-color text-decoration-color caret-color accent-color column-rule-color
+	fill stroke stop-color flood-color lighting-color
+`)
+
+// namedColors are the css color keywords
+var namedColors = strings.Fields(`
+	aliceblue antiquewhite aqua aquamarine azure beige bisque black blanchedalmond blue blueviolet
+	brown burlywood cadetblue chartreuse chocolate coral cornflowerblue cornsilk crimson cyan
+	darkblue darkcyan darkgoldenrod darkgray darkgreen darkgrey darkkhaki darkmagenta
+	darkolivegreen darkorange darkorchid darkred darksalmon darkseagreen darkslateblue
+	darkslategray darkslategrey darkturquoise darkviolet deeppink deepskyblue dimgray dimgrey
+	dodgerblue firebrick floralwhite forestgreen fuchsia gainsboro ghostwhite gold goldenrod gray
+	green greenyellow grey honeydew hotpink indianred indigo ivory khaki lavender lavenderblush
+	lawngreen lemonchiffon lightblue lightcoral lightcyan lightgoldenrodyellow lightgray lightgreen
+	lightgrey lightpink lightsalmon lightseagreen lightskyblue lightslategray lightslategrey
+	lightsteelblue lightyellow lime limegreen linen magenta maroon mediumaquamarine mediumblue
+	mediumorchid mediumpurple mediumseagreen mediumslateblue mediumspringgreen mediumturquoise
+	mediumvioletred midnightblue mintcream mistyrose moccasin navajowhite navy oldlace olive
+	olivedrab orange orangered orchid palegoldenrod palegreen paleturquoise palevioletred
+	papayawhip peachpuff peru pink plum powderblue purple rebeccapurple red rosybrown royalblue
+	saddlebrown salmon sandybrown seagreen seashell sienna silver skyblue slateblue slategray
+	slategrey snow springgreen steelblue tan teal thistle tomato turquoise violet wheat white
+	whitesmoke yellow yellowgreen transparent currentcolor inherit initial unset revert
+	revert-layer none context-fill context-stroke
+`)
+
+// lengthProperties only take lengths so a number without a unit is a mistake unless it's zero
+var lengthProperties = strings.Fields(`
+	width height min-width min-height max-width max-height margin margin-top margin-right
+	margin-bottom margin-left padding padding-top padding-right padding-bottom padding-left top
+	right bottom left inset font-size letter-spacing word-spacing text-indent border-width
+	border-top-width border-right-width border-bottom-width border-left-width border-radius
+	border-top-left-radius border-top-right-radius border-bottom-left-radius
+	border-bottom-right-radius outline-width outline-offset gap row-gap column-gap grid-gap
+	column-width flex-basis block-size inline-size
+`)
+
+func contains(list []string, check string) bool {
+	for _, item := range list {
+		if item == check {
+			return true
+		}
+	}
+	return false
+}
+
+// Lint checks the script for common mistakes, params are the names of the parameters a
+// component declares and are used to check "@param@" templates, a nil list skips the check
+func (script *Script) Lint(params []string) []Issue {
+	ret := []Issue{}
+	for _, rule := range script.Rules {
+		if len(rule.Styles) == 0 {
+			ret = append(ret, Issue{rule.Line, fmt.Sprintf("empty rule '%s'", selectorString(rule.Selectors))})
+		}
+		ret = append(ret, lintStyles(rule.Styles)...)
+	}
+
+	for _, anim := range script.Anims {
+		for _, frame := range anim.Frames {
+			ret = append(ret, lintStyles(frame.Styles)...)
+		}
+	}
+
+	for _, at := range script.AtRules {
+		if at.Script != nil {
+			ret = append(ret, at.Script.Lint(nil)...)
+		}
+		if !isStyleAtRule(at.Name) {
+			continue
+		}
+		// at-rules like @font-face have their own descriptors so only check the values
+		for _, style := range at.Styles {
+			ret = append(ret, lintValue(style)...)
+		}
+	}
+
+	if params != nil {
+		ret = append(ret, script.LintTemplates(params)...)
+	}
+	return ret
+}
+
+// LintTemplates checks that every "@param@" template in the script refers to one of params
+func (script *Script) LintTemplates(params []string) []Issue {
+	ret := []Issue{}
+	for _, style := range script.AllStyles() {
+		for _, match := range templatePattern.FindAllString(style.Val, -1) {
+			name := match[2 : len(match)-2]
+			if !contains(params, name) {
+				ret = append(ret, Issue{style.Line, fmt.Sprintf("template %s refers to an undeclared parameter", match)})
+			}
+		}
+	}
+	return ret
+}
+
+func lintStyles(styles []Style) []Issue {
+	ret := []Issue{}
+	for i, style := range styles {
+		prop := strings.ToLower(style.Prop)
+		if !strings.HasPrefix(prop, "-") && !contains(knownProperties, prop) {
+			ret = append(ret, Issue{style.Line, fmt.Sprintf("unknown property '%s'", style.Prop)})
+		}
+
+		// repeating a property straight after itself with a new value is a fallback for older
+		// browsers e.g. width:100px;width:calc(...)
+		fallback := i > 0 && strings.ToLower(styles[i-1].Prop) == prop && styles[i-1].Val != style.Val
+		for _, prev := range styles[:i] {
+			if fallback || strings.ToLower(prev.Prop) != prop {
+				continue
+			}
+			// so is repeating it with a prefixed value
+			if prev.Val != style.Val && (strings.HasPrefix(prev.Val, "-") || strings.HasPrefix(style.Val, "-")) {
+				continue
+			}
+			ret = append(ret, Issue{style.Line, fmt.Sprintf("duplicate property '%s'", style.Prop)})
+			break
+		}
+
+		ret = append(ret, lintValue(style)...)
+	}
+	return ret
+}
+
+func lintValue(style Style) []Issue {
+	ret := []Issue{}
+	prop := strings.ToLower(style.Prop)
+
+	// the value of a template isn't known until the component is instanced
+	if templatePattern.MatchString(style.Val) {
+		return ret
+	}
+
+	raw := tokenize(style.Val)
+	depth := 0
+	values := 0
+	for _, tok := range raw {
+		switch tok.Type {
+		case functionToken, openParenToken:
+			depth++
+		case closeParenToken:
+			depth--
+		case hashToken:
+			if !validHex(tok.Name) {
+				ret = append(ret, Issue{style.Line, fmt.Sprintf("invalid color '%s'", tok.Value)})
+			}
+		case numberToken:
+			// numbers inside functions like calc() are allowed
+			if depth == 0 && contains(lengthProperties, prop) && strings.Trim(tok.Value, "+-0.") != "" {
+				ret = append(ret, Issue{style.Line, fmt.Sprintf("length '%s' for '%s' is missing a unit", tok.Value, style.Prop)})
+			}
+		}
+		if depth == 0 && tok.Type != whitespaceToken && tok.Type != commentToken {
+			values++
+		}
+	}
+
+	val := strings.ToLower(strings.TrimSpace(style.Val))
+	if contains(colorProperties, prop) && values == 1 && len(raw) > 0 && raw[0].Type == identToken && !contains(namedColors, val) {
+		ret = append(ret, Issue{style.Line, fmt.Sprintf("invalid color '%s'", style.Val)})
+	}
+	return ret
+}
+
+func validHex(hex string) bool {
+	if len(hex) != 3 && len(hex) != 4 && len(hex) != 6 && len(hex) != 8 {
+		return false
+	}
+	for i := 0; i < len(hex); i++ {
+		if !isHex(hex[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,389 @@
+package css
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Target is a browser and the oldest version of it that the css needs to support
+type Target struct {
+	Browser string
+	Version float64
+}
+
+// browsers are the browser names that can be used as targets
+var browsers = []string{"chrome", "edge", "firefox", "safari", "ios", "opera", "samsung"}
+
+// ParseTargets parses a comma separated list of browser targets e.g. "safari 12, firefox 60"
+func ParseTargets(list string) ([]Target, error) {
+	ret := []Target{}
+	for _, target := range strings.Split(list, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		parts := strings.Fields(strings.ToLower(target))
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid browser target '%s', targets should be in the form 'browser version'", target)
+		}
+
+		known := false
+		for _, check := range browsers {
+			if parts[0] == check {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown browser '%s' in target '%s'", parts[0], target)
+		}
+
+		version, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version '%s' in target '%s'", parts[1], target)
+		}
+		ret = append(ret, Target{Browser: parts[0], Version: version})
+	}
+	return ret, nil
+}
+
+// support is a prefix that a browser needs before the given version
+type support struct {
+	prefix  string
+	browser string
+	before  float64
+}
+
+// always is used for browsers that have not shipped the unprefixed version yet
+const always = 1000
+
+// the prefix tables are a bundled subset of the caniuse data so builds never need the network
+var (
+	flexSupport = []support{
+		{"-webkit-", "chrome", 29}, {"-webkit-", "safari", 9}, {"-webkit-", "ios", 9}, {"-webkit-", "opera", 16},
+	}
+	transformSupport = []support{
+		{"-webkit-", "chrome", 36}, {"-webkit-", "safari", 9}, {"-webkit-", "ios", 9}, {"-webkit-", "opera", 23},
+		{"-moz-", "firefox", 16},
+	}
+	animationSupport = []support{
+		{"-webkit-", "chrome", 43}, {"-webkit-", "safari", 9}, {"-webkit-", "ios", 9}, {"-webkit-", "opera", 30},
+		{"-moz-", "firefox", 16},
+	}
+	maskSupport = []support{
+		{"-webkit-", "chrome", 120}, {"-webkit-", "edge", 120}, {"-webkit-", "safari", 15.4}, {"-webkit-", "ios", 15.4},
+		{"-webkit-", "opera", 106}, {"-webkit-", "samsung", 25},
+	}
+)
+
+// propertyPrefixes are the properties that need prefixes in some browsers
+var propertyPrefixes = map[string][]support{
+	"appearance": {
+		{"-webkit-", "chrome", 84}, {"-webkit-", "edge", 84}, {"-webkit-", "safari", 15.4}, {"-webkit-", "ios", 15.4},
+		{"-webkit-", "opera", 70}, {"-webkit-", "samsung", 14}, {"-moz-", "firefox", 80},
+	},
+	"user-select": {
+		{"-webkit-", "chrome", 54}, {"-webkit-", "safari", always}, {"-webkit-", "ios", always}, {"-webkit-", "opera", 41},
+		{"-webkit-", "samsung", 6.2}, {"-moz-", "firefox", 69}, {"-ms-", "edge", 79},
+	},
+	"backdrop-filter": {
+		{"-webkit-", "safari", 18}, {"-webkit-", "ios", 18},
+	},
+	"text-size-adjust": {
+		{"-webkit-", "safari", always}, {"-webkit-", "ios", always}, {"-moz-", "firefox", always},
+	},
+	"hyphens": {
+		{"-webkit-", "safari", 17}, {"-webkit-", "ios", 17}, {"-moz-", "firefox", 43},
+	},
+	"tab-size": {
+		{"-moz-", "firefox", 91},
+	},
+	"box-decoration-break": {
+		{"-webkit-", "chrome", 130}, {"-webkit-", "edge", 130}, {"-webkit-", "safari", always}, {"-webkit-", "ios", always},
+		{"-webkit-", "opera", 115}, {"-webkit-", "samsung", always},
+	},
+	"clip-path": {
+		{"-webkit-", "chrome", 55}, {"-webkit-", "safari", 13.1}, {"-webkit-", "ios", 13.4}, {"-webkit-", "opera", 42},
+	},
+	"backface-visibility": {
+		{"-webkit-", "chrome", 36}, {"-webkit-", "safari", 15.4}, {"-webkit-", "ios", 15.4}, {"-moz-", "firefox", 16},
+	},
+	"mask":                       maskSupport,
+	"mask-image":                 maskSupport,
+	"mask-size":                  maskSupport,
+	"mask-position":              maskSupport,
+	"mask-repeat":                maskSupport,
+	"flex":                       flexSupport,
+	"flex-direction":             flexSupport,
+	"flex-wrap":                  flexSupport,
+	"flex-flow":                  flexSupport,
+	"flex-grow":                  flexSupport,
+	"flex-shrink":                flexSupport,
+	"flex-basis":                 flexSupport,
+	"justify-content":            flexSupport,
+	"align-items":                flexSupport,
+	"align-self":                 flexSupport,
+	"align-content":              flexSupport,
+	"order":                      flexSupport,
+	"transform":                  transformSupport,
+	"transform-origin":           transformSupport,
+	"transform-style":            transformSupport,
+	"perspective":                transformSupport,
+	"perspective-origin":         transformSupport,
+	"transition":                 transformSupport,
+	"transition-property":        transformSupport,
+	"transition-duration":        transformSupport,
+	"transition-delay":           transformSupport,
+	"transition-timing-function": transformSupport,
+	"animation":                  animationSupport,
+	"animation-name":             animationSupport,
+	"animation-duration":         animationSupport,
+	"animation-delay":            animationSupport,
+	"animation-direction":        animationSupport,
+	"animation-fill-mode":        animationSupport,
+	"animation-iteration-count":  animationSupport,
+	"animation-play-state":       animationSupport,
+	"animation-timing-function":  animationSupport,
+}
+
+// valuePrefixes are the property values that need prefixes in some browsers
+var valuePrefixes = map[string][]support{
+	"display:flex":        flexSupport,
+	"display:inline-flex": flexSupport,
+	"position:sticky": {
+		{"-webkit-", "safari", 13}, {"-webkit-", "ios", 13},
+	},
+}
+
+// pseudoPrefix is a prefixed name for a pseudo class or element
+type pseudoPrefix struct {
+	name string
+	support
+}
+
+// selectorPrefixes are the pseudo classes and elements that have prefixed names in some browsers
+var selectorPrefixes = []struct {
+	pseudo string
+	names  []pseudoPrefix
+}{
+	{"::placeholder", []pseudoPrefix{
+		{"::-webkit-input-placeholder", support{"-webkit-", "chrome", 57}},
+		{"::-webkit-input-placeholder", support{"-webkit-", "safari", 10.1}},
+		{"::-webkit-input-placeholder", support{"-webkit-", "ios", 10.3}},
+		{"::-moz-placeholder", support{"-moz-", "firefox", 51}},
+	}},
+	{":fullscreen", []pseudoPrefix{
+		{":-webkit-full-screen", support{"-webkit-", "chrome", 71}},
+		{":-webkit-full-screen", support{"-webkit-", "safari", 16.4}},
+		{":-webkit-full-screen", support{"-webkit-", "ios", always}},
+		{":-moz-full-screen", support{"-moz-", "firefox", 64}},
+	}},
+	{"::selection", []pseudoPrefix{
+		{"::-moz-selection", support{"-moz-", "firefox", 62}},
+	}},
+	{"::file-selector-button", []pseudoPrefix{
+		{"::-webkit-file-upload-button", support{"-webkit-", "chrome", 89}},
+		{"::-webkit-file-upload-button", support{"-webkit-", "safari", 14.1}},
+		{"::-webkit-file-upload-button", support{"-webkit-", "ios", 14.5}},
+	}},
+	{":any-link", []pseudoPrefix{
+		{":-webkit-any-link", support{"-webkit-", "chrome", 65}},
+		{":-webkit-any-link", support{"-webkit-", "safari", 9}},
+		{":-moz-any-link", support{"-moz-", "firefox", 50}},
+	}},
+}
+
+// keyframesSupport are the browsers that need @-webkit-keyframes
+var keyframesSupport = animationSupport
+
+// needsPrefix returns true if any of the targets are older than the supported version
+func needsPrefix(check support, targets []Target) bool {
+	for _, target := range targets {
+		if target.Browser == check.browser && target.Version < check.before {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixes returns every unique prefix from the list that is needed by the targets
+func prefixes(list []support, targets []Target) []string {
+	ret := []string{}
+	for _, check := range list {
+		if !needsPrefix(check, targets) {
+			continue
+		}
+		found := false
+		for _, prefix := range ret {
+			if prefix == check.prefix {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, check.prefix)
+		}
+	}
+	return ret
+}
+
+// Prefix adds the vendor prefixed declarations, selectors and keyframes that the targets need,
+// prefixes that are already written by hand are not duplicated
+func (script *Script) Prefix(targets []Target) {
+	if len(targets) == 0 {
+		return
+	}
+
+	rules := []Rule{}
+	for _, rule := range script.Rules {
+		rule.Styles = prefixStyles(rule.Styles, targets)
+		rules = append(rules, prefixRules(rule, targets)...)
+		rules = append(rules, rule)
+	}
+	script.Rules = rules
+
+	anims := []Anim{}
+	for _, anim := range script.Anims {
+		for i := range anim.Frames {
+			anim.Frames[i].Styles = prefixStyles(anim.Frames[i].Styles, targets)
+		}
+		if anim.Prefix == "" {
+			for _, prefix := range prefixes(keyframesSupport, targets) {
+				if script.hasAnim(prefix, anim.Name) {
+					continue
+				}
+				add := Script{Anims: []Anim{anim}}
+				add = *add.Clone()
+				add.Anims[0].Prefix = prefix
+				anims = append(anims, add.Anims[0])
+			}
+		}
+		anims = append(anims, anim)
+	}
+	script.Anims = anims
+
+	for i := range script.AtRules {
+		script.AtRules[i].Styles = prefixStyles(script.AtRules[i].Styles, targets)
+		if script.AtRules[i].Script != nil {
+			script.AtRules[i].Script.Prefix(targets)
+		}
+	}
+}
+
+func (script *Script) hasAnim(prefix, name string) bool {
+	for _, anim := range script.Anims {
+		if anim.Prefix == prefix && anim.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixStyles adds the prefixed declarations before each declaration that needs them
+func prefixStyles(styles []Style, targets []Target) []Style {
+	ret := []Style{}
+	for _, style := range styles {
+		prop := strings.ToLower(style.Prop)
+		for _, prefix := range prefixes(propertyPrefixes[prop], targets) {
+			add := Style{Prop: prefix + style.Prop, Val: style.Val}
+			if !hasStyle(styles, add) {
+				ret = append(ret, add)
+			}
+		}
+
+		val := strings.ToLower(style.Val)
+		for _, prefix := range prefixes(valuePrefixes[prop+":"+val], targets) {
+			add := Style{Prop: style.Prop, Val: prefix + style.Val}
+			if !hasStyle(styles, add) {
+				ret = append(ret, add)
+			}
+		}
+
+		ret = append(ret, style)
+	}
+	return ret
+}
+
+func hasStyle(styles []Style, check Style) bool {
+	for _, style := range styles {
+		if strings.ToLower(style.Prop) == strings.ToLower(check.Prop) && style.Val == check.Val {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixRules creates a copy of the rule for each prefixed selector the targets need, these can't
+// be added to the original selector list since browsers drop a whole rule if any selector is unknown
+func prefixRules(rule Rule, targets []Target) []Rule {
+	ret := []Rule{}
+	for _, pseudo := range selectorPrefixes {
+		if !ruleHasPseudo(rule, pseudo.pseudo) {
+			continue
+		}
+
+		done := []string{}
+		for _, name := range pseudo.names {
+			if !needsPrefix(name.support, targets) {
+				continue
+			}
+			found := false
+			for _, check := range done {
+				if check == name.name {
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			done = append(done, name.name)
+
+			add := Rule{Selectors: cloneSelectors(rule.Selectors), Order: rule.Order}
+			add.Styles = append(add.Styles, rule.Styles...)
+			for i := range add.Selectors {
+				add.Selectors[i].PostSel = replacePseudo(add.Selectors[i].PostSel, pseudo.pseudo, name.name)
+			}
+			ret = append(ret, add)
+		}
+	}
+	return ret
+}
+
+func ruleHasPseudo(rule Rule, pseudo string) bool {
+	for _, sel := range rule.Selectors {
+		if replacePseudo(sel.PostSel, pseudo, "") != sel.PostSel {
+			return true
+		}
+	}
+	return false
+}
+
+// replacePseudo replaces a pseudo class or element but not longer names that start with it
+func replacePseudo(postSel, pseudo, name string) string {
+	ret := ""
+	for {
+		i := strings.Index(strings.ToLower(postSel), pseudo)
+		if i < 0 {
+			return ret + postSel
+		}
+
+		end := i + len(pseudo)
+		if end < len(postSel) && (isNameChar(postSel[end]) || postSel[end] == '(') {
+			ret += postSel[:end]
+			postSel = postSel[end:]
+			continue
+		}
+		if pseudo[1] != ':' && i > 0 && postSel[i-1] == ':' {
+			// a pseudo class should not match the end of a pseudo element
+			ret += postSel[:end]
+			postSel = postSel[end:]
+			continue
+		}
+
+		ret += postSel[:i] + name
+		postSel = postSel[end:]
+	}
+}
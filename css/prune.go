@@ -0,0 +1,72 @@
+package css
+
+import (
+	"strings"
+)
+
+// Compound is a compound selector split into the simple selectors that can be checked against
+// an element, attribute selectors and pseudo classes are not included
+type Compound struct {
+	Tag     string
+	IDs     []string
+	Classes []string
+}
+
+// Compound splits the selector into its tag, ids and classes with any escapes resolved
+func (sel Selector) Compound() Compound {
+	ret := Compound{}
+	raw := tokenize(sel.Sel)
+	for i := 0; i < len(raw); i++ {
+		tok := raw[i]
+		switch {
+		case tok.Type == identToken:
+			ret.Tag = strings.ToLower(tok.Name)
+		case tok.Type == hashToken:
+			ret.IDs = append(ret.IDs, tok.Name)
+		case tok.Type == delimToken && tok.Value == "." && i+1 < len(raw) && raw[i+1].Type == identToken:
+			ret.Classes = append(ret.Classes, raw[i+1].Name)
+			i++
+		case tok.Type == openSquareToken:
+			for i < len(raw) && raw[i].Type != closeSquareToken {
+				i++
+			}
+		}
+	}
+	return ret
+}
+
+// Prune removes every complex selector that the keep function rejects, rules that are left
+// without any selectors and conditional at-rules that are left empty are removed
+func (script *Script) Prune(keep func(sel []Selector) bool) {
+	rules := []Rule{}
+	for _, rule := range script.Rules {
+		sels := []Selector{}
+		for _, sel := range splitSelectors(rule.Selectors) {
+			if !keep(sel) {
+				continue
+			}
+			if len(sels) > 0 {
+				sel[0].Comb = ","
+			}
+			sels = append(sels, sel...)
+		}
+		if len(sels) == 0 {
+			continue
+		}
+		rule.Selectors = sels
+		rules = append(rules, rule)
+	}
+	script.Rules = rules
+
+	atRules := []AtRule{}
+	for _, at := range script.AtRules {
+		if at.Script != nil {
+			at.Script.Prune(keep)
+			if at.Script.Empty() {
+				continue
+			}
+		}
+		atRules = append(atRules, at)
+	}
+	script.AtRules = atRules
+}
@@ -0,0 +1,422 @@
+package css
+
+import (
+	"strings"
+)
+
+// rawType is the type of a token as defined by the CSS Syntax Module Level 3
+type rawType int
+
+const (
+	identToken = rawType(iota)
+	functionToken
+	atKeywordToken
+	hashToken
+	stringToken
+	badStringToken
+	urlToken
+	badURLToken
+	delimToken
+	numberToken
+	percentageToken
+	dimensionToken
+	whitespaceToken
+	cdoToken
+	cdcToken
+	colonToken
+	semicolonToken
+	commaToken
+	openSquareToken
+	closeSquareToken
+	openParenToken
+	closeParenToken
+	openCurlyToken
+	closeCurlyToken
+	commentToken
+)
+
+// rawToken is a single token from the tokenizer, Value is the source text of the token
+// and Name is the unescaped name of ident, function, at-keyword and hash tokens
+type rawToken struct {
+	Type  rawType
+	Value string
+	Name  string
+	Line  int
+}
+
+// tokenizer implements the tokenization algorithm from https://www.w3.org/TR/css-syntax-3/#tokenization
+type tokenizer struct {
+	css string
+	pos int
+}
+
+// tokenize splits a css string into raw tokens
+func tokenize(css string) []rawToken {
+	// https://www.w3.org/TR/css-syntax-3/#input-preprocessing
+	css = strings.ReplaceAll(css, "\r\n", "\n")
+	css = strings.ReplaceAll(css, "\r", "\n")
+	css = strings.ReplaceAll(css, "\f", "\n")
+	css = strings.ReplaceAll(css, "\x00", "�")
+
+	t := tokenizer{css: css}
+	ret := []rawToken{}
+	line := 1
+	for t.pos < len(t.css) {
+		tok := t.next()
+		tok.Line = line
+		line += strings.Count(tok.Value, "\n")
+		ret = append(ret, tok)
+	}
+	return ret
+}
+
+func (t *tokenizer) peek(n int) byte {
+	if t.pos+n < len(t.css) {
+		return t.css[t.pos+n]
+	}
+	return 0
+}
+
+func (t *tokenizer) token(tType rawType, start int) rawToken {
+	return rawToken{Type: tType, Value: t.css[start:t.pos]}
+}
+
+func (t *tokenizer) next() rawToken {
+	start := t.pos
+	c := t.peek(0)
+
+	switch {
+	case c == '/' && t.peek(1) == '*':
+		end := strings.Index(t.css[t.pos+2:], "*/")
+		if end < 0 {
+			t.pos = len(t.css)
+		} else {
+			t.pos += end + 4
+		}
+		return t.token(commentToken, start)
+	case isWhiteSpace(c):
+		for t.pos < len(t.css) && isWhiteSpace(t.peek(0)) {
+			t.pos++
+		}
+		return t.token(whitespaceToken, start)
+	case c == '"' || c == '\'':
+		return t.consumeString(c)
+	case c == '#':
+		if isNameChar(t.peek(1)) || isEscape(t.peek(1), t.peek(2)) {
+			t.pos++
+			tok := rawToken{Type: hashToken, Name: t.consumeName()}
+			tok.Value = t.css[start:t.pos]
+			return tok
+		}
+	case c == '(':
+		t.pos++
+		return t.token(openParenToken, start)
+	case c == ')':
+		t.pos++
+		return t.token(closeParenToken, start)
+	case c == '[':
+		t.pos++
+		return t.token(openSquareToken, start)
+	case c == ']':
+		t.pos++
+		return t.token(closeSquareToken, start)
+	case c == '{':
+		t.pos++
+		return t.token(openCurlyToken, start)
+	case c == '}':
+		t.pos++
+		return t.token(closeCurlyToken, start)
+	case c == ',':
+		t.pos++
+		return t.token(commaToken, start)
+	case c == ':':
+		t.pos++
+		return t.token(colonToken, start)
+	case c == ';':
+		t.pos++
+		return t.token(semicolonToken, start)
+	case c == '+' || c == '.':
+		if startsNumber(c, t.peek(1), t.peek(2)) {
+			return t.consumeNumeric()
+		}
+	case c == '-':
+		if startsNumber(c, t.peek(1), t.peek(2)) {
+			return t.consumeNumeric()
+		}
+		if t.peek(1) == '-' && t.peek(2) == '>' {
+			t.pos += 3
+			return t.token(cdcToken, start)
+		}
+		if startsIdent(c, t.peek(1), t.peek(2)) {
+			return t.consumeIdentLike()
+		}
+	case c == '<':
+		if strings.HasPrefix(t.css[t.pos:], "<!--") {
+			t.pos += 4
+			return t.token(cdoToken, start)
+		}
+	case c == '@':
+		if startsIdent(t.peek(1), t.peek(2), t.peek(3)) {
+			t.pos++
+			tok := rawToken{Type: atKeywordToken, Name: t.consumeName()}
+			tok.Value = t.css[start:t.pos]
+			return tok
+		}
+	case c == '\\':
+		if isEscape(c, t.peek(1)) {
+			return t.consumeIdentLike()
+		}
+	case isDigit(c):
+		return t.consumeNumeric()
+	case isNameStart(c):
+		return t.consumeIdentLike()
+	}
+
+	t.pos++
+	return t.token(delimToken, start)
+}
+
+func (t *tokenizer) consumeString(quote byte) rawToken {
+	start := t.pos
+	t.pos++
+	for t.pos < len(t.css) {
+		c := t.peek(0)
+		switch {
+		case c == quote:
+			t.pos++
+			return t.token(stringToken, start)
+		case c == '\n':
+			// the newline is not consumed, it is the start of the next token
+			return t.token(badStringToken, start)
+		case c == '\\':
+			t.pos += 2
+		default:
+			t.pos++
+		}
+	}
+	if t.pos > len(t.css) {
+		t.pos = len(t.css)
+	}
+	return t.token(stringToken, start)
+}
+
+func (t *tokenizer) consumeNumeric() rawToken {
+	start := t.pos
+	if t.peek(0) == '+' || t.peek(0) == '-' {
+		t.pos++
+	}
+	for isDigit(t.peek(0)) {
+		t.pos++
+	}
+	if t.peek(0) == '.' && isDigit(t.peek(1)) {
+		t.pos++
+		for isDigit(t.peek(0)) {
+			t.pos++
+		}
+	}
+	e := t.peek(0)
+	if e == 'e' || e == 'E' {
+		sign := t.peek(1) == '+' || t.peek(1) == '-'
+		if isDigit(t.peek(1)) || (sign && isDigit(t.peek(2))) {
+			t.pos++
+			if sign {
+				t.pos++
+			}
+			for isDigit(t.peek(0)) {
+				t.pos++
+			}
+		}
+	}
+
+	if startsIdent(t.peek(0), t.peek(1), t.peek(2)) {
+		t.consumeName()
+		return t.token(dimensionToken, start)
+	}
+	if t.peek(0) == '%' {
+		t.pos++
+		return t.token(percentageToken, start)
+	}
+	return t.token(numberToken, start)
+}
+
+func (t *tokenizer) consumeIdentLike() rawToken {
+	start := t.pos
+	name := t.consumeName()
+	if strings.ToLower(name) == "url" && t.peek(0) == '(' {
+		t.pos++
+		ws := t.pos
+		for isWhiteSpace(t.peek(0)) {
+			t.pos++
+		}
+		if t.peek(0) == '"' || t.peek(0) == '\'' {
+			// quoted urls are just a function with a string argument
+			t.pos = ws
+			return rawToken{Type: functionToken, Value: t.css[start:t.pos], Name: name}
+		}
+		return t.consumeURL(start, name)
+	}
+
+	if t.peek(0) == '(' {
+		t.pos++
+		return rawToken{Type: functionToken, Value: t.css[start:t.pos], Name: name}
+	}
+	return rawToken{Type: identToken, Value: t.css[start:t.pos], Name: name}
+}
+
+func (t *tokenizer) consumeURL(start int, name string) rawToken {
+	for t.pos < len(t.css) {
+		c := t.peek(0)
+		switch {
+		case c == ')':
+			t.pos++
+			return rawToken{Type: urlToken, Value: t.css[start:t.pos], Name: name}
+		case isWhiteSpace(c):
+			for isWhiteSpace(t.peek(0)) {
+				t.pos++
+			}
+			if t.peek(0) == ')' || t.pos >= len(t.css) {
+				continue
+			}
+			return t.consumeBadURL(start, name)
+		case c == '"' || c == '\'' || c == '(' || isNonPrintable(c):
+			return t.consumeBadURL(start, name)
+		case c == '\\':
+			if !isEscape(c, t.peek(1)) {
+				return t.consumeBadURL(start, name)
+			}
+			t.pos += 2
+		default:
+			t.pos++
+		}
+	}
+	return rawToken{Type: urlToken, Value: t.css[start:], Name: name}
+}
+
+func (t *tokenizer) consumeBadURL(start int, name string) rawToken {
+	for t.pos < len(t.css) {
+		c := t.peek(0)
+		if c == ')' {
+			t.pos++
+			break
+		}
+		if isEscape(c, t.peek(1)) {
+			t.pos++
+		}
+		t.pos++
+	}
+	if t.pos > len(t.css) {
+		t.pos = len(t.css)
+	}
+	return rawToken{Type: badURLToken, Value: t.css[start:t.pos], Name: name}
+}
+
+// consumeName consumes an identifier and returns it with any escapes resolved
+func (t *tokenizer) consumeName() string {
+	ret := ""
+	for t.pos < len(t.css) {
+		c := t.peek(0)
+		if isNameChar(c) {
+			ret += string(c)
+			t.pos++
+			continue
+		}
+		if isEscape(c, t.peek(1)) {
+			t.pos++
+			ret += t.consumeEscape()
+			continue
+		}
+		break
+	}
+	return ret
+}
+
+func (t *tokenizer) consumeEscape() string {
+	hex := 0
+	for hex < 6 && isHex(t.peek(hex)) {
+		hex++
+	}
+	if hex == 0 {
+		if t.pos >= len(t.css) {
+			return "�"
+		}
+		c := t.css[t.pos]
+		t.pos++
+		return string(c)
+	}
+
+	var code rune
+	for _, h := range t.css[t.pos : t.pos+hex] {
+		code = code*16 + hexValue(byte(h))
+	}
+	t.pos += hex
+	if isWhiteSpace(t.peek(0)) {
+		t.pos++
+	}
+	if code == 0 || code > 0x10FFFF || (code >= 0xD800 && code <= 0xDFFF) {
+		code = 0xFFFD
+	}
+	return string(code)
+}
+
+func isWhiteSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) rune {
+	switch {
+	case isDigit(c):
+		return rune(c - '0')
+	case c >= 'a' && c <= 'f':
+		return rune(c-'a') + 10
+	default:
+		return rune(c-'A') + 10
+	}
+}
+
+// isNameStart checks for a name start code point, all non-ascii bytes count so multi-byte
+// utf-8 characters are always treated as part of a name
+func isNameStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c >= 0x80
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c) || c == '-'
+}
+
+func isNonPrintable(c byte) bool {
+	return c <= 0x08 || c == 0x0B || (c >= 0x0E && c <= 0x1F) || c == 0x7F
+}
+
+func isEscape(c1, c2 byte) bool {
+	return c1 == '\\' && c2 != '\n' && c2 != 0
+}
+
+func startsIdent(c1, c2, c3 byte) bool {
+	switch {
+	case c1 == '-':
+		return isNameStart(c2) || c2 == '-' || isEscape(c2, c3)
+	case isNameStart(c1):
+		return true
+	case c1 == '\\':
+		return isEscape(c1, c2)
+	}
+	return false
+}
+
+func startsNumber(c1, c2, c3 byte) bool {
+	switch {
+	case c1 == '+' || c1 == '-':
+		return isDigit(c2) || (c2 == '.' && isDigit(c3))
+	case c1 == '.':
+		return isDigit(c2)
+	}
+	return isDigit(c1)
+}
@@ -0,0 +1,92 @@
+package css
+
+import (
+	"strings"
+)
+
+// RewriteURLs calls the rewrite function for every url() in the scripts styles and at-rule
+// preludes, and the string of an @import, and replaces the url with the one it returns
+func (script *Script) RewriteURLs(rewrite func(url string) (string, error)) error {
+	for _, style := range script.AllStyles() {
+		val, err := rewriteURLs(style.Val, rewrite)
+		if err != nil {
+			return err
+		}
+		style.Val = val
+	}
+	return script.rewritePreludes(rewrite)
+}
+
+func (script *Script) rewritePreludes(rewrite func(url string) (string, error)) error {
+	for i := range script.AtRules {
+		at := &script.AtRules[i]
+		prelude, err := rewriteURLs(at.Prelude, rewrite)
+		if err != nil {
+			return err
+		}
+
+		// @import "theme.css" is the same as @import url("theme.css")
+		raw := tokenize(prelude)
+		if at.Name == "import" && len(raw) > 0 && raw[0].Type == stringToken {
+			str := raw[0].Value
+			new, err := rewrite(str[1 : len(str)-1])
+			if err != nil {
+				return err
+			}
+			prelude = string(str[0]) + new + string(str[0]) + prelude[len(str):]
+		}
+		at.Prelude = prelude
+
+		if at.Script != nil {
+			err := at.Script.rewritePreludes(rewrite)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func rewriteURLs(val string, rewrite func(url string) (string, error)) (string, error) {
+	raw := tokenize(val)
+	ret := ""
+	for i := 0; i < len(raw); i++ {
+		tok := raw[i]
+		switch {
+		case tok.Type == urlToken:
+			url := strings.TrimSpace(strings.TrimSuffix(tok.Value[len(tok.Name)+1:], ")"))
+			new, err := rewrite(url)
+			if err != nil {
+				return "", err
+			}
+			ret += tok.Value[:len(tok.Name)+1] + quoteURL(new) + ")"
+		case tok.Type == functionToken && strings.ToLower(tok.Name) == "url":
+			// skip to the string argument of url("...")
+			ret += tok.Value
+			for i+1 < len(raw) && raw[i+1].Type == whitespaceToken {
+				i++
+				ret += raw[i].Value
+			}
+			if i+1 < len(raw) && raw[i+1].Type == stringToken {
+				i++
+				str := raw[i].Value
+				new, err := rewrite(str[1 : len(str)-1])
+				if err != nil {
+					return "", err
+				}
+				ret += string(str[0]) + new + string(str[0])
+			}
+		default:
+			ret += tok.Value
+		}
+	}
+	return ret, nil
+}
+
+// quoteURL quotes a url that can't be written as an unquoted url() token
+func quoteURL(url string) string {
+	if strings.ContainsAny(url, " \t\n\"'()\\") {
+		return `"` + strings.ReplaceAll(url, `"`, `\"`) + `"`
+	}
+	return url
+}
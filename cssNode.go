@@ -8,13 +8,25 @@ import (
 	"strings"
 )
 
-// CSSNode is a node for all style data
+// CSSNode is a node for all style data, Script holds the rules shared by every instance of a
+// component and InstScript holds the rules that use templates and so are unique to each instance
 type CSSNode struct {
 	BaseNode
-	Href   string
-	Script css.Script
-	Remote bool
-	roi    bool
+	Href       string
+	Script     css.Script
+	InstScript css.Script
+	Remote     bool
+	roi        bool
+	source     string
+	def        *styleDef
+}
+
+// styleDef is shared by a style and every clone of it, it collects the parameters that the
+// instances of its component are given so the templates are checked once for the definition
+type styleDef struct {
+	templates css.Script
+	params    map[string]bool
+	instanced bool
 }
 
 // Parse extracts all css rules and applies the correct scope to them
@@ -42,8 +54,10 @@ func (node *CSSNode) Parse(ctx ParseNodeContext) error {
 		cssString = node.FirstChild().Data()
 		Detach(node.FirstChild())
 	}
+	node.dir = ctx.path
 	if hasHref {
 		node.Href = ctx.path + hrefAttr.Val
+		node.dir = getPath(node.Href)
 		styleBytes, err := ioutil.ReadFile(node.Href)
 		cssString = string(styleBytes)
 		if err != nil {
@@ -57,66 +71,95 @@ func (node *CSSNode) Parse(ctx ParseNodeContext) error {
 		return err
 	}
 
+	// lint before prefixing so only the hand written css is checked
+	node.source = "style in " + ctx.file
+	if hasHref {
+		node.source = node.Href
+	}
+	node.warn(script.Lint(nil))
+
+	script.Prefix(ctx.targets)
+	node.InstScript = script.SplitTemplates()
 	node.Script = script
+	node.def = &styleDef{templates: *node.InstScript.Clone(), params: map[string]bool{}}
 
 	return nil
 }
 
 // Instance takes parameters from the node context and replaces template parameteres
 func (node *CSSNode) Instance(ctx InstNodeContext) error {
-	// TODO: why is this function being called twice?
-	if ctx.componentScope != "" {
-		node.Script.AddClass(ctx.componentScope)
+	node.Script.AddClass(ctx.componentClass)
+	node.InstScript.AddClass(ctx.componentScope)
+
+	// styles outside a component instance, like the definition of an inline component, have no
+	// parameters to check against
+	if ctx.componentClass != "" && node.def != nil {
+		node.def.instanced = true
+		for name := range ctx.Parameters {
+			node.def.params[name] = true
+		}
 	}
 
 	re := regexp.MustCompile(`"@[_a-zA-Z][_a-zA-Z0-9]*@"`)
-	for i := 0; i < len(node.Script.Rules); i++ {
-		for ii := 0; ii < len(node.Script.Rules[i].Styles); ii++ {
-			val := node.Script.Rules[i].Styles[ii].Val
-			matches := re.FindAll([]byte(val), -1)
-			for _, match := range matches {
-				p := ""
-				pnode, ok := ctx.Parameters[string(match[2:len(match)-2])]
-				if ok {
-					if len(pnode) == 1 {
-						p = pnode[0].Data()
-					}
-					if len(pnode) > 1 {
-						return fmt.Errorf("error at node %s, tried to replace %s with multiple param nodes", node, match)
-					}
-					if len(pnode) == 1 && pnode[0].Type() != TextType {
-						return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
-					}
-				}
-				node.Script.Rules[i].Styles[ii].Val = strings.ReplaceAll(val, string(match), p)
+	for _, style := range node.InstScript.AllStyles() {
+		matches := re.FindAll([]byte(style.Val), -1)
+		for _, match := range matches {
+			p := ""
+			pnode := ctx.Parameters[string(match[2:len(match)-2])]
+			if len(pnode) == 1 {
+				p = pnode[0].Data()
+			}
+			if len(pnode) > 1 {
+				return fmt.Errorf("error at node %s, tried to replace %s with multiple param nodes", node, match)
+			}
+			if len(pnode) == 1 && pnode[0].Type() != TextType {
+				return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
 			}
+			style.Val = strings.ReplaceAll(style.Val, string(match), p)
 		}
 	}
-	for i := 0; i < len(node.Script.Anims); i++ {
-		for ii := 0; ii < len(node.Script.Anims[i].Frames); ii++ {
-			for iii := 0; iii < len(node.Script.Anims[i].Frames[ii].Styles); iii++ {
-				val := node.Script.Anims[i].Frames[ii].Styles[iii].Val
-				matches := re.FindAll([]byte(val), -1)
-				for _, match := range matches {
-					p := ""
-					pnode, ok := ctx.Parameters[string(match[2:len(match)-2])]
-					if ok {
-						if len(pnode) == 1 {
-							p = pnode[0].Data()
-						}
-						if len(pnode) > 1 {
-							return fmt.Errorf("error at node %s, tried to replace %s with multiple param nodes", node, match)
-						}
-						if len(pnode) == 1 && pnode[0].Type() != TextType {
-							return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
-						}
-					}
-					node.Script.Anims[i].Frames[ii].Styles[iii].Val = strings.ReplaceAll(val, string(match), p)
-				}
-			}
+
+	return nil
+}
+
+// warn prints lint issues found in the node's css, they don't stop the build
+func (node *CSSNode) warn(issues []css.Issue) {
+	for _, issue := range issues {
+		fmt.Printf("Warning at node %s, %s %s\n", node, node.source, issue)
+	}
+}
+
+// lintTemplates warns about the templates of each component style that none of the instances of
+// the component give a parameter for, every definition is only checked once
+func lintTemplates(root Node) {
+	done := map[*styleDef]bool{}
+	for _, found := range FindNodes(root, CSSType) {
+		node := found.(*CSSNode)
+		if node.def == nil || !node.def.instanced || done[node.def] {
+			continue
+		}
+		done[node.def] = true
+		params := []string{}
+		for name := range node.def.params {
+			params = append(params, name)
 		}
+		node.warn(node.def.templates.LintTemplates(params))
+	}
+}
+
+// copyAssets copies the local files used by url() into the output and rewrites the urls to match
+func (node *CSSNode) copyAssets(files *assets) error {
+	rewrite := func(url string) (string, error) {
+		return files.url(url, node.dir)
 	}
 
+	err := node.Script.RewriteURLs(rewrite)
+	if err == nil {
+		err = node.InstScript.RewriteURLs(rewrite)
+	}
+	if err != nil {
+		return fmt.Errorf("error at node %s, %s", node, err)
+	}
 	return nil
 }
 
@@ -145,16 +188,64 @@ func (node *CSSNode) FindEntry(ctx RenderNodeContext) RenderNodeContext {
 
 // Render converts a node into a textual representation
 func (node *CSSNode) Render() string {
-	return node.Script.String()
+	return node.Script.String() + node.InstScript.String()
+}
+
+// bundleCSS renders a list of css nodes into a single bundle, rules that are shared by
+// every instance of a component are only included once
+func bundleCSS(nodes []*CSSNode) string {
+	return strings.Join(cssChunks(nodes), "")
+}
+
+// cssChunks renders each css node in the same order and with the same deduplication as the bundle
+func cssChunks(nodes []*CSSNode) []string {
+	ret := []string{}
+	done := []string{}
+	for _, node := range nodes {
+		chunk := ""
+		shared := node.Script.String()
+		new := true
+		for _, check := range done {
+			if check == shared {
+				new = false
+			}
+		}
+		if new {
+			chunk += shared
+			done = append(done, shared)
+		}
+		chunk += node.InstScript.String()
+		ret = append(ret, chunk)
+	}
+	return ret
+}
+
+// criticalCSS splits the bundle so the css for the start of the document fits within the limit,
+// only a leading run of nodes is inlined so the order of the rules in the cascade is kept
+func criticalCSS(nodes []*CSSNode, limit int) (string, string) {
+	var critical, rest string
+	full := false
+	for _, chunk := range cssChunks(nodes) {
+		if !full && len(critical)+len(chunk) <= limit {
+			critical += chunk
+			continue
+		}
+		full = true
+		rest += chunk
+	}
+	return critical, rest
 }
 
 // Clone creates a deep copy of a node, but does not copy over the connections to the original parent and siblings
 func (node *CSSNode) Clone() Node {
 	clone := &CSSNode{
-		BaseNode: BaseNode{data: node.Data(), attr: cloneAttrs(node.Attrs()), nType: node.Type(), visible: node.Visible()},
-		Href:     node.Href,
-		Script:   *node.Script.Clone(),
-		Remote:   node.Remote,
+		BaseNode:   BaseNode{data: node.Data(), attr: cloneAttrs(node.Attrs()), nType: node.Type(), visible: node.Visible(), dir: node.dir},
+		Href:       node.Href,
+		Script:     *node.Script.Clone(),
+		InstScript: *node.InstScript.Clone(),
+		Remote:     node.Remote,
+		source:     node.source,
+		def:        node.def,
 	}
 
 	for _, child := range Children(node) {
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"math/rand"
+	"crypto/sha1"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/net/html"
@@ -105,11 +106,22 @@ func listNodes(root *html.Node) []*html.Node {
 	return ret
 }
 
-func randomID(l int) string {
+// hashID builds an id from a hash of the keys so the same input always produces the same id
+func hashID(l int, keys ...string) string {
 	ref := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	sum := sha1.Sum([]byte(strings.Join(keys, "\x00")))
 	ret := ""
-	for i := 0; i < l; i++ {
-		ret += string(ref[rand.Intn(len(ref))])
+	for i := 0; i < l && i < len(sum); i++ {
+		ret += string(ref[int(sum[i])%len(ref)])
 	}
 	return ret
 }
+
+// relPath returns the file path relative to the root directory using forward slashes
+func relPath(root, file string) string {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(file))
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+	return filepath.ToSlash(rel)
+}
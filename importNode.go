@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 )
 
@@ -10,6 +11,8 @@ type ImportNode struct {
 	BaseNode
 	Tag           string
 	Src           string
+	Lazy          bool
+	Class         string
 	ComponentRoot Node
 }
 
@@ -25,9 +28,20 @@ func (node *ImportNode) Parse(ctx ParseNodeContext) error {
 		return fmt.Errorf("error at node %s, can not have both a src value and a child node", node)
 	}
 
+	hasLazy, _ := GetAttr(node, "lazy")
+	node.Lazy = hasLazy
+
 	if hasSrc {
 		node.Src = ctx.path + srcAttr.Val
-		children, err := parseComponentFile(node.Src)
+		var children []Node
+		var err error
+		if strings.EqualFold(filepath.Ext(node.Src), ".svg") {
+			currentColor, _ := GetAttr(node, "currentcolor")
+			optimize, _ := GetAttr(node, "optimize")
+			children, err = parseSVGFile(node.Src, currentColor, optimize)
+		} else {
+			children, err = parseComponentFile(node.Src, relPath(ctx.root, node.Src))
+		}
 		if err != nil {
 			return fmt.Errorf("error at node %s, %s there was an error parsing component src", node, err)
 		}
@@ -40,8 +54,19 @@ func (node *ImportNode) Parse(ctx ParseNodeContext) error {
 		node.ComponentRoot = root
 	}
 
+	// the class only depends on where the component is defined so it is the same between builds
+	src := ""
+	if node.Src != "" {
+		src = relPath(ctx.root, node.Src)
+	}
+	node.Class = "k-" + hashID(6, relPath(ctx.root, ctx.path), strings.ToLower(tagAttr.Val), src)
+
+	// inline components keep the path of the file they are defined in
 	compCtx := ctx.Clone()
-	compCtx.path = getPath(node.Src)
+	if node.Src != "" {
+		compCtx.path = getPath(node.Src)
+		compCtx.file = node.Src
+	}
 	err := node.ComponentRoot.Parse(compCtx)
 	if err != nil {
 		return err
@@ -49,9 +74,11 @@ func (node *ImportNode) Parse(ctx ParseNodeContext) error {
 
 	ctx.ImportTags = append(ctx.ImportTags,
 		ImportTag{
-			tag:  strings.ToLower(tagAttr.Val),
-			root: node.ComponentRoot,
-			path: compCtx.path,
+			tag:   strings.ToLower(tagAttr.Val),
+			root:  node.ComponentRoot,
+			path:  compCtx.path,
+			lazy:  node.Lazy,
+			class: node.Class,
 		},
 	)
 
@@ -70,6 +97,8 @@ func (node *ImportNode) Clone() Node {
 
 	clone.Tag = node.Tag
 	clone.Src = node.Src
+	clone.Lazy = node.Lazy
+	clone.Class = node.Class
 	clone.ComponentRoot = node.ComponentRoot
 
 	return clone
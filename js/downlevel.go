@@ -0,0 +1,1247 @@
+package js
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Feature is modern syntax that Downlevel can rewrite into es5, features are combined as flags
+type Feature int
+
+// the features Downlevel can rewrite, OptionalChaining also covers ?? which shipped with it and
+// Spread also covers rest parameters
+const (
+	Arrows Feature = 1 << iota
+	BlockScope
+	Templates
+	OptionalChaining
+	Spread
+)
+
+// support is the first version of a browser that can parse a feature
+type support struct {
+	feature Feature
+	browser string
+	since   float64
+}
+
+// featureSupport is a bundled subset of the caniuse data so builds never need the network, the
+// versions for Spread are the ones that added object spread since it shipped last
+var featureSupport = []support{
+	{Arrows, "chrome", 45}, {Arrows, "edge", 12}, {Arrows, "firefox", 22}, {Arrows, "safari", 10},
+	{Arrows, "ios", 10}, {Arrows, "opera", 32}, {Arrows, "samsung", 5},
+	{BlockScope, "chrome", 49}, {BlockScope, "edge", 14}, {BlockScope, "firefox", 44}, {BlockScope, "safari", 11},
+	{BlockScope, "ios", 11}, {BlockScope, "opera", 36}, {BlockScope, "samsung", 5},
+	{Templates, "chrome", 41}, {Templates, "edge", 13}, {Templates, "firefox", 34}, {Templates, "safari", 9},
+	{Templates, "ios", 9}, {Templates, "opera", 28}, {Templates, "samsung", 4},
+	{OptionalChaining, "chrome", 80}, {OptionalChaining, "edge", 80}, {OptionalChaining, "firefox", 74},
+	{OptionalChaining, "safari", 13.1}, {OptionalChaining, "ios", 13.4}, {OptionalChaining, "opera", 67},
+	{OptionalChaining, "samsung", 13},
+	{Spread, "chrome", 60}, {Spread, "edge", 79}, {Spread, "firefox", 55}, {Spread, "safari", 11.1},
+	{Spread, "ios", 11.3}, {Spread, "opera", 47}, {Spread, "samsung", 8.2},
+}
+
+// Unsupported returns the features that a version of a browser can't parse
+func Unsupported(browser string, version float64) Feature {
+	var ret Feature
+	for _, check := range featureSupport {
+		if check.browser == browser && version < check.since {
+			ret |= check.feature
+		}
+	}
+	return ret
+}
+
+// helpers are the es5 functions that rewritten code calls, they are declared with var like the
+// module runtime so the bundles on a page share them
+var helpers = []struct {
+	name string
+	src  string
+}{
+	{"kissSpread", `var kissSpread=kissSpread||function(value){if(Array.isArray(value)){return value}if(typeof Symbol!=="undefined"&&value[Symbol.iterator]){var ret=[];for(var it=value[Symbol.iterator](),step;!(step=it.next()).done;){ret.push(step.value)}return ret}return Array.prototype.slice.call(value)};`},
+	{"kissAssign", `var kissAssign=kissAssign||function(target){for(var i=1;i<arguments.length;i++){var source=arguments[i];if(source!=null){for(var key in source){if(Object.prototype.hasOwnProperty.call(source,key)){target[key]=source[key]}}}}return target};`},
+	{"kissTemplate", `var kissTemplate=kissTemplate||function(cooked,raw){cooked.raw=raw;return cooked};`},
+}
+
+// downlevel is the state of a rewrite, used are the helpers the rewritten code calls and names
+// are the names in the script that new variables can't take
+type downlevel struct {
+	used  map[string]bool
+	names map[string]bool
+}
+
+// Downlevel rewrites the features of a script into es5, the script is joined into one line and
+// the helpers the rewritten code needs are declared at the start of it
+func (script *Script) Downlevel(features Feature) error {
+	tokens := strip(script.tokens())
+	d := &downlevel{used: map[string]bool{}, names: map[string]bool{}}
+	for _, tok := range tokens {
+		if tok.Type == identifier || tok.Type == templateLiteral {
+			for _, word := range wordPattern.FindAllString(tok.Value, -1) {
+				d.names[word] = true
+			}
+		}
+	}
+
+	// templates go first so the code in their substitutions is rewritten by the other passes
+	passes := []struct {
+		feature Feature
+		run     func([]Token) ([]Token, error)
+	}{
+		{Templates, d.templates},
+		{Arrows, d.arrows},
+		{Spread, d.spread},
+		{OptionalChaining, d.optionalChaining},
+		{BlockScope, d.blockScope},
+	}
+	for _, pass := range passes {
+		if features&pass.feature == 0 {
+			continue
+		}
+		var err error
+		tokens, err = pass.run(tokens)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a browser that can't parse arrows can't parse any other es2015 syntax either
+	if features&Arrows != 0 {
+		if syntax := es2015(tokens); syntax != "" {
+			return fmt.Errorf("can not rewrite %s into es5", syntax)
+		}
+	}
+
+	prelude := []Token{}
+	for _, helper := range helpers {
+		if d.used[helper.name] {
+			prelude = append(prelude, lex(helper.src)...)
+		}
+	}
+	script.Lines = compact(append(prelude, tokens...))
+	return nil
+}
+
+// es2015 returns the first es2015 or later syntax that is left in the tokens since none of the
+// passes rewrite it, it is empty if there is none
+func es2015(tokens []Token) string {
+	a := analyze(tokens)
+	for i, tok := range tokens {
+		prev, next := a.at(i-1), a.at(i+1)
+		switch {
+		case tok.Type == keyword && tok.Value == "class" && prev.Value != "." && !a.keyPosition(i):
+			return "classes"
+		case tok.Type == identifier && tok.Value == "of" && a.parent[i] >= 0 && a.kind[a.parent[i]] == controlBracket &&
+			a.at(a.parent[i]-1).Value == "for":
+			return "for...of loops"
+		case tok.Type == identifier && tok.Value == "async" && prev.Value != "." &&
+			(next.Value == "function" || (a.keyPosition(i) && next.Value != "(" && next.Value != ":" && next.Value != "," && next.Value != "}")):
+			return "async functions"
+		case tok.Value == "*" && (prev.Value == "function" || a.keyPosition(i)):
+			return "generators"
+		case (tok.Value == "{" && a.kind[i] == objectBracket || tok.Value == "[" && !a.afterOperand(i)) &&
+			tok.Type == punctuator && a.destructures(i):
+			return "destructuring"
+		case tok.Type == identifier && a.key(i):
+			return "shorthand properties"
+		case next.Value == "(" && a.keyPosition(i) && a.kind[a.parent[i]] == objectBracket && prev.Value != "get" && prev.Value != "set":
+			return "shorthand methods"
+		case tok.Type == punctuator && tok.Value == "=" && a.parent[i] >= 0 && a.kind[a.parent[i]] == paramsBracket:
+			return "default parameters"
+		case tok.Type == punctuator && tok.Value == "...":
+			return "spread and rest"
+		case tok.Type == punctuator && (tok.Value == "**" || tok.Value == "**="):
+			return "the ** operator"
+		case tok.Type == punctuator && (tok.Value == "&&=" || tok.Value == "||=" || tok.Value == "??="):
+			return "logical assignment"
+		}
+	}
+	return ""
+}
+
+// lex lexes code that is added to a script
+func lex(src string) []Token {
+	return strip(LexScript(src))
+}
+
+// fresh returns a name starting with base that isn't used in the script
+func (d *downlevel) fresh(base string) string {
+	for n := 0; ; n++ {
+		name := base + strconv.Itoa(n)
+		if !d.names[name] {
+			d.names[name] = true
+			return name
+		}
+	}
+}
+
+// helper returns the name of a helper and marks it as used
+func (d *downlevel) helper(name string) Token {
+	d.used[name] = true
+	return Token{identifier, name}
+}
+
+// templates rewrites template literals into strings joined with +, a tagged template calls its
+// tag with the strings and the values of the substitutions
+func (d *downlevel) templates(tokens []Token) ([]Token, error) {
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].Type != templateLiteral {
+			continue
+		}
+		texts, subs := splitTemplate(tokens[i].Value)
+
+		ret := []Token{}
+		if i > 0 && tagged(tokens[i-1]) {
+			cooked, raw := []Token{}, []Token{}
+			for j, text := range texts {
+				if j > 0 {
+					cooked = append(cooked, Token{punctuator, ","})
+					raw = append(raw, Token{punctuator, ","})
+				}
+				cooked = append(cooked, Token{value, templateString(text)})
+				raw = append(raw, Token{value, Literal(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n"))})
+			}
+			ret = append(ret, Token{punctuator, "("}, d.helper("kissTemplate"), Token{punctuator, "("}, Token{punctuator, "["})
+			ret = append(append(ret, cooked...), Token{punctuator, "]"}, Token{punctuator, ","}, Token{punctuator, "["})
+			ret = append(append(ret, raw...), Token{punctuator, "]"}, Token{punctuator, ")"})
+			for _, sub := range subs {
+				ret = append(append(ret, Token{punctuator, ","}), sub...)
+			}
+			ret = append(ret, Token{punctuator, ")"})
+		} else {
+			// the first string is always kept so the values are joined as strings
+			ret = append(ret, Token{value, templateString(texts[0])})
+			for j, sub := range subs {
+				if len(sub) == 1 {
+					ret = append(ret, Token{punctuator, "+"}, sub[0])
+				} else {
+					ret = append(append(append(ret, Token{punctuator, "+"}, Token{punctuator, "("}), sub...), Token{punctuator, ")"})
+				}
+				if texts[j+1] != "" {
+					ret = append(ret, Token{punctuator, "+"}, Token{value, templateString(texts[j+1])})
+				}
+			}
+			if len(subs) > 0 {
+				ret = append(append([]Token{Token{punctuator, "("}}, ret...), Token{punctuator, ")"})
+			}
+		}
+		tokens = append(tokens[:i], append(ret, tokens[i+1:]...)...)
+	}
+	return tokens, nil
+}
+
+// splitTemplate splits a template literal into the text around its substitutions and the tokens
+// of the substitutions
+func splitTemplate(literal string) ([]string, [][]Token) {
+	texts, subs := []string{}, [][]Token{}
+	start := 1
+	for i := 1; i < len(literal)-1; i++ {
+		switch {
+		case literal[i] == '\\':
+			i++
+		case strings.HasPrefix(literal[i:], "${"):
+			sub := &lexer{src: literal, pos: i + 2}
+			sub.run(true)
+			texts = append(texts, literal[start:i])
+			subs = append(subs, lex(literal[i+2:sub.pos]))
+			start = sub.pos + 1
+			i = sub.pos
+		}
+	}
+	return append(texts, literal[start:len(literal)-1]), subs
+}
+
+// templateString converts the text of a template literal into a string literal with the same
+// value, escapes mean the same in both so they are kept as they are
+func templateString(text string) string {
+	ret := strings.Builder{}
+	ret.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			ret.WriteByte(c)
+			i++
+			ret.WriteByte(text[i])
+			// an escaped line break continues the line
+			if text[i] == '\r' && i+1 < len(text) && text[i+1] == '\n' {
+				i++
+				ret.WriteByte('\n')
+			}
+		case c == '"':
+			ret.WriteString("\\\"")
+		case c == '\r':
+			ret.WriteString("\\n")
+			if i+1 < len(text) && text[i+1] == '\n' {
+				i++
+			}
+		case c == '\n':
+			ret.WriteString("\\n")
+		default:
+			ret.WriteByte(c)
+		}
+	}
+	ret.WriteByte('"')
+	return strings.NewReplacer("\u2028", "\\u2028", "\u2029", "\\u2029").Replace(ret.String())
+}
+
+// tagged checks if a template literal after the token is a tagged template
+func tagged(prev Token) bool {
+	switch prev.Type {
+	case identifier:
+		return prev.Value != "of"
+	case punctuator:
+		return prev.Value == ")" || prev.Value == "]"
+	}
+	return false
+}
+
+// arrows rewrites arrow functions into function expressions, the last arrow in the script is
+// rewritten first so the body of the arrow being rewritten never has another arrow in it, an arrow
+// that uses this is bound to the this around it
+func (d *downlevel) arrows(tokens []Token) ([]Token, error) {
+	for {
+		k := -1
+		for i := len(tokens) - 1; i >= 0; i-- {
+			if tokens[i].Type == punctuator && tokens[i].Value == "=>" {
+				k = i
+				break
+			}
+		}
+		if k < 0 {
+			return tokens, nil
+		}
+		a := analyze(tokens)
+
+		params := []Token{}
+		start := k - 1
+		switch prev := a.at(k - 1); {
+		case prev.Value == ")" && a.match[k-1] >= 0:
+			start = a.match[k-1]
+			params = append(params, tokens[start:k]...)
+		case prev.Type == identifier:
+			params = append(params, Token{punctuator, "("}, prev, Token{punctuator, ")"})
+		default:
+			return nil, fmt.Errorf("unexpected => after %s", prev.Value)
+		}
+		async := a.at(start-1).Type == identifier && a.at(start-1).Value == "async" && a.at(start-2).Value != "."
+		if async {
+			start--
+		}
+
+		end := a.arrowBody(k + 1)
+		block := a.at(k+1).Value == "{" && a.match[k+1] > k
+		if block {
+			end = a.match[k+1]
+		}
+
+		// the arguments of the function around the arrow are kept in a variable
+		this := false
+		owner, arguments := -1, ""
+		for j := k + 1; j <= end; j++ {
+			tok := tokens[j]
+			switch {
+			case j > k+1 && tok.Value == "{" && (a.kind[j] == bodyBracket || a.kind[j] == classBracket):
+				// functions and classes have their own this and arguments
+				j = a.match[j]
+			case tok.Type == keyword && tok.Value == "this":
+				this = true
+			case tok.Type == identifier && tok.Value == "arguments" && a.reference(j):
+				if arguments == "" {
+					owner = a.functionBody(start, false)
+					if owner < 0 {
+						return nil, fmt.Errorf("arguments is used outside of a function")
+					}
+					arguments = d.fresh("kissArguments")
+				}
+				tokens[j] = Token{identifier, arguments}
+			}
+		}
+
+		body := []Token{}
+		if block {
+			body = append(body, tokens[k+1:end+1]...)
+		} else {
+			body = append(append(append(body, Token{punctuator, "{"}, Token{keyword, "return"}), tokens[k+1:end+1]...), Token{punctuator, "}"})
+		}
+
+		fn := []Token{}
+		if async {
+			fn = append(fn, Token{identifier, "async"})
+		}
+		fn = append(append(append(fn, Token{keyword, "function"}), params...), body...)
+		if this || a.statementStart(start) {
+			fn = append(append([]Token{Token{punctuator, "("}}, fn...), Token{punctuator, ")"})
+		}
+		if this {
+			fn = append(fn, lex(".bind(this)")...)
+		}
+		tokens = append(tokens[:start], append(fn, tokens[end+1:]...)...)
+		if arguments != "" {
+			tokens = declare(tokens, owner, lex("var "+arguments+"=arguments;"))
+		}
+	}
+}
+
+// arrowBody returns the last token of an arrow function's expression body, unlike exprEnd it also
+// ends at the colon of a conditional the arrow is in
+func (a *analysis) arrowBody(i int) int {
+	depth, conditions := 0, 0
+	for j := i; j < len(a.tokens); j++ {
+		if a.tokens[j].Type != punctuator {
+			continue
+		}
+		switch a.tokens[j].Value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			if depth == 0 {
+				return j - 1
+			}
+			depth--
+		case ",", ";":
+			if depth == 0 {
+				return j - 1
+			}
+		case "?":
+			if depth == 0 {
+				conditions++
+			}
+		case ":":
+			if depth == 0 && conditions == 0 {
+				return j - 1
+			}
+			if depth == 0 {
+				conditions--
+			}
+		}
+	}
+	return len(a.tokens) - 1
+}
+
+// afterOperand checks if the token before i ends an operand, a bracket or template literal at i
+// is then a call, member access or tagged template
+func (a *analysis) afterOperand(i int) bool {
+	prev := a.at(i - 1)
+	switch prev.Type {
+	case identifier:
+		// for (x of [...])
+		return !(prev.Value == "of" && a.parent[i] >= 0 && a.kind[a.parent[i]] == controlBracket)
+	case number, value, templateLiteral, template:
+		return true
+	case keyword:
+		return prev.Value == "this" || prev.Value == "super" || a.at(i-2).Value == "." || a.at(i-2).Value == "?."
+	case punctuator:
+		switch prev.Value {
+		case ")":
+			return a.match[i-1] < 0 || a.kind[a.match[i-1]] != controlBracket
+		case "]":
+			return true
+		}
+	}
+	return false
+}
+
+// operandStart returns the first token of the member and call chain that ends at i
+func (a *analysis) operandStart(i int) int {
+	for i > 0 {
+		tok := a.tokens[i]
+		switch {
+		case tok.Type == punctuator && (tok.Value == ")" || tok.Value == "]" || tok.Value == "}"):
+			open := a.match[i]
+			if open < 0 || tok.Value == "}" || !a.afterOperand(open) {
+				return open
+			}
+			i = open - 1
+		case tok.Type == templateLiteral && a.afterOperand(i):
+			i--
+		case a.at(i-1).Type == punctuator && (a.at(i-1).Value == "." || a.at(i-1).Value == "?."):
+			i -= 2
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// chainEnd returns the last token of the member accesses and calls that follow the ?. at i
+func (a *analysis) chainEnd(i int) int {
+	end := i + 1
+	if next := a.at(end); next.Type == punctuator && (next.Value == "[" || next.Value == "(") {
+		end = a.match[end]
+	}
+	for {
+		next := a.at(end + 1)
+		switch {
+		case next.Type == punctuator && (next.Value == "." || next.Value == "?."):
+			end += 2
+			if after := a.at(end); after.Type == punctuator && (after.Value == "[" || after.Value == "(") {
+				end = a.match[end]
+			}
+		case next.Type == punctuator && (next.Value == "[" || next.Value == "("):
+			end = a.match[end+1]
+		case next.Type == templateLiteral:
+			end++
+		default:
+			return end
+		}
+	}
+}
+
+// accessor returns where the last member access of the operand from start to end begins or -1
+// if the operand doesn't end with one
+func (a *analysis) accessor(start, end int) int {
+	last := a.at(end)
+	switch {
+	case last.Type == punctuator && last.Value == "]" && a.match[end] > start && a.afterOperand(a.match[end]):
+		return a.match[end]
+	case last.Type != punctuator && end-1 > start && a.at(end-1).Value == ".":
+		return end - 1
+	}
+	return -1
+}
+
+// simple checks if an operand can be evaluated twice without a temporary variable
+func simple(operand []Token) bool {
+	return len(operand) == 1 && (operand[0].Type == identifier || (operand[0].Type == keyword && operand[0].Value == "this"))
+}
+
+// functionBody returns the body of the function that the token at i is in or -1 at the top level,
+// arrow functions are skipped unless arrows is set
+func (a *analysis) functionBody(i int, arrows bool) int {
+	open := a.parent[i]
+	for open >= 0 && (a.kind[open] != bodyBracket || (!arrows && a.at(open-1).Value == "=>")) {
+		open = a.parent[open]
+	}
+	return open
+}
+
+// declare adds a declaration to the start of the body that opens at open or the script at -1
+func declare(tokens []Token, open int, decl []Token) []Token {
+	at := bodyStart(tokens, open)
+	return append(tokens[:at], append(decl, tokens[at:]...)...)
+}
+
+// bodyStart returns where the statements of a body that opens at open start, directives like
+// "use strict" have to stay first
+func bodyStart(tokens []Token, open int) int {
+	at := open + 1
+	for at+1 < len(tokens) && tokens[at].Type == value && tokens[at+1].Value == ";" {
+		at += 2
+	}
+	return at
+}
+
+// temps declares temporary variables in the function that the token at i is in, they are added
+// to the temporaries that are already declared there
+func (a *analysis) temps(tokens []Token, i int, names ...string) []Token {
+	open := a.functionBody(i, true)
+	at := bodyStart(tokens, open)
+	if at+1 < len(tokens) && tokens[at].Value == "var" && strings.HasPrefix(tokens[at+1].Value, "kissTemp") {
+		return append(tokens[:at+2], append(lex(","+strings.Join(names, ",")), tokens[at+2:]...)...)
+	}
+	return declare(tokens, open, lex("var "+strings.Join(names, ",")+";"))
+}
+
+// spread rewrites spread arguments into calls to apply, spread elements into concat, spread
+// properties into kissAssign and rest parameters into a slice of arguments
+func (d *downlevel) spread(tokens []Token) ([]Token, error) {
+	for {
+		a := analyze(tokens)
+		changed := false
+		for i, tok := range tokens {
+			if tok.Type != punctuator || tok.Value != "..." || a.parent[i] < 0 {
+				continue
+			}
+			var err error
+			open := a.parent[i]
+			switch {
+			case a.kind[open] == paramsBracket:
+				tokens, changed, err = d.rest(a, tokens, i)
+			case a.destructures(open):
+			case tokens[open].Value == "(" && a.afterOperand(open):
+				tokens, changed = d.spreadCall(a, tokens, open)
+			case tokens[open].Value == "[" && !a.afterOperand(open):
+				ret := d.concat(a.items(open))
+				tokens, changed = append(tokens[:open], append(ret, tokens[a.match[open]+1:]...)...), true
+			case tokens[open].Value == "{" && a.kind[open] == objectBracket:
+				ret := d.assign(a.items(open))
+				tokens, changed = append(tokens[:open], append(ret, tokens[a.match[open]+1:]...)...), true
+			}
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				break
+			}
+		}
+		if !changed {
+			return tokens, nil
+		}
+	}
+}
+
+// rest moves the rest parameter of a function into a variable that slices arguments, the rest
+// parameters of arrow functions are left since they don't have their own arguments
+func (d *downlevel) rest(a *analysis, tokens []Token, i int) ([]Token, bool, error) {
+	open := a.parent[i]
+	close := a.match[open]
+	if a.at(close+1).Value != "{" {
+		return tokens, false, nil
+	}
+	name := a.at(i + 1)
+	if name.Type != identifier || i+2 != close {
+		return nil, false, fmt.Errorf("can not rewrite a rest parameter that isn't a name")
+	}
+
+	index := 0
+	for j := open + 1; j < i; j++ {
+		if a.parent[j] == open && tokens[j].Value == "," {
+			index++
+		}
+	}
+	from := i
+	if tokens[i-1].Value == "," {
+		from = i - 1
+	}
+
+	decl := lex("var " + name.Value + "=[].slice.call(arguments," + strconv.Itoa(index) + ");")
+	tokens = declare(tokens, close+1, decl)
+	return append(tokens[:from], tokens[i+2:]...), true, nil
+}
+
+// destructures checks if the array or object bracket at open is a destructuring pattern rather
+// than a literal
+func (a *analysis) destructures(open int) bool {
+	for {
+		prev, next := a.at(open-1), a.at(a.match[open]+1)
+		parent := a.parent[open]
+		switch {
+		case next.Type == punctuator && next.Value == "=":
+			return true
+		case prev.Type == keyword && (prev.Value == "var" || prev.Value == "let" || prev.Value == "const"):
+			return true
+		case parent < 0:
+			return false
+		case a.kind[parent] == paramsBracket:
+			return true
+		case a.kind[parent] == controlBracket:
+			return a.at(parent-1).Value == "catch" || next.Value == "of" || next.Value == "in"
+		case a.tokens[parent].Value == "[" && !a.afterOperand(parent), a.kind[parent] == objectBracket:
+			open = parent
+		default:
+			return false
+		}
+	}
+}
+
+// items splits the tokens in a bracket at its commas
+func (a *analysis) items(open int) [][]Token {
+	ret := [][]Token{}
+	start := open + 1
+	for j := open + 1; j <= a.match[open]; j++ {
+		if j == a.match[open] || (a.parent[j] == open && a.tokens[j].Value == ",") {
+			ret = append(ret, a.tokens[start:j])
+			start = j + 1
+		}
+	}
+	if len(ret) > 0 && len(ret[len(ret)-1]) == 0 {
+		ret = ret[:len(ret)-1]
+	}
+	return ret
+}
+
+// concat builds an array from items that can be spread, items that aren't spread are joined
+// into array literals
+func (d *downlevel) concat(items [][]Token) []Token {
+	parts := [][]Token{}
+	literal := []Token{}
+	flush := func() {
+		if len(literal) > 0 {
+			parts = append(parts, append(append([]Token{Token{punctuator, "["}}, literal[1:]...), Token{punctuator, "]"}))
+		}
+		literal = nil
+	}
+	for _, item := range items {
+		if len(item) > 0 && item[0].Value == "..." {
+			flush()
+			parts = append(parts, append(append([]Token{d.helper("kissSpread"), Token{punctuator, "("}}, item[1:]...), Token{punctuator, ")"}))
+			continue
+		}
+		literal = append(append(literal, Token{punctuator, ","}), item...)
+	}
+	flush()
+
+	// concat copies so a spread array is never the array it was spread from
+	ret := []Token{Token{punctuator, "["}, Token{punctuator, "]"}}
+	if len(parts) > 0 && parts[0][0].Value == "[" {
+		ret, parts = parts[0], parts[1:]
+	}
+	if len(parts) == 0 {
+		return ret
+	}
+	ret = append(ret, Token{punctuator, "."}, Token{identifier, "concat"}, Token{punctuator, "("})
+	for j, part := range parts {
+		if j > 0 {
+			ret = append(ret, Token{punctuator, ","})
+		}
+		ret = append(ret, part...)
+	}
+	return append(ret, Token{punctuator, ")"})
+}
+
+// assign builds an object from properties and spread objects with kissAssign
+func (d *downlevel) assign(items [][]Token) []Token {
+	ret := []Token{d.helper("kissAssign"), Token{punctuator, "("}}
+	literal := []Token{}
+	first := true
+	add := func(part ...Token) {
+		if !first {
+			ret = append(ret, Token{punctuator, ","})
+		}
+		ret = append(ret, part...)
+		first = false
+	}
+	flush := func() {
+		if len(literal) > 0 || first {
+			add(append(append([]Token{Token{punctuator, "{"}}, literal...), Token{punctuator, "}"})...)
+		}
+		literal = nil
+	}
+	for _, item := range items {
+		if len(item) > 0 && item[0].Value == "..." {
+			flush()
+			add(item[1:]...)
+			continue
+		}
+		if len(literal) > 0 {
+			literal = append(literal, Token{punctuator, ","})
+		}
+		literal = append(literal, item...)
+	}
+	flush()
+	return append(ret, Token{punctuator, ")"})
+}
+
+// spreadCall rewrites a call with spread arguments into a call to apply, a method is applied to
+// its object and new uses bind to pass the arguments to a constructor
+func (d *downlevel) spreadCall(a *analysis, tokens []Token, open int) ([]Token, bool) {
+	close := a.match[open]
+	start := a.operandStart(open - 1)
+	callee := tokens[start:open]
+	if len(callee) == 1 && callee[0].Value == "super" {
+		return tokens, false
+	}
+
+	items := a.items(open)
+	if a.at(start-1).Type == keyword && a.at(start-1).Value == "new" {
+		args := d.concat(append([][]Token{[]Token{Token{keyword, "null"}}}, items...))
+		ret := lex("(new(Function.prototype.bind.apply(")
+		ret = append(append(append(ret, callee...), Token{punctuator, ","}), args...)
+		ret = append(ret, lex(")))")...)
+		return append(tokens[:start-1], append(ret, tokens[close+1:]...)...), true
+	}
+
+	args := d.concat(items)
+	ret := append([]Token{}, callee...)
+	this := lex("void 0")
+	var temp string
+	if acc := a.accessor(start, open-1); acc > start {
+		object := tokens[start:acc]
+		this = object
+		if !simple(object) {
+			temp = d.fresh("kissTemp")
+			this = []Token{Token{identifier, temp}}
+			ret = append(append(lex("("+temp+"="), object...), Token{punctuator, ")"})
+			ret = append(ret, tokens[acc:open]...)
+		}
+	}
+	ret = append(append(append(ret, lex(".apply(")...), this...), Token{punctuator, ","})
+	ret = append(append(ret, args...), Token{punctuator, ")"})
+
+	tokens = append(tokens[:start], append(ret, tokens[close+1:]...)...)
+	if temp != "" {
+		tokens = a.temps(tokens, start, temp)
+	}
+	return tokens, true
+}
+
+// optionalChaining rewrites optional chains and ?? into conditionals that check for null and
+// undefined, an operand that isn't a name is stored in a temporary variable so it's only
+// evaluated once
+func (d *downlevel) optionalChaining(tokens []Token) ([]Token, error) {
+	tokens, err := d.chains(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return d.nullish(tokens), nil
+}
+
+// assigns checks if the tokens before and after an operand assign to it
+func assigns(prev, next Token) bool {
+	return (next.Type == punctuator && strings.HasSuffix(next.Value, "=") && precedence(next) == 0) ||
+		next.Value == "++" || next.Value == "--" || prev.Value == "++" || prev.Value == "--"
+}
+
+// chains rewrites the optional chains, the first ?. is rewritten first so the ones after it
+// become part of the chain that is rewritten, delete a?.b becomes a==null||delete a.b so it
+// still deletes the property
+func (d *downlevel) chains(tokens []Token) ([]Token, error) {
+	for {
+		k := -1
+		for i, tok := range tokens {
+			if tok.Type == punctuator && tok.Value == "?." {
+				k = i
+				break
+			}
+		}
+		if k < 0 {
+			return tokens, nil
+		}
+		a := analyze(tokens)
+
+		start := a.operandStart(k - 1)
+		for a.at(start-1).Type == keyword && a.at(start-1).Value == "new" {
+			start--
+		}
+		end := a.chainEnd(k)
+		base := tokens[start:k]
+		tail := append([]Token{}, tokens[k+1:end+1]...)
+		if len(tail) == 0 {
+			return nil, fmt.Errorf("unexpected ?. at the end of the script")
+		}
+		if assigns(a.at(start-1), a.at(end+1)) {
+			return nil, fmt.Errorf("can not assign to an optional chain")
+		}
+		call := tail[0].Value == "("
+		if tail[0].Value != "[" && !call {
+			tail = append([]Token{Token{punctuator, "."}}, tail...)
+		}
+
+		temps := []string{}
+		ret := []Token{Token{punctuator, "("}}
+		acc := a.accessor(start, k-1)
+		del := !call && a.at(start-1).Type == keyword && a.at(start-1).Value == "delete"
+		switch {
+		case del && simple(base):
+			ret = append(append(ret, base...), lex("==null||delete ")...)
+			ret = append(append(ret, base...), tail...)
+		case del:
+			temp := d.fresh("kissTemp")
+			temps = append(temps, temp)
+			ret = append(append(append(ret, lex("("+temp+"=")...), base...), lex(")==null||delete "+temp)...)
+			ret = append(ret, tail...)
+		case call && acc > start:
+			// a method called with ?.() is still called on its object
+			object, this := tokens[start:acc], tokens[start:acc]
+			fn := d.fresh("kissTemp")
+			temps = append(temps, fn)
+			if !simple(object) {
+				temp := d.fresh("kissTemp")
+				temps = append(temps, temp)
+				object = append(append(lex("("+temp+"="), object...), Token{punctuator, ")"})
+				this = []Token{Token{identifier, temp}}
+			}
+			args := tail[1 : a.match[k+1]-k-1]
+			ret = append(append(append(ret, lex("("+fn+"=")...), object...), tokens[acc:k]...)
+			ret = append(append(ret, lex(")==null?void 0:"+fn+".call(")...), this...)
+			if len(args) > 0 {
+				ret = append(append(ret, Token{punctuator, ","}), args...)
+			}
+			ret = append(append(ret, Token{punctuator, ")"}), tail[a.match[k+1]-k:]...)
+		case simple(base):
+			ret = append(append(ret, base...), lex("==null?void 0:")...)
+			ret = append(append(ret, base...), tail...)
+		default:
+			temp := d.fresh("kissTemp")
+			temps = append(temps, temp)
+			ret = append(append(append(ret, lex("("+temp+"=")...), base...), lex(")==null?void 0:"+temp)...)
+			ret = append(ret, tail...)
+		}
+		ret = append(ret, Token{punctuator, ")"})
+
+		if del {
+			start--
+		}
+		tokens = append(tokens[:start], append(ret, tokens[end+1:]...)...)
+		if len(temps) > 0 {
+			tokens = a.temps(tokens, start, temps...)
+		}
+	}
+}
+
+// blockScope rewrites let and const into var, a name that would clash with another variable of
+// its function is renamed and a loop whose closures use a name declared in it gets a function for
+// each iteration so every closure still sees its own variable
+func (d *downlevel) blockScope(tokens []Token) ([]Token, error) {
+	for {
+		a := analyze(tokens)
+		root := &scope{start: 0, end: len(tokens) - 1, function: true}
+		scopes := a.scopes(root)
+		at := make([]*scope, len(tokens))
+		for _, s := range scopes {
+			for i := s.start; i <= s.end && i < len(tokens); i++ {
+				at[i] = s
+			}
+		}
+		a.declarations(scopes, at)
+
+		refs := map[string][]int{}
+		for i, tok := range tokens {
+			if tok.Type == identifier && a.reference(i) {
+				refs[tok.Value] = append(refs[tok.Value], i)
+			}
+		}
+		resolve := func(i int) *scope {
+			for s := at[i]; s != nil; s = s.parent {
+				if s.declares(tokens[i].Value) {
+					return s
+				}
+			}
+			return nil
+		}
+		captured := func(s *scope, name string) bool {
+			for _, i := range refs[name] {
+				if resolve(i) != s {
+					continue
+				}
+				for p := at[i]; p != s && p != nil; p = p.parent {
+					if p.function {
+						return true
+					}
+				}
+			}
+			return false
+		}
+
+		wrapped := false
+		for _, s := range scopes {
+			if !a.blockScoped(s) || !a.inLoop(s) {
+				continue
+			}
+			for _, name := range s.names {
+				if !captured(s, name) {
+					continue
+				}
+				var err error
+				tokens, err = d.loopFunction(a, s, refs, resolve)
+				if err != nil {
+					return nil, fmt.Errorf("can not give %s its own variable in every loop iteration, %s", name, err)
+				}
+				wrapped = true
+				break
+			}
+			if wrapped {
+				break
+			}
+		}
+		if wrapped {
+			continue
+		}
+
+		for _, s := range scopes {
+			s.renamed = map[string]string{}
+			if !a.blockScoped(s) {
+				continue
+			}
+			function := s
+			for !function.function {
+				function = function.parent
+			}
+			for _, name := range s.names {
+				for _, i := range refs[name] {
+					if i < function.start || i > function.end {
+						continue
+					}
+					r := resolve(i)
+					// sibling blocks can share a variable as long as no closure keeps it
+					if r == s || (r != nil && a.blockScoped(r) && (r.end < s.start || s.end < r.start) && !captured(r, name) && !captured(s, name)) {
+						continue
+					}
+					s.renamed[name] = d.fresh(name + "$")
+					break
+				}
+			}
+		}
+
+		return a.varDeclarations(resolve), nil
+	}
+}
+
+// blockScoped checks if a scope is a block or for statement, the scopes that let and const are
+// block scoped to
+func (a *analysis) blockScoped(s *scope) bool {
+	if s.function || s.parent == nil {
+		return false
+	}
+	switch open := a.at(s.start); open.Value {
+	case "{":
+		return true
+	case "(":
+		return a.at(s.start-1).Value == "for" || a.at(s.start-1).Value == "await"
+	}
+	return false
+}
+
+// loopBody checks if a block is the body of a loop
+func (a *analysis) loopBody(open int) bool {
+	prev := a.at(open - 1)
+	switch {
+	case prev.Type == keyword && prev.Value == "do":
+		return true
+	case prev.Value == ")" && a.match[open-1] >= 0 && a.kind[a.match[open-1]] == controlBracket:
+		control := a.at(a.match[open-1] - 1).Value
+		return control == "for" || control == "while" || control == "await"
+	}
+	return false
+}
+
+// inLoop checks if a block scope runs more than once in its function
+func (a *analysis) inLoop(s *scope) bool {
+	for ; s != nil && !s.function; s = s.parent {
+		if a.at(s.start).Value == "(" || a.loopBody(s.start) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopFunction moves the code of a block or the body of a for statement into a function that is
+// called right away, the variables of a for statement are passed to it, a break, continue or
+// return that leaves the code makes the function return what the loop does after the call, it
+// fails where the code would mean something else inside of a function
+func (d *downlevel) loopFunction(a *analysis, s *scope, refs map[string][]int, resolve func(int) *scope) ([]Token, error) {
+	tokens := a.tokens
+	start, end := s.start+1, s.end-1
+	params := []string{}
+	if tokens[s.start].Value == "(" {
+		start, end = a.match[s.start]+1, s.end
+		params = s.names
+		for _, name := range params {
+			for _, i := range refs[name] {
+				if i < start || i > end || resolve(i) != s {
+					continue
+				}
+				if assigns(a.at(i-1), a.at(i+1)) {
+					return nil, fmt.Errorf("it is assigned in the loop")
+				}
+			}
+		}
+	}
+
+	// loops and switches inside of the code can still be left with break and continue
+	inner := [][2]int{}
+	for j := start; j <= end; j++ {
+		if tokens[j].Type == keyword && (tokens[j].Value == "for" || tokens[j].Value == "while" || tokens[j].Value == "do" || tokens[j].Value == "switch") {
+			inner = append(inner, [2]int{j, a.statementEnd(j)})
+		}
+	}
+
+	result := d.fresh("kissLoop")
+	breaks, returns := false, false
+	body := []Token{}
+	for j := start; j <= end; j++ {
+		tok := tokens[j]
+		switch {
+		case tok.Value == "{" && (a.kind[j] == bodyBracket || a.kind[j] == classBracket):
+			body = append(body, tokens[j:a.match[j]+1]...)
+			j = a.match[j]
+			continue
+		case tok.Type == keyword && (tok.Value == "yield" || tok.Value == "await" || tok.Value == "var" || tok.Value == "super"):
+			return nil, fmt.Errorf("the loop uses %s", tok.Value)
+		case tok.Type == keyword && tok.Value == "function" && a.statementStart(j):
+			return nil, fmt.Errorf("the loop declares a function")
+		case tok.Type == identifier && tok.Value == "arguments" && a.reference(j):
+			return nil, fmt.Errorf("the loop uses arguments")
+		case tok.Type == keyword && tok.Value == "return":
+			returns = true
+			last := a.statementEnd(j)
+			if tokens[last].Value == ";" {
+				last--
+			}
+			value := tokens[j+1 : last+1]
+			if len(value) == 0 {
+				value = lex("void 0")
+			}
+			body = append(append(append(body, lex("return{value:")...), value...), Token{punctuator, "}"})
+			j = last
+			continue
+		case tok.Type == keyword && (tok.Value == "break" || tok.Value == "continue"):
+			contained := false
+			for _, loop := range inner {
+				if loop[0] < j && j <= loop[1] && (tok.Value == "break" || tokens[loop[0]].Value != "switch") {
+					contained = true
+				}
+			}
+			switch {
+			case a.at(j+1).Type == identifier:
+				// a label can name a statement outside of the code
+				return nil, fmt.Errorf("the loop uses %s with a label", tok.Value)
+			case contained:
+			case tok.Value == "break":
+				breaks = true
+				body = append(body, lex("return false")...)
+				continue
+			default:
+				body = append(body, Token{keyword, "return"})
+				continue
+			}
+		}
+		body = append(body, tok)
+	}
+
+	names := strings.Join(params, ",")
+	args := ""
+	if len(params) > 0 {
+		args = "," + names
+	}
+	call := "(function(" + names + "){"
+	after := "}).call(this" + args + ");"
+	if breaks || returns {
+		call = "var " + result + "=" + call
+	}
+	if breaks {
+		after += "if(" + result + "===false)break;"
+	}
+	if returns {
+		after += "if(" + result + ")return " + result + ".value;"
+	}
+
+	ret := append([]Token{}, tokens[:start]...)
+	ret = append(ret, lex("{"+call)...)
+	ret = append(ret, body...)
+	ret = append(ret, lex(after+"}")...)
+	return append(ret, tokens[end+1:]...), nil
+}
+
+// varDeclarations renames the variables that have a new name and turns let and const into var, a
+// let without a value is given undefined since a var keeps its value when a loop runs it again
+func (a *analysis) varDeclarations(resolve func(int) *scope) []Token {
+	tokens := a.tokens
+	undefined := map[int]bool{}
+	for i, tok := range tokens {
+		if tok.Type != keyword || tok.Value != "let" {
+			continue
+		}
+		for j := i + 1; j < len(tokens); {
+			_, next := a.pattern(j)
+			if a.at(next).Value == "=" {
+				next = a.exprEnd(next+1) + 1
+			} else if a.at(next).Value != "of" && a.at(next).Value != "in" {
+				undefined[next-1] = true
+			}
+			j = next
+			if a.at(j).Value != "," {
+				break
+			}
+			j++
+		}
+	}
+
+	ret := []Token{}
+	for i, tok := range tokens {
+		switch {
+		case tok.Type == keyword && (tok.Value == "let" || tok.Value == "const"):
+			ret = append(ret, Token{keyword, "var"})
+		case tok.Type == identifier && a.reference(i):
+			name := ""
+			if s := resolve(i); s != nil {
+				name = s.renamed[tok.Value]
+			}
+			switch {
+			case name == "":
+				ret = append(ret, tok)
+			case a.key(i):
+				ret = append(ret, tok, Token{punctuator, ":"}, Token{identifier, name})
+			default:
+				ret = append(ret, Token{identifier, name})
+			}
+		default:
+			ret = append(ret, tok)
+		}
+		if undefined[i] {
+			ret = append(ret, lex("=void 0")...)
+		}
+	}
+	return ret
+}
+
+// nullish rewrites a ?? b into a conditional, the first ?? is rewritten first so a chain of them
+// nests from the left, the operands reach out to the operators that bind less tightly than ??
+func (d *downlevel) nullish(tokens []Token) []Token {
+	for {
+		k := -1
+		for i, tok := range tokens {
+			if tok.Type == punctuator && tok.Value == "??" {
+				k = i
+				break
+			}
+		}
+		if k < 0 {
+			return tokens
+		}
+		a := analyze(tokens)
+
+		start := k
+		for start > 0 && a.parent[start-1] == a.parent[k] && !a.operandEdge(start-1) {
+			start--
+			if tok := tokens[start]; tok.Type == punctuator && (tok.Value == ")" || tok.Value == "]" || tok.Value == "}") {
+				start = a.match[start]
+			}
+		}
+		end := k
+		for end+1 < len(tokens) && a.parent[end+1] == a.parent[k] && !a.operandEdge(end+1) && tokens[end+1].Value != "??" {
+			end++
+			if a.match[end] > end {
+				end = a.match[end]
+			}
+		}
+
+		left, right := tokens[start:k], tokens[k+1:end+1]
+		ret := []Token{Token{punctuator, "("}}
+		temp := ""
+		if simple(left) {
+			ret = append(append(append(ret, left...), lex("!=null?")...), left...)
+		} else {
+			temp = d.fresh("kissTemp")
+			ret = append(append(append(ret, lex("("+temp+"=")...), left...), lex(")!=null?"+temp)...)
+		}
+		ret = append(append(append(ret, Token{punctuator, ":"}), right...), Token{punctuator, ")"})
+
+		tokens = append(tokens[:start], append(ret, tokens[end+1:]...)...)
+		if temp != "" {
+			tokens = a.temps(tokens, start, temp)
+		}
+	}
+}
+
+// operandEdge checks if the token at i is outside of the operands of a ??, it is an operator that
+// binds less tightly, ends a statement or is part of one
+func (a *analysis) operandEdge(i int) bool {
+	tok := a.tokens[i]
+	switch tok.Type {
+	case punctuator:
+		switch tok.Value {
+		case "||", "&&", "?", ":", ",", ";", "=>":
+			return true
+		case ")":
+			return a.match[i] >= 0 && a.kind[a.match[i]] == controlBracket
+		case "{", "}":
+			open := i
+			if tok.Value == "}" {
+				open = a.match[i]
+			}
+			return open < 0 || a.kind[open] != objectBracket
+		}
+		return strings.HasSuffix(tok.Value, "=") && precedence(tok) == 0
+	case keyword:
+		switch tok.Value {
+		case "return", "throw", "case", "yield", "else", "do", "in":
+			return tok.Value != "in" || (a.parent[i] >= 0 && a.kind[a.parent[i]] == controlBracket)
+		}
+	case identifier:
+		return tok.Value == "of" && a.parent[i] >= 0 && a.kind[a.parent[i]] == controlBracket
+	}
+	return false
+}
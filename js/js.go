@@ -2,81 +2,21 @@ package js
 
 import (
 	"fmt"
-	"regexp"
 )
 
 const (
-	openImport = iota
-	closeImport
-	kissKeyword
+	identifier = iota
 	keyword
+	template
+	number
 	value
-	openCloseString
-	escapedOpenCloseString
+	templateLiteral
+	regex
+	punctuator
 	whiteSpace
-	colon
-	comma
-	semiColon
-	closeExpression
-	openExpression
-	openObject
-	closeObject
-	dot
-	equal
 	newLine
-	template
-	comment
-	commentStart
-	blockCommentStart
-	blockCommentEnd
-	logicalOp
-	any
 )
 
-var tokenPatterns = []tokenPattern{
-	tokenPattern{openImport, regexp.MustCompile(`^\({`)},
-	tokenPattern{closeImport, regexp.MustCompile(`^}\)`)},
-	tokenPattern{kissKeyword, regexp.MustCompile(`^KISSimport`)},
-	tokenPattern{kissKeyword, regexp.MustCompile(`^remote`)},
-	tokenPattern{keyword, regexp.MustCompile(`^function {0,1}`)},
-	tokenPattern{keyword, regexp.MustCompile(`^var `)},
-	tokenPattern{keyword, regexp.MustCompile(`^let `)},
-	tokenPattern{keyword, regexp.MustCompile(`^yield `)},
-	tokenPattern{keyword, regexp.MustCompile(`^new `)},
-	tokenPattern{keyword, regexp.MustCompile(`^return `)},
-	tokenPattern{keyword, regexp.MustCompile(`^const `)},
-	tokenPattern{keyword, regexp.MustCompile(`^document`)},
-	tokenPattern{keyword, regexp.MustCompile(`^async {0,1}`)},
-	tokenPattern{keyword, regexp.MustCompile(`^await {0,1}`)},
-	tokenPattern{keyword, regexp.MustCompile(`^import {0,1}`)},
-	tokenPattern{equal, regexp.MustCompile(`^=`)},
-	tokenPattern{value, regexp.MustCompile(`^(?:true|false)`)},
-	tokenPattern{escapedOpenCloseString, regexp.MustCompile(`^\\['"]`)},
-	tokenPattern{openCloseString, regexp.MustCompile(`^[\x60'"]`)},
-	tokenPattern{whiteSpace, regexp.MustCompile(`^[ \t]+`)},
-	tokenPattern{newLine, regexp.MustCompile(`^[\n\r]+`)},
-	tokenPattern{semiColon, regexp.MustCompile(`^;`)},
-	tokenPattern{colon, regexp.MustCompile(`^:`)},
-	tokenPattern{comma, regexp.MustCompile(`^,`)},
-	tokenPattern{openObject, regexp.MustCompile(`^{`)},
-	tokenPattern{closeObject, regexp.MustCompile(`^}`)},
-	tokenPattern{openExpression, regexp.MustCompile(`^[\(\[]`)},
-	tokenPattern{closeExpression, regexp.MustCompile(`^[\)\]]`)},
-	tokenPattern{dot, regexp.MustCompile(`^\.`)},
-	tokenPattern{template, regexp.MustCompile(`^\$[_a-zA-Z][_a-zA-Z0-9]*\$`)},
-	tokenPattern{commentStart, regexp.MustCompile(`^\/\/`)},
-	tokenPattern{blockCommentStart, regexp.MustCompile(`^\/\*`)},
-	tokenPattern{blockCommentEnd, regexp.MustCompile(`^\*\/`)},
-	tokenPattern{logicalOp, regexp.MustCompile(`^(&&|\|\|)`)},
-	tokenPattern{any, regexp.MustCompile(`^.`)},
-}
-
-// tokenPattern matches a regex with a tokenType
-type tokenPattern struct {
-	tType   int
-	pattern *regexp.Regexp
-}
-
 // Token is a token type and value
 type Token struct {
 	Type  int
@@ -94,9 +34,16 @@ type Line struct {
 	Value []Token
 }
 
-// Script is a parsed js file
+func (line Line) last() Token {
+	return line.Value[len(line.Value)-1]
+}
+
+// Script is a parsed js file, Imports are the KISSimport statements and Modules and Exports
+// are the es module import and export declarations
 type Script struct {
 	Imports []Import
+	Modules []ModuleImport
+	Exports []ModuleExport
 	Lines   []Line
 }
 
@@ -122,6 +69,17 @@ func (script Script) Clone() Script {
 		)
 	}
 
+	for _, mod := range script.Modules {
+		clone.Modules = append(clone.Modules,
+			ModuleImport{
+				Src:   mod.Src,
+				Names: append([]Binding{}, mod.Names...),
+				Lazy:  mod.Lazy,
+			},
+		)
+	}
+	clone.Exports = append(clone.Exports, script.Exports...)
+
 	for _, line := range script.Lines {
 		newLine := Line{}
 		for _, tok := range line.Value {
@@ -133,262 +91,304 @@ func (script Script) Clone() Script {
 	return clone
 }
 
-// LexScript lexes a js script and returns a series of tokens
-func LexScript(script string) []Token {
+// ParseTokens will parse a series of tokens passed from the lexer into a Script object, the
+// semicolons that automatic semicolon insertion would add at line breaks are made explicit
+// since the lines are joined together when the script is rendered
+func ParseTokens(script []Token) (Script, error) {
+	ret := Script{}
 	tokens := []Token{}
-	i := 0
-	for i < len(script) {
-		for _, token := range tokenPatterns {
-			index := token.pattern.FindIndex([]byte(script[i:]))
-			if index != nil {
-				tokens = append(tokens,
-					Token{
-						Type:  token.tType,
-						Value: script[i : i+index[1]],
-					},
-				)
-				i += index[1]
-				break
+	for i := 0; i < len(script); i++ {
+		if statementStart(tokens) {
+			count, jsImport := parseImportStatment(script[i:])
+			if count > 0 {
+				ret.Imports = append(ret.Imports, jsImport)
+				i += count - 1
+				continue
 			}
 		}
+		tokens = append(tokens, script[i])
 	}
 
-	// filter results
-	ret := []Token{}
-	i = 0
-	for i < len(tokens) {
-		if tokens[i].Type == whiteSpace {
-			i++
-			continue
-		}
-		if tokens[i].Type == openCloseString {
-			count, str := lexString(tokens[i:])
-			ret = append(ret, str)
-			i += count
+	tokens, err := insertSemiColons(tokens)
+	if err != nil {
+		return Script{}, err
+	}
+	tokens, err = extractModules(tokens, &ret)
+	if err != nil {
+		return Script{}, err
+	}
+
+	ret.Lines = splitLines(tokens)
+	return ret, nil
+}
+
+// splitLines splits tokens into lines at the line breaks, empty lines are dropped
+func splitLines(tokens []Token) []Line {
+	ret := []Line{}
+	line := Line{}
+	for _, tok := range tokens {
+		if tok.Type == newLine {
+			if len(line.Value) > 0 {
+				ret = append(ret, line)
+			}
+			line = Line{}
 			continue
 		}
-		if tokens[i].Type == commentStart ||
-			tokens[i].Type == blockCommentStart {
-			count, _ := lexComment(tokens[i:])
-			i += count
+		// a space separating the line from a statement that was ended by a semicolon isn't needed
+		if tok.Type == whiteSpace && len(line.Value) == 0 && len(ret) > 0 && ret[len(ret)-1].last().Value == ";" {
 			continue
 		}
-		ret = append(ret, tokens[i])
-		i++
+		line.Value = append(line.Value, tok)
+	}
+	if len(line.Value) > 0 {
+		ret = append(ret, line)
 	}
-
 	return ret
 }
 
-func lexString(script []Token) (int, Token) {
-	if script[0].Type != openCloseString {
-		return 0, Token{}
-	}
-	ret := Token{Type: value, Value: script[0].Value}
-	i := 1
-	for i < len(script) {
-		tok := script[i].Type
-		ret.Value += script[i].Value
-		i++
-		if tok == openCloseString {
-			return i, ret
+// tokens joins the lines of a script into one list with line breaks between them
+func (script Script) tokens() []Token {
+	ret := []Token{}
+	for i, line := range script.Lines {
+		if i > 0 {
+			ret = append(ret, Token{newLine, "\n"})
 		}
+		ret = append(ret, line.Value...)
 	}
-	return 0, Token{}
+	return ret
 }
 
-func lexComment(script []Token) (int, Token) {
-	if script[0].Type != commentStart &&
-		script[0].Type != blockCommentStart {
-		return 0, Token{}
-	}
-	ret := Token{Type: comment, Value: script[0].Value}
-	i := 1
-	endType := newLine
-	if script[0].Type == blockCommentStart {
-		endType = blockCommentEnd
-	}
-	for i < len(script) {
-		tok := script[i].Type
-		ret.Value += script[i].Value
-		i++
-		if tok == endType {
-			return i, ret
+// statementStart checks if the next token would start a new statement
+func statementStart(tokens []Token) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		switch tokens[i].Type {
+		case whiteSpace:
+			continue
+		case newLine:
+			return true
 		}
+		return tokens[i].Value == ";" || tokens[i].Value == "}"
 	}
-	return 0, Token{}
+	return true
 }
 
-// ParseTokens will parse a series of tokens passed from the lexer into a Script object
-func ParseTokens(script []Token) (Script, error) {
-	ret := Script{}
-	var i, start int
-	for i < len(script) {
-		start = i
-		if script[i].Type == whiteSpace {
-			i++
-			continue
+// bracket is an open bracket, control marks the parentheses of if, for and while statements
+// and the braces of a do statement
+type bracket struct {
+	value   string
+	control bool
+}
+
+// insertSemiColons adds a semicolon at each line break where https://tc39.es/ecma262/#sec-automatic-semicolon-insertion
+// would insert one, and at the end of the script so it can be joined to other scripts, it
+// also checks that the brackets are balanced
+func insertSemiColons(tokens []Token) ([]Token, error) {
+	ret := []Token{}
+	stack := []bracket{}
+	var prev, before *Token
+	var closed bracket
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.Type == value && (len(tok.Value) < 2 || tok.Value[len(tok.Value)-1] != tok.Value[0]) {
+			return nil, fmt.Errorf("unterminated string %s", tok.Value)
+		}
+		if tok.Type == templateLiteral && (len(tok.Value) < 2 || tok.Value[len(tok.Value)-1] != '`') {
+			return nil, fmt.Errorf("unterminated template literal %s", tok.Value)
 		}
-		count, jsImport := parseImportStatment(script[i:])
-		if count > 0 {
-			i += count
-			ret.Imports = append(ret.Imports, jsImport)
+
+		if tok.Type == newLine {
+			next := nextToken(tokens[i:])
+			inBlock := len(stack) == 0 || stack[len(stack)-1].value == "{"
+			if prev != nil && next != nil && inBlock && lineBreakSemiColon(*prev, *next, closed) {
+				ret = append(ret, Token{punctuator, ";"})
+			}
+			ret = append(ret, tok)
 			continue
 		}
-		count, line := parseLine(script[i:])
-		if count > 0 {
-			i += count
-			ret.Lines = append(ret.Lines, line)
+		if tok.Type == whiteSpace {
+			ret = append(ret, tok)
+			continue
 		}
-		if i == start {
-			return Script{}, fmt.Errorf("failed to parse js token, '%s'", script[i].Value)
+
+		if tok.Type == punctuator {
+			switch tok.Value {
+			case "(", "[", "{":
+				control := false
+				member := before != nil && (before.Value == "." || before.Value == "?.")
+				if prev != nil && prev.Type == keyword && !member {
+					switch prev.Value {
+					case "if", "for", "while", "with", "switch", "catch":
+						control = tok.Value == "("
+					case "do":
+						control = tok.Value == "{"
+					}
+				}
+				stack = append(stack, bracket{tok.Value, control})
+			case ")", "]", "}":
+				if len(stack) == 0 || closing(stack[len(stack)-1].value) != tok.Value {
+					return nil, fmt.Errorf("unexpected %s", tok.Value)
+				}
+				closed = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
 		}
-	}
 
-	ret.Lines = addSemiColons(ret.Lines)
+		ret = append(ret, tok)
+		before = prev
+		prev = &tokens[i]
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("missing %s", closing(stack[len(stack)-1].value))
+	}
 
+	if prev != nil && (prev.Value == "}" || endsStatement(*prev, closed)) {
+		ret = append(ret, Token{punctuator, ";"})
+	}
 	return ret, nil
 }
 
-func parseLine(script []Token) (int, Line) {
-	ret := Line{}
-	i := 0
-	for script[i].Type == newLine {
-		i++
-		if i >= len(script) {
-			return i, Line{}
+func nextToken(tokens []Token) *Token {
+	for i := range tokens {
+		if tokens[i].Type != newLine && tokens[i].Type != whiteSpace {
+			return &tokens[i]
 		}
 	}
-	for i < len(script) {
-		tok := script[i].Type
-		if tok == newLine {
-			i++
-			break
-		}
-		if tok == semiColon {
-			i++
-			break
-		}
-		ret.Value = append(ret.Value, script[i])
-		i++
-	}
-	if len(ret.Value) == 0 {
-		return 0, ret
+	return nil
+}
+
+func closing(open string) string {
+	switch open {
+	case "(":
+		return ")"
+	case "[":
+		return "]"
 	}
-	return i, ret
+	return "}"
 }
 
-func addSemiColons(lines []Line) []Line {
-	for i := 0; i < len(lines); i++ {
-		line := &lines[i]
-		if len(line.Value) == 0 {
-			continue
-		}
-		preTok := line.Value[len(line.Value)-1].Type
-		postTok := any
-		if i+1 < len(lines) && len(lines[i+1].Value) > 0 {
-			postTok = lines[i+1].Value[0].Type
-		}
+// lineBreakSemiColon checks if a semicolon is inserted at a line break between two tokens, closed
+// is the last bracket that was closed
+func lineBreakSemiColon(prev, next Token, closed bracket) bool {
+	if next.Value == ";" {
+		return false
+	}
 
-		add := true
-		switch preTok {
-		case semiColon:
-			add = false
-		case openExpression:
-			add = false
-		case openObject:
-			add = false
-		case closeObject:
-			add = false
-		case dot:
-			add = false
-		case equal:
-			add = false
-		case colon:
-			add = false
-		case comma:
-			add = false
-		case openImport:
-			add = false
-		case logicalOp:
-			add = false
+	// restricted productions can't continue on the next line
+	if prev.Type == keyword {
+		switch prev.Value {
+		case "return", "break", "continue", "throw", "yield":
+			return next.Value != "}"
 		}
+	}
+	if next.Value == "++" || next.Value == "--" {
+		return endsStatement(prev, closed)
+	}
 
-		switch postTok {
-		case closeExpression:
-			add = false
-		case closeObject:
-			add = false
-		case closeImport:
-			add = false
-		}
+	if !endsStatement(prev, closed) {
+		return false
+	}
+	switch {
+	case prev.Value == ")" && next.Value == "{":
+		return false
+	case prev.Value == "}" && (next.Value == "else" || next.Value == "catch" || next.Value == "finally"):
+		return false
+	case prev.Value == "}" && next.Value == "while" && closed.control:
+		return false
+	}
 
-		if preTok == closeObject && postTok == keyword {
-			add = true
-		}
-		if preTok == closeObject && postTok == any {
-			add = true
-		}
-		if preTok == closeExpression && postTok == closeExpression {
-			add = false
-		}
+	// only a token that can't continue the statement causes a semicolon to be inserted
+	switch next.Type {
+	case identifier, template, number, value:
+		return true
+	case keyword:
+		return next.Value != "in" && next.Value != "instanceof"
+	case punctuator:
+		return next.Value == "{" || next.Value == "!" || next.Value == "~" || next.Value == "@"
+	}
+	return false
+}
 
-		if add {
-			line.Value = append(line.Value, Token{semiColon, ";"})
+// endsStatement checks if a statement can end with the token
+func endsStatement(tok Token, closed bracket) bool {
+	switch tok.Type {
+	case identifier, template, number, value, templateLiteral, regex:
+		return true
+	case keyword:
+		return endsExpression(tok) || tok.Value == "debugger"
+	case punctuator:
+		switch tok.Value {
+		case ")":
+			return !closed.control
+		case "]", "}", "++", "--":
+			return true
 		}
 	}
+	return false
+}
 
-	return lines
+// endsExpression checks if a keyword is a value that can end an expression
+func endsExpression(tok Token) bool {
+	switch tok.Value {
+	case "this", "super", "null", "true", "false":
+		return true
+	}
+	return false
 }
 
+// parseImportStatment parses ({KISSimport: "file.js", remote: true}); statements
 func parseImportStatment(script []Token) (int, Import) {
+	ret := Import{}
+	expect := []string{"(", "{", "KISSimport", ":"}
 	i := 0
-	for script[i].Type == newLine {
-		i++
+	next := func() *Token {
+		for i < len(script) && (script[i].Type == newLine || script[i].Type == whiteSpace) {
+			i++
+		}
 		if i >= len(script) {
+			return nil
+		}
+		i++
+		return &script[i-1]
+	}
+
+	for _, val := range expect {
+		tok := next()
+		if tok == nil || tok.Value != val {
 			return 0, Import{}
 		}
 	}
-	if script[i].Type != openImport {
+	tok := next()
+	if tok == nil || tok.Type != value {
 		return 0, Import{}
 	}
-	ret := Import{}
-	expectedToken := kissKeyword
-	keyword := ""
-	i++
-	for i < len(script) {
-		tok := script[i].Type
-		if tok == whiteSpace {
-			i++
-			continue
-		}
-		if tok == closeImport {
-			i += 2
-			return i, ret
-		}
+	ret.Src = tok.Value[1 : len(tok.Value)-1]
 
-		if tok != expectedToken {
-			break
-		}
-		switch tok {
-		case kissKeyword:
-			keyword = script[i].Value
-			expectedToken = colon
-		case colon:
-			expectedToken = value
-		case value:
-			val := script[i].Value
-			if keyword == "KISSimport" {
-				ret.Src = val[1 : len(val)-1]
+	tok = next()
+	if tok != nil && tok.Value == "," {
+		tok = next()
+		if tok != nil && tok.Value == "remote" {
+			if tok = next(); tok == nil || tok.Value != ":" {
+				return 0, Import{}
 			}
-			if keyword == "remote" {
-				ret.Remote = (val == "true")
+			tok = next()
+			if tok == nil {
+				return 0, Import{}
 			}
-			expectedToken = comma
-		case comma:
-			expectedToken = kissKeyword
+			ret.Remote = tok.Value == "true"
+			tok = next()
 		}
-		i++
 	}
-	return 0, Import{}
+	if tok == nil || tok.Value != "}" {
+		return 0, Import{}
+	}
+	if tok = next(); tok == nil || tok.Value != ")" {
+		return 0, Import{}
+	}
+
+	// the semicolon is optional
+	end := i
+	if tok = next(); tok != nil && tok.Value == ";" {
+		end = i
+	}
+	return end, ret
 }
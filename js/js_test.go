@@ -1,27 +1,31 @@
 package js
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestLexScript(t *testing.T) {
 	script := `({KISSimport:"t.js", remote: true});`
 	ok := []Token{
-		Token{Type: openImport, Value: "({"},
-		Token{Type: kissKeyword, Value: "KISSimport"},
-		Token{Type: colon, Value: ":"},
+		Token{Type: punctuator, Value: "("},
+		Token{Type: punctuator, Value: "{"},
+		Token{Type: identifier, Value: "KISSimport"},
+		Token{Type: punctuator, Value: ":"},
 		Token{Type: value, Value: `"t.js"`},
-		Token{Type: comma, Value: ","},
-		Token{Type: kissKeyword, Value: "remote"},
-		Token{Type: colon, Value: ":"},
-		Token{Type: value, Value: "true"},
-		Token{Type: closeImport, Value: "})"},
-		Token{Type: semiColon, Value: ";"}}
+		Token{Type: punctuator, Value: ","},
+		Token{Type: identifier, Value: "remote"},
+		Token{Type: punctuator, Value: ":"},
+		Token{Type: keyword, Value: "true"},
+		Token{Type: punctuator, Value: "}"},
+		Token{Type: punctuator, Value: ")"},
+		Token{Type: punctuator, Value: ";"}}
 	tokens := LexScript(script)
 	if len(ok) != len(tokens) {
 		t.Errorf("Expecting %d tokens, but got %d", len(ok), len(tokens))
 	}
-	for i := 0; i < len(ok); i++ {
+	for i := 0; i < len(ok) && i < len(tokens); i++ {
 		if ok[i].Type != tokens[i].Type {
 			t.Errorf("Expecting tokenType %d, but got %d", ok[i].Type, tokens[i].Type)
 		}
@@ -30,37 +34,29 @@ func TestLexScript(t *testing.T) {
 		}
 	}
 
-	script = `console.log( "\"Test\"" );
+	script = `console.log( "\"Test\"" ); // comment
 let a = 10`
 	tokens = LexScript(script)
 	ok = []Token{
-		Token{Type: any, Value: "c"},
-		Token{Type: any, Value: "o"},
-		Token{Type: any, Value: "n"},
-		Token{Type: any, Value: "s"},
-		Token{Type: any, Value: "o"},
-		Token{Type: any, Value: "l"},
-		Token{Type: any, Value: "e"},
-		Token{Type: dot, Value: "."},
-		Token{Type: any, Value: "l"},
-		Token{Type: any, Value: "o"},
-		Token{Type: any, Value: "g"},
-		Token{Type: openExpression, Value: "("},
+		Token{Type: identifier, Value: "console"},
+		Token{Type: punctuator, Value: "."},
+		Token{Type: identifier, Value: "log"},
+		Token{Type: punctuator, Value: "("},
 		Token{Type: value, Value: `"\"Test\""`},
-		Token{Type: closeExpression, Value: ")"},
-		Token{Type: semiColon, Value: ";"},
+		Token{Type: punctuator, Value: ")"},
+		Token{Type: punctuator, Value: ";"},
 		Token{Type: newLine, Value: "\n"},
-		Token{Type: keyword, Value: "let "},
-		Token{Type: any, Value: "a"},
-		Token{Type: equal, Value: "="},
-		Token{Type: any, Value: "1"},
-		Token{Type: any, Value: "0"},
+		Token{Type: keyword, Value: "let"},
+		Token{Type: whiteSpace, Value: " "},
+		Token{Type: identifier, Value: "a"},
+		Token{Type: punctuator, Value: "="},
+		Token{Type: number, Value: "10"},
 	}
 
 	if len(ok) != len(tokens) {
 		t.Errorf("Expecting %d tokens, but got %d", len(ok), len(tokens))
 	}
-	for i := 0; i < len(ok); i++ {
+	for i := 0; i < len(ok) && i < len(tokens); i++ {
 		if ok[i].Type != tokens[i].Type {
 			t.Errorf("Expecting tokenType %d, but got %d", ok[i].Type, tokens[i].Type)
 		}
@@ -70,6 +66,50 @@ let a = 10`
 	}
 }
 
+func TestLexLiterals(t *testing.T) {
+	type test struct {
+		script string
+		check  []string
+	}
+
+	tests := []test{
+		test{
+			script: `let q = /"[/]/g.test(s) / 2`,
+			check:  []string{"let", " ", "q", "=", `/"[/]/g`, ".", "test", "(", "s", ")", "/", "2"},
+		},
+		test{
+			script: "let s = `a ${ {b: \"}`\"}.b } c`",
+			check:  []string{"let", " ", "s", "=", "`a ${ {b: \"}`\"}.b } c`"},
+		},
+		test{
+			script: `if (x) return /* a
+			*/ typeof $id$ === 'it\'s'`,
+			check: []string{"if", "(", "x", ")", "return", "\n", " ", "typeof", " ", "$id$", "===", `'it\'s'`},
+		},
+		test{
+			script: `a + +b - -1.5e3 + .5 + 0x1F + 1n`,
+			check:  []string{"a", "+", " ", "+", "b", "-", " ", "-", "1.5e3", "+", ".5", "+", "0x1F", "+", "1n"},
+		},
+		test{
+			script: `a?.b ?? c?.5:1`,
+			check:  []string{"a", "?.", "b", "??", "c", "?", ".5", ":", "1"},
+		},
+	}
+
+	for i, run := range tests {
+		tokens := LexScript(run.script)
+		if len(tokens) != len(run.check) {
+			t.Errorf("(%d) Expecting %d tokens, but got %d %v", i, len(run.check), len(tokens), tokens)
+			continue
+		}
+		for ii, tok := range tokens {
+			if tok.Value != run.check[ii] {
+				t.Errorf("(%d|%d) Expecting value of %s but got %s", i, ii, run.check[ii], tok.Value)
+			}
+		}
+	}
+}
+
 func TestParseTokens(t *testing.T) {
 	type test struct {
 		script     string
@@ -105,7 +145,6 @@ func TestParseTokens(t *testing.T) {
 				"var t=test({",
 				"hi:5,",
 				"});",
-				"",
 			},
 		},
 		test{
@@ -149,6 +188,77 @@ func TestParseTokens(t *testing.T) {
 				`}).`,
 			},
 		},
+		test{
+			script: `
+				fetch(url)
+					.then(res => res.json())
+					.then(data => {
+						console.log(data)
+					})
+				let count = 0
+				count
+				++count
+				`,
+			check: Script{},
+			checkLines: []string{
+				"fetch(url)",
+				".then(res=>res.json())",
+				".then(data=>{",
+				"console.log(data)",
+				"});",
+				"let count=0;",
+				"count;",
+				"++count;",
+			},
+		},
+		test{
+			script: `
+				function f(a)
+				{
+					if (a)
+						return
+					else
+						a = [1,
+							2]
+					do {
+						a++
+					} while (a < 5)
+				}
+				let s = a
+				` + "`${a}`" + `
+				`,
+			check: Script{},
+			checkLines: []string{
+				"function f(a)",
+				"{",
+				"if(a)",
+				"return;",
+				"else",
+				" a=[1,",
+				"2];",
+				"do{",
+				"a++",
+				"}while(a<5)",
+				"};",
+				"let s=a",
+				"`${a}`;",
+			},
+		},
+		test{
+			script: `
+				load()
+					.then(res => res.default)
+					.catch(e => console.log(e))
+				let z = 1
+				`,
+			check: Script{},
+			checkLines: []string{
+				"load()",
+				".then(res=>res.default)",
+				".catch(e=>console.log(e));",
+				"let z=1;",
+			},
+		},
 	}
 
 	for i, run := range tests {
@@ -186,3 +296,557 @@ func TestParseTokens(t *testing.T) {
 }
 
 // TODO: we need better test coverage on this stuff
+
+func TestModules(t *testing.T) {
+	type test struct {
+		script  string
+		modules []ModuleImport
+		exports []ModuleExport
+		lines   []string
+	}
+
+	tests := []test{
+		test{
+			script: `
+			import def, { a, b as c } from "./a.js"
+			import * as ns from './b.js';
+			import "./side.js"
+			let x = import("./lazy.js")
+			`,
+			modules: []ModuleImport{
+				ModuleImport{Src: "./a.js", Names: []Binding{Binding{"def", "default"}, Binding{"a", "a"}, Binding{"c", "b"}}},
+				ModuleImport{Src: "./b.js", Names: []Binding{Binding{"ns", "*"}}},
+				ModuleImport{Src: "./side.js"},
+			},
+			lines: []string{`let x=import("./lazy.js");`},
+		},
+		test{
+			script: `
+			export const one = 1, two = [1, 2]
+			export async function load() {}
+			export { one as uno, two }
+			export * from "./c.js"
+			export { d as e } from "./d.js"
+			export default {
+				one
+			}
+			`,
+			exports: []ModuleExport{
+				ModuleExport{Binding: Binding{"one", "one"}},
+				ModuleExport{Binding: Binding{"two", "two"}},
+				ModuleExport{Binding: Binding{"load", "load"}},
+				ModuleExport{Binding: Binding{"one", "uno"}},
+				ModuleExport{Binding: Binding{"two", "two"}},
+				ModuleExport{Binding: Binding{"", "*"}, From: "./c.js"},
+				ModuleExport{Binding: Binding{"d", "e"}, From: "./d.js"},
+				ModuleExport{Binding: Binding{DefaultName, "default"}},
+			},
+			lines: []string{
+				"const one=1,two=[1,2];",
+				"async function load(){};",
+				"var kissDefault={",
+				"one",
+				"};",
+			},
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		if fmt.Sprint(script.Modules) != fmt.Sprint(run.modules) {
+			t.Errorf("(%d) Expected modules %v, got %v", i, run.modules, script.Modules)
+		}
+		if fmt.Sprint(script.Exports) != fmt.Sprint(run.exports) {
+			t.Errorf("(%d) Expected exports %v, got %v", i, run.exports, script.Exports)
+		}
+		if len(script.Lines) != len(run.lines) {
+			t.Errorf("(%d) Expected %d lines, got %d", i, len(run.lines), len(script.Lines))
+			continue
+		}
+		for ii, line := range script.Lines {
+			str := ""
+			for _, tok := range line.Value {
+				str += tok.Value
+			}
+			if str != run.lines[ii] {
+				t.Errorf("(%d|%d) Expected line %s, got %s", i, ii, run.lines[ii], str)
+			}
+		}
+	}
+
+	_, err := ParseTokens(LexScript(`export const { a } = b`))
+	if err == nil {
+		t.Errorf("Expected an error exporting a destructured declaration")
+	}
+}
+
+func TestShake(t *testing.T) {
+	type test struct {
+		script  string
+		keep    []string
+		exports int
+		check   string
+	}
+
+	tests := []test{
+		test{
+			script: `
+			const registry = []
+			const helper = (x) => x + 1
+			export function observe(obj) {
+				registry.push(obj)
+			}
+			export function unwatch(obj) {
+				return helper(registry.indexOf(obj))
+			}
+			export const VERSION = "1.0"
+			`,
+			keep:    []string{"observe"},
+			exports: 1,
+			check:   "const registry=[];function observe(obj){registry.push(obj)};",
+		},
+		test{
+			script: `
+			let count = start()
+			export let a = 1, b = ` + "`${count}`" + `
+			export class C {}
+			export default function () {}
+			`,
+			keep:    []string{},
+			exports: 0,
+			check:   "let count=start();let a=1,b=`${count}`;",
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		script.Shake(func(name string) bool {
+			for _, keep := range run.keep {
+				if keep == name {
+					return true
+				}
+			}
+			return false
+		})
+		if len(script.Exports) != run.exports {
+			t.Errorf("(%d) Expected %d exports, got %d", i, run.exports, len(script.Exports))
+		}
+		if script.String() != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, script.String())
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	type test struct {
+		script string
+		refs   map[string]string
+		check  string
+	}
+
+	tests := []test{
+		test{
+			script: `export function b() { return a() + ns.name }`,
+			refs:   map[string]string{"a": `mods["a"]["a"]`, "ns": `mods["a"]`},
+			check:  `function b(){return mods["a"]["a"]()+mods["a"].name};`,
+		},
+		test{
+			script: `function f(a) { return a + obj.a + {a}.a } let g = () => ({a, b: a})`,
+			refs:   map[string]string{"a": `mods["a"]["a"]`},
+			check:  `function f(a){return a+obj.a+{a}.a}let g=()=>({a:mods["a"]["a"],b:mods["a"]["a"]});`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		linked := script.Link(run.refs)
+		if linked.String() != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, linked.String())
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	type test struct {
+		script string
+		names  []string
+		ok     bool
+		check  string
+	}
+
+	tests := []test{
+		test{
+			script: `let elm = document.getElementById("$id$")`,
+			names:  []string{"id"},
+			ok:     true,
+			check:  "let elm=document.getElementById(($params.id));",
+		},
+		test{
+			script: `alert('button $id$ was pressed $count$ times by $id$')`,
+			names:  []string{"id", "count"},
+			ok:     true,
+			check:  "alert(('button '+$params.id+' was pressed '+$params.count+' times by '+$params.id));",
+		},
+		test{
+			script: "console.log(`hello $name$`)",
+			names:  []string{"name"},
+			ok:     true,
+			check:  "console.log(`hello ${$params.name}`);",
+		},
+		test{
+			script: `let obj = {"key_$a$": $b$, c: $class$}`,
+			names:  []string{"a", "b$", "class$"},
+			ok:     true,
+			check:  `let obj={["key_"+$params.a]:$params.b$,c:$params.class$};`,
+		},
+		test{
+			script: `let total = "$count$" + $count$, on = "$on$" === "true", len = "$count$".length`,
+			names:  []string{"count", "count$", "on"},
+			ok:     true,
+			check:  `let total=($params.count)+$params.count$,on=($params.on)==="true",len=($params.count).length;`,
+		},
+		test{
+			script: `let $name$ = 1`,
+			ok:     false,
+			check:  "let $name$=1;",
+		},
+		test{
+			script: `/a$x$/.test(str)`,
+			ok:     false,
+			check:  "/a$x$/.test(str);",
+		},
+		test{
+			script: `let str = "\$x$"`,
+			ok:     false,
+			check:  `let str="\$x$";`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		names, ok := script.Params()
+		if ok != run.ok {
+			t.Errorf("(%d) Expected ok to be %t, got %t", i, run.ok, ok)
+		}
+		if ok && strings.Join(names, ",") != strings.Join(run.names, ",") {
+			t.Errorf("(%d) Expected names %v, got %v", i, run.names, names)
+		}
+		if script.String() != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, script.String())
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	type test struct {
+		script string
+		params map[string]string
+		err    bool
+		check  string
+	}
+
+	tests := []test{
+		test{
+			script: `let a = "$x$", b = 'it$x$'`,
+			params: map[string]string{"x": `'s "quoted"</script>`},
+			check:  `let a="'s \"quoted\"\x3c/script>",b='it\'s "quoted"\x3c/script>';`,
+		},
+		test{
+			script: `let count = $count$ + 1`,
+			params: map[string]string{"count": `1;alert("hi")`},
+			check:  `let count="1;alert(\"hi\")"+1;`,
+		},
+		test{
+			script: `let n = $count$ + 1, d = 1 - $delta$, on = $on$, s = $count$.toFixed(1)`,
+			params: map[string]string{"count": "5", "delta": "-2.5", "on": "true"},
+			check:  `let n=5+1,d=1-(-2.5),on=true,s=(5).toFixed(1);`,
+		},
+		test{
+			script: "let msg = `hello $name$`",
+			params: map[string]string{"name": "${alert(1)}`"},
+			check:  "let msg=`hello \\${alert(1)}\\``;",
+		},
+		test{
+			script: `let match = /^$x$$/.test(str)`,
+			params: map[string]string{"x": "a.b/c"},
+			check:  `let match=/^a\.b\/c$/.test(str);`,
+		},
+		test{
+			script: `obj.$prop$ = 1; let $name$ = 2`,
+			params: map[string]string{"prop": "title", "name": "second"},
+			check:  `obj.title=1;let second=2;`,
+		},
+		test{
+			script: `let $name$ = 1`,
+			params: map[string]string{"name": "a=alert(1)"},
+			err:    true,
+		},
+		test{
+			script: `let on$name$ = 1`,
+			params: map[string]string{"name": "Click"},
+			check:  `let onClick=1;`,
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		err = script.Substitute(func(match string) (string, error) {
+			return run.params[match[1:len(match)-1]], nil
+		})
+		if run.err {
+			if err == nil {
+				t.Errorf("(%d) Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(%d) there was an error substituting the params %s", i, err)
+			continue
+		}
+		if script.String() != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, script.String())
+		}
+	}
+}
+
+func TestMinify(t *testing.T) {
+	type test struct {
+		script string
+		local  bool
+		check  string
+	}
+
+	tests := []test{
+		test{
+			script: "function add(first, second) {\n\tlet total = first + second\n\treturn total\n}",
+			check:  `function add(a,b){let c=a+b;return c};`,
+		},
+		test{
+			script: "var timeout = 60 * 60 * 1000\nconst name = 'a' + 'b'\nlet mask = 1 << 4 | 1",
+			check:  `var timeout=3600000;const name='ab';let mask=17;`,
+		},
+		test{
+			script: "function check(value) {\n\tif (value) {\n\t\treturn 1\n\t\tconsole.log('never')\n\t}\n\treturn 2\n\tconsole.log('never')\n}",
+			check:  `function check(a){if(a){return 1;};return 2;};`,
+		},
+		test{
+			script: "function point(x, y) {\n\tconst { length } = x\n\treturn { x, y, length }\n}",
+			check:  `function point(a,b){const{length:c}=a;return{x:a,y:b,length:c}};`,
+		},
+		test{
+			script: "function run(code) {\n\tlet local = 1\n\treturn eval(code)\n}",
+			check:  `function run(code){let local=1;return eval(code)};`,
+		},
+		test{
+			script: "const list = [1, 2].map(item => item * 2)\nfor (let index = 0; index < list.length; index++) {\n\ttry {\n\t\tlist[index]()\n\t} catch (error) {\n\t\tconsole.log(error.message)\n\t}\n}",
+			check:  `const list=[1,2].map(a=>a*2);for(let a=0;a<list.length;a++){try{list[a]()}catch(b){console.log(b.message)}};`,
+		},
+		test{
+			script: "function outer(a) {\n\tfunction inner(b) {\n\t\treturn a + b + `${a}`\n\t}\n\treturn inner\n}",
+			check:  "function outer(a){function c(d){return a+d+`${a}`};return c};",
+		},
+		test{
+			script: "class Counter {\n\tcount = 0\n\tadd(amount) {\n\t\tconst next = this.count + amount\n\t\tthis.count = next\n\t}\n}",
+			check:  `class Counter{count=0;add(a){const b=this.count+a;this.count=b}};`,
+		},
+		test{
+			script: "switch (x) {\ncase 1:\n\tfoo()\n\tbreak\n\tbar()\ncase 2:\n\tbaz()\n}\nlet y = 2 - -1, z = x - 1 + 2, w = '1' + 2",
+			check:  `switch(x){case 1:foo();break;case 2:baz()};let y=2- -1,z=x-1+2,w='1'+2;`,
+		},
+		test{
+			script: "let item = document.getElementById($params.id)\nfunction show() {\n\titem.hidden = false\n}\n$root.onclick = show",
+			local:  true,
+			check:  "let a=document.getElementById($params.id);function b(){a.hidden=false};$root.onclick=b;",
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		script.Minify(run.local)
+		if script.String() != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, script.String())
+		}
+	}
+}
+
+func TestDownlevel(t *testing.T) {
+	type test struct {
+		script   string
+		features Feature
+		check    string
+		err      bool
+	}
+
+	tests := []test{
+		test{
+			script:   "const add = (a, b) => a + b",
+			features: Arrows,
+			check:    `const add=function(a,b){return a+b};`,
+		},
+		test{
+			script:   "const o = { v: 1, run: function () { return [1].map(() => this.v) } }",
+			features: Arrows,
+			check:    `const o={v:1,run:function(){return[1].map((function(){return this.v}).bind(this))}};`,
+		},
+		test{
+			script:   "const o = { get v() { return 1 }, set v(x) {}, get: function () {} }",
+			features: Arrows,
+			check:    `const o={get v(){return 1},set v(x){},get:function(){}};`,
+		},
+		test{
+			script:   "let o = {a, b}",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "let o = { m() {} }",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "let f = ({a}) => a",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "let [a, b] = pair",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "let f = (a = 1) => a",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "for (const item of list) {}",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "class A {}",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "let f = async () => {}",
+			features: Arrows,
+			err:      true,
+		},
+		test{
+			script:   "let total = `sum ${a + b} of ${count}`",
+			features: Templates,
+			check:    `let total=("sum "+(a+b)+" of "+count);`,
+		},
+		test{
+			script:   "let first = user?.name?.first ?? 'none'",
+			features: OptionalChaining,
+			check:    `var kissTemp0,kissTemp1;let first=((kissTemp1=(user==null?void 0:((kissTemp0=user.name)==null?void 0:kissTemp0.first)))!=null?kissTemp1:'none');`,
+		},
+		test{
+			script:   "let gone = delete cache?.items[key]",
+			features: OptionalChaining,
+			check:    `let gone=(cache==null||delete cache.items[key]);`,
+		},
+		test{
+			script:   "user?.name = 'k'",
+			features: OptionalChaining,
+			err:      true,
+		},
+		test{
+			script:   "function max(...values) { return Math.max(...values) }\nlet all = [...one, 2]",
+			features: Spread,
+			check:    `var kissSpread=kissSpread||function(value){if(Array.isArray(value)){return value}if(typeof Symbol!=="undefined"&&value[Symbol.iterator]){var ret=[];for(var it=value[Symbol.iterator](),step;!(step=it.next()).done;){ret.push(step.value)}return ret}return Array.prototype.slice.call(value)};function max(){var values=[].slice.call(arguments,0);return Math.max.apply(Math,[].concat(kissSpread(values)))};let all=[].concat(kissSpread(one),[2]);`,
+		},
+		test{
+			script:   "let z = 1\nif (z) { let z = 2; console.log(z) }\nconsole.log(z)",
+			features: BlockScope,
+			check:    `var z=1;if(z){var z$0=2;console.log(z$0)};console.log(z);`,
+		},
+		test{
+			script:   "const fns = []\nfor (let i = 0; i < 3; i++) { if (i == 2) break; fns.push(() => i) }",
+			features: Arrows | BlockScope,
+			check:    `var fns=[];for(var i$0=0;i$0<3;i$0++){var kissLoop0=(function(i){{if(i==2)return false;fns.push(function(){return i})}}).call(this,i$0);if(kissLoop0===false)break;};`,
+		},
+		test{
+			script:   "outer: for (let i = 0; i < 3; i++) { for (;;) { fns.push(() => i); break outer } }",
+			features: Arrows | BlockScope,
+			err:      true,
+		},
+		test{
+			script:   "for (let i = 0; i < 3; i++) { fns.push(() => i); i++ }",
+			features: Arrows | BlockScope,
+			err:      true,
+		},
+		test{
+			script: "let name = `a`",
+			check:  "let name=`a`;",
+		},
+	}
+
+	for i, run := range tests {
+		script, err := ParseTokens(LexScript(run.script))
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the js script %s", i, err)
+			continue
+		}
+		err = script.Downlevel(run.features)
+		if run.err {
+			if err == nil {
+				t.Errorf("(%d) Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(%d) there was an error downleveling the script %s", i, err)
+			continue
+		}
+		if script.String() != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, script.String())
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	type test struct {
+		browser string
+		version float64
+		check   Feature
+	}
+
+	tests := []test{
+		test{browser: "chrome", version: 120},
+		test{browser: "safari", version: 8, check: Arrows | BlockScope | Templates | OptionalChaining | Spread},
+		test{browser: "chrome", version: 60, check: OptionalChaining},
+	}
+
+	for i, run := range tests {
+		if got := Unsupported(run.browser, run.version); got != run.check {
+			t.Errorf("(%d) Expected %d, got %d", i, run.check, got)
+		}
+	}
+}
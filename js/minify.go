@@ -0,0 +1,991 @@
+package js
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the kinds of brackets, an object bracket is also used for destructuring patterns
+const (
+	parenBracket = iota
+	controlBracket
+	paramsBracket
+	blockBracket
+	bodyBracket
+	objectBracket
+	classBracket
+)
+
+// mangleReserved are the names that are never given to a renamed variable on top of the reserved words
+var mangleReserved = []string{
+	"arguments", "eval", "undefined", "NaN", "Infinity", "enum", "implements", "interface",
+	"package", "private", "protected", "public", "static", "of", "get", "set", "async",
+}
+
+var wordPattern = regexp.MustCompile(`[_$a-zA-Z][_$a-zA-Z0-9]*`)
+var decimalPattern = regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// Minify shortens a script, expressions of literals are folded into one literal, statements after
+// a return, throw, break or continue that can never run are removed and the names declared in
+// functions and blocks are renamed to short names, the names declared at the top level are kept
+// since other scripts can use them unless local is set for a script that runs inside a function
+func (script *Script) Minify(local bool) {
+	tokens := strip(script.tokens())
+	tokens = foldConstants(tokens)
+	tokens = removeDeadCode(tokens)
+	tokens = mangle(tokens, local)
+	script.Lines = compact(tokens)
+}
+
+// strip drops the spaces and line breaks between tokens
+func strip(tokens []Token) []Token {
+	ret := []Token{}
+	for _, tok := range tokens {
+		if tok.Type != whiteSpace && tok.Type != newLine {
+			ret = append(ret, tok)
+		}
+	}
+	return ret
+}
+
+// compact joins tokens into a single line with a space only where two tokens would merge
+func compact(tokens []Token) []Line {
+	line := Line{}
+	for _, tok := range tokens {
+		if len(line.Value) > 0 && needSpace(line.last().Value, tok.Value) {
+			line.Value = append(line.Value, Token{whiteSpace, " "})
+		}
+		line.Value = append(line.Value, tok)
+	}
+	if len(line.Value) == 0 {
+		return nil
+	}
+	return []Line{line}
+}
+
+// analysis records how the brackets of a script without spaces or line breaks nest, match is the
+// index of the matching bracket, kind is the kind of an open bracket and parent is the bracket a
+// token is in, statement marks the colons that end a label or a case
+type analysis struct {
+	tokens    []Token
+	match     []int
+	kind      []int
+	parent    []int
+	statement []bool
+}
+
+func analyze(tokens []Token) *analysis {
+	a := &analysis{
+		tokens:    tokens,
+		match:     make([]int, len(tokens)),
+		kind:      make([]int, len(tokens)),
+		parent:    make([]int, len(tokens)),
+		statement: make([]bool, len(tokens)),
+	}
+	stack := []int{}
+	ternary := map[int]int{}
+	class := map[int]bool{}
+	for i, tok := range tokens {
+		a.match[i] = -1
+		a.parent[i] = -1
+		if len(stack) > 0 {
+			a.parent[i] = stack[len(stack)-1]
+		}
+		if tok.Type != punctuator && tok.Type != keyword {
+			continue
+		}
+		prev := a.at(i - 1)
+
+		switch tok.Value {
+		case "class":
+			// class can also be a property name
+			switch a.at(i + 1).Value {
+			case ":", "(", ",", "}", "=":
+			default:
+				class[len(stack)] = prev.Value != "." && prev.Value != "?."
+			}
+		case "?":
+			ternary[len(stack)]++
+		case ":":
+			if ternary[len(stack)] > 0 {
+				ternary[len(stack)]--
+			} else {
+				a.statement[i] = a.blockLike(a.parent[i])
+			}
+		case "(", "[":
+			a.kind[i] = parenBracket
+			if tok.Value == "(" && ((prev.Type == keyword && isControl(prev.Value)) || (prev.Value == "await" && a.at(i-2).Value == "for")) {
+				a.kind[i] = controlBracket
+			}
+			stack = append(stack, i)
+		case "{":
+			switch {
+			case class[len(stack)]:
+				a.kind[i] = classBracket
+				class[len(stack)] = false
+			case prev.Value == "=>":
+				a.kind[i] = bodyBracket
+			case prev.Value == ")" && a.kind[a.match[i-1]] == paramsBracket:
+				a.kind[i] = bodyBracket
+			case a.statementStart(i):
+				a.kind[i] = blockBracket
+			default:
+				a.kind[i] = objectBracket
+			}
+			stack = append(stack, i)
+		case ")", "]", "}":
+			if len(stack) == 0 {
+				continue
+			}
+			open := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			a.match[open], a.match[i] = i, open
+			a.parent[i] = -1
+			if len(stack) > 0 {
+				a.parent[i] = stack[len(stack)-1]
+			}
+			ternary[len(stack)+1] = 0
+
+			next := a.at(i + 1).Value
+			if tok.Value == ")" && a.kind[open] == parenBracket && !class[len(stack)] && (next == "{" || next == "=>") {
+				a.kind[open] = paramsBracket
+			}
+		}
+	}
+	return a
+}
+
+// at returns the token at i or an empty token if i is outside the script
+func (a *analysis) at(i int) Token {
+	if i < 0 || i >= len(a.tokens) {
+		return Token{}
+	}
+	return a.tokens[i]
+}
+
+// blockLike checks if the bracket holds statements, -1 is the top level of the script
+func (a *analysis) blockLike(open int) bool {
+	return open < 0 || a.kind[open] == blockBracket || a.kind[open] == bodyBracket
+}
+
+// statementStart checks if the token at i starts a statement
+func (a *analysis) statementStart(i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := a.tokens[i-1]
+	switch prev.Value {
+	case ";", "}", "else", "do", "try", "catch", "finally", ")":
+		return prev.Type == punctuator || prev.Type == keyword
+	case "{":
+		return a.kind[i-1] == blockBracket || a.kind[i-1] == bodyBracket
+	case ":":
+		return a.statement[i-1]
+	}
+	return false
+}
+
+func isControl(word string) bool {
+	switch word {
+	case "if", "for", "while", "switch", "catch", "with":
+		return true
+	}
+	return false
+}
+
+// exprEnd returns the last token of the expression starting at i, it ends at a comma, semicolon or
+// a bracket that closes outside of it
+func (a *analysis) exprEnd(i int) int {
+	depth := 0
+	for j := i; j < len(a.tokens); j++ {
+		switch a.tokens[j].Value {
+		case "(", "[", "{":
+			if a.tokens[j].Type == punctuator {
+				depth++
+			}
+		case ")", "]", "}":
+			if a.tokens[j].Type != punctuator {
+				continue
+			}
+			if depth == 0 {
+				return j - 1
+			}
+			depth--
+		case ",", ";":
+			if depth == 0 && a.tokens[j].Type == punctuator {
+				return j - 1
+			}
+		}
+	}
+	return len(a.tokens) - 1
+}
+
+// statementEnd returns the last token of the statement starting at i
+func (a *analysis) statementEnd(i int) int {
+	if i >= len(a.tokens) {
+		return len(a.tokens) - 1
+	}
+	tok := a.tokens[i]
+	closing := func(j int) int {
+		if j < len(a.tokens) && a.match[j] > j {
+			return a.match[j]
+		}
+		return len(a.tokens) - 1
+	}
+
+	switch {
+	case tok.Value == "{" && tok.Type == punctuator:
+		return closing(i)
+	case tok.Value == "if" && tok.Type == keyword:
+		end := a.statementEnd(closing(i+1) + 1)
+		if a.at(end+1).Value == "else" {
+			end = a.statementEnd(end + 2)
+		}
+		return end
+	case (tok.Value == "for" || tok.Value == "while" || tok.Value == "with") && tok.Type == keyword:
+		j := i + 1
+		if a.at(j).Value == "await" {
+			j++
+		}
+		return a.statementEnd(closing(j) + 1)
+	case tok.Value == "do" && tok.Type == keyword:
+		end := closing(a.statementEnd(i+1) + 2)
+		if a.at(end+1).Value == ";" {
+			end++
+		}
+		return end
+	case tok.Value == "try" && tok.Type == keyword:
+		end := closing(i + 1)
+		for {
+			switch a.at(end + 1).Value {
+			case "catch":
+				if a.at(end+2).Value == "(" {
+					end = closing(closing(end+2) + 1)
+				} else {
+					end = closing(end + 2)
+				}
+				continue
+			case "finally":
+				end = closing(end + 2)
+				continue
+			}
+			return end
+		}
+	case (tok.Value == "function" || tok.Value == "class") && tok.Type == keyword,
+		tok.Value == "async" && a.at(i+1).Value == "function":
+		for j := i; j < len(a.tokens); j++ {
+			switch a.tokens[j].Value {
+			case "(", "[":
+				j = closing(j)
+			case "{":
+				return closing(j)
+			}
+		}
+		return len(a.tokens) - 1
+	case tok.Type == identifier && a.at(i+1).Value == ":" && a.statement[i+1]:
+		return a.statementEnd(i + 2)
+	}
+
+	depth := 0
+	for j := i; j < len(a.tokens); j++ {
+		if a.tokens[j].Type != punctuator {
+			continue
+		}
+		switch a.tokens[j].Value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			if depth == 0 {
+				return j - 1
+			}
+			depth--
+		case ";":
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(a.tokens) - 1
+}
+
+// precedence is the binding power of binary operators, zero is anything else
+func precedence(tok Token) int {
+	if tok.Type != punctuator && tok.Type != keyword {
+		return 0
+	}
+	switch tok.Value {
+	case "**":
+		return 13
+	case "*", "/", "%":
+		return 12
+	case "+", "-":
+		return 11
+	case "<<", ">>", ">>>":
+		return 10
+	case "<", ">", "<=", ">=", "in", "instanceof":
+		return 9
+	case "==", "!=", "===", "!==":
+		return 8
+	case "&":
+		return 7
+	case "^":
+		return 6
+	case "|":
+		return 5
+	case "&&":
+		return 4
+	case "||", "??":
+		return 3
+	}
+	return 0
+}
+
+// foldConstants replaces arithmetic on two number literals and the joining of two string literals
+// with the result, the tokens around the operation have to bind less tightly than it does
+func foldConstants(tokens []Token) []Token {
+	for folded := true; folded; {
+		folded = false
+		for i := 1; i+1 < len(tokens); i++ {
+			op := tokens[i]
+			prec := precedence(op)
+			if op.Type != punctuator || prec < 5 || prec > 12 || prec == 8 || prec == 9 {
+				continue
+			}
+
+			var prev, next Token
+			if i >= 2 {
+				prev = tokens[i-2]
+			}
+			if i+2 < len(tokens) {
+				next = tokens[i+2]
+			}
+			if !foldBefore(prev, prec) || !foldAfter(next, prec) {
+				continue
+			}
+
+			result := fold(tokens[i-1], op, tokens[i+1])
+			if result == nil {
+				continue
+			}
+			tokens = append(tokens[:i-1], append(result, tokens[i+2:]...)...)
+			folded = true
+		}
+	}
+	return tokens
+}
+
+// foldBefore checks if the token before a folded operation can't take its left operand
+func foldBefore(prev Token, prec int) bool {
+	if prev.Value == "" {
+		return true
+	}
+	if p := precedence(prev); p > 0 {
+		return p < prec
+	}
+	switch prev.Value {
+	case "(", "[", "{", ",", ";", "?", ":", "=>", "=", "+=", "-=", "*=", "/=", "%=", "**=", "<<=",
+		">>=", ">>>=", "&=", "|=", "^=", "&&=", "||=", "??=":
+		return prev.Type == punctuator
+	case "return", "case", "throw":
+		return prev.Type == keyword
+	}
+	return false
+}
+
+// foldAfter checks if the token after a folded operation can't take its right operand
+func foldAfter(next Token, prec int) bool {
+	if next.Value == "" {
+		return true
+	}
+	if p := precedence(next); p > 0 {
+		return p <= prec && next.Value != "**"
+	}
+	switch next.Value {
+	case ")", "]", "}", ",", ";", "?", ":":
+		return next.Type == punctuator
+	}
+	return false
+}
+
+// fold returns the tokens for the result of an operation on two literals or nil if it can't be
+// folded or the result would be longer
+func fold(left, op, right Token) []Token {
+	if left.Type == value && right.Type == value && op.Value == "+" {
+		if left.Value[0] != right.Value[0] {
+			return nil
+		}
+		return []Token{Token{value, left.Value[:len(left.Value)-1] + right.Value[1:]}}
+	}
+	if left.Type != number || right.Type != number {
+		return nil
+	}
+
+	a, ok := parseNumber(left.Value)
+	if !ok {
+		return nil
+	}
+	b, ok := parseNumber(right.Value)
+	if !ok {
+		return nil
+	}
+
+	var result float64
+	switch op.Value {
+	case "+":
+		result = a + b
+	case "-":
+		result = a - b
+	case "*":
+		result = a * b
+	case "/":
+		if b == 0 {
+			return nil
+		}
+		result = a / b
+	case "%":
+		if b == 0 {
+			return nil
+		}
+		result = math.Mod(a, b)
+	default:
+		// the bitwise operators only fold integers that fit in 32 bits
+		if a != math.Trunc(a) || b != math.Trunc(b) || math.Abs(a) > math.MaxInt32 || math.Abs(b) > math.MaxInt32 {
+			return nil
+		}
+		x, y := int32(a), int32(b)
+		switch op.Value {
+		case "<<":
+			result = float64(x << (uint32(y) & 31))
+		case ">>":
+			result = float64(x >> (uint32(y) & 31))
+		case ">>>":
+			result = float64(uint32(x) >> (uint32(y) & 31))
+		case "&":
+			result = float64(x & y)
+		case "|":
+			result = float64(x | y)
+		case "^":
+			result = float64(x ^ y)
+		default:
+			return nil
+		}
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) || (result == 0 && math.Signbit(result)) {
+		return nil
+	}
+
+	text := strconv.FormatFloat(math.Abs(result), 'f', -1, 64)
+	if short := strconv.FormatFloat(math.Abs(result), 'g', -1, 64); len(short) < len(text) {
+		text = short
+	}
+	ret := []Token{Token{number, text}}
+	if result < 0 {
+		ret = []Token{Token{punctuator, "-"}, Token{number, text}}
+		text = "-" + text
+	}
+	if len(text) > len(left.Value)+len(op.Value)+len(right.Value) {
+		return nil
+	}
+	return ret
+}
+
+// parseNumber parses decimal and hex number literals
+func parseNumber(val string) (float64, bool) {
+	if strings.HasPrefix(val, "0x") || strings.HasPrefix(val, "0X") {
+		n, err := strconv.ParseUint(val[2:], 16, 53)
+		return float64(n), err == nil
+	}
+	// a leading zero is an octal literal in sloppy mode
+	if !decimalPattern.MatchString(val) || (len(val) > 1 && val[0] == '0' && val[1] != '.') {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(val, 64)
+	return n, err == nil
+}
+
+// removeDeadCode removes the statements in a block after one that always leaves it, statements
+// that declare functions or vars are kept since they are hoisted
+func removeDeadCode(tokens []Token) []Token {
+	for removed := true; removed; {
+		removed = false
+		a := analyze(tokens)
+		for i, tok := range tokens {
+			if tok.Type != keyword || a.parent[i] < 0 || !a.blockLike(a.parent[i]) {
+				continue
+			}
+			switch tok.Value {
+			case "return", "throw", "break", "continue":
+			default:
+				continue
+			}
+			// only a statement directly in the block leaves it, not the body of an if or loop
+			if prev := a.at(i - 1); prev.Value != ";" && prev.Value != "}" && i-1 != a.parent[i] {
+				continue
+			}
+
+			start := a.statementEnd(i) + 1
+			end := start
+			for ; end < a.match[a.parent[i]]; end++ {
+				if a.parent[end] == a.parent[i] && tokens[end].Type == keyword && (tokens[end].Value == "case" || tokens[end].Value == "default") {
+					break
+				}
+			}
+			if end <= start {
+				continue
+			}
+			hoisted := false
+			for _, dead := range tokens[start:end] {
+				if dead.Type == keyword && (dead.Value == "function" || dead.Value == "var") {
+					hoisted = true
+				}
+			}
+			if hoisted {
+				continue
+			}
+
+			tokens = append(tokens[:start], tokens[end:]...)
+			removed = true
+			break
+		}
+	}
+	return tokens
+}
+
+// scope is a function or block that names are declared in, renamed maps the declared names to
+// their new names
+type scope struct {
+	parent   *scope
+	start    int
+	end      int
+	function bool
+	names    []string
+	renamed  map[string]string
+}
+
+func (s *scope) declare(name string) {
+	for _, check := range s.names {
+		if check == name {
+			return
+		}
+	}
+	s.names = append(s.names, name)
+}
+
+func (s *scope) declares(name string) bool {
+	for _, check := range s.names {
+		if check == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mangle renames the names declared in functions and blocks, names are resolved to the innermost
+// scope that declares them and a new name is never one that is already used in the script or by
+// an enclosing scope, the top level is only renamed when local is set, nothing is renamed if the
+// script uses eval or with
+func mangle(tokens []Token, local bool) []Token {
+	avoid := map[string]bool{}
+	for _, word := range append(reserved, mangleReserved...) {
+		avoid[word] = true
+	}
+	// substitutions aren't split into tokens so the names used in them are left alone
+	opaque := map[string]bool{}
+	for _, tok := range tokens {
+		switch tok.Type {
+		case identifier, keyword, template:
+			avoid[tok.Value] = true
+		case templateLiteral:
+			for _, word := range wordPattern.FindAllString(tok.Value, -1) {
+				avoid[word] = true
+				opaque[word] = true
+			}
+		}
+		if (tok.Type == identifier && tok.Value == "eval") || (tok.Type == keyword && tok.Value == "with") {
+			return tokens
+		}
+	}
+
+	a := analyze(tokens)
+	root := &scope{start: 0, end: len(tokens) - 1, function: true}
+	scopes := a.scopes(root)
+	at := make([]*scope, len(tokens))
+	for _, s := range scopes {
+		for i := s.start; i <= s.end && i < len(tokens); i++ {
+			at[i] = s
+		}
+	}
+	a.declarations(scopes, at)
+
+	// names are given out from the outside in so a scope knows the names its parents use
+	for _, s := range scopes {
+		s.renamed = map[string]string{}
+		if s == root && !local {
+			continue
+		}
+		used := map[string]bool{}
+		for p := s.parent; p != nil; p = p.parent {
+			for _, name := range p.renamed {
+				used[name] = true
+			}
+		}
+		next := 0
+		for _, name := range s.names {
+			if opaque[name] {
+				continue
+			}
+			var short string
+			for {
+				short = shortName(next)
+				next++
+				if !avoid[short] && !used[short] {
+					break
+				}
+			}
+			s.renamed[name] = short
+		}
+	}
+
+	ret := make([]Token, 0, len(tokens))
+	for i, tok := range tokens {
+		if tok.Type != identifier || strings.HasPrefix(tok.Value, "#") || !a.reference(i) {
+			ret = append(ret, tok)
+			continue
+		}
+		short := ""
+		for s := at[i]; s != nil; s = s.parent {
+			if s.declares(tok.Value) {
+				short = s.renamed[tok.Value]
+				break
+			}
+		}
+		switch {
+		case short == "":
+			ret = append(ret, tok)
+		case a.key(i):
+			ret = append(ret, tok, Token{punctuator, ":"}, Token{identifier, short})
+		default:
+			ret = append(ret, Token{identifier, short})
+		}
+	}
+	return ret
+}
+
+// shortName returns the nth short name
+func shortName(n int) string {
+	first := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_$"
+	rest := first + "0123456789"
+	name := string(first[n%len(first)])
+	for n /= len(first); n > 0; n /= len(rest) {
+		n--
+		name += string(rest[n%len(rest)])
+	}
+	return name
+}
+
+// scopes finds the functions, blocks, for statements, catch clauses and named class expressions of
+// a script, they are returned from the outside in with their parents set
+func (a *analysis) scopes(root *scope) []*scope {
+	found := []*scope{}
+	add := func(start, end int, function bool) *scope {
+		s := &scope{start: start, end: end, function: function}
+		found = append(found, s)
+		return s
+	}
+
+	for i, tok := range a.tokens {
+		switch {
+		case tok.Value == "(" && a.kind[i] == paramsBracket:
+			close := a.match[i]
+			start := i
+			// a function expression's own name is only visible inside of it
+			if name := a.at(i - 1); name.Type == identifier && a.functionName(i-1) && !a.declaration(i-1) {
+				start = i - 1
+			}
+			add(start, a.arrowEnd(close), true)
+		case tok.Type == identifier && a.at(i+1).Value == "=>" && a.at(i-1).Value != "." && a.at(i-1).Value != "?.":
+			add(i, a.arrowEnd(i), true)
+		case tok.Value == "{" && a.kind[i] == blockBracket && !(a.at(i-1).Value == ")" && a.at(a.match[i-1]-1).Value == "catch"):
+			add(i, a.match[i], false)
+		case tok.Value == "for" && tok.Type == keyword:
+			open := i + 1
+			if a.at(open).Value == "await" {
+				open++
+			}
+			add(open, a.statementEnd(i), false)
+		case tok.Value == "catch" && tok.Type == keyword:
+			open := i + 1
+			if a.at(open).Value == "(" {
+				add(open, a.statementEnd(a.match[open]+1), false)
+			}
+		case tok.Value == "class" && tok.Type == keyword && a.at(i+1).Type == identifier && !a.declaration(i):
+			for j := i + 1; j < len(a.tokens); j++ {
+				if a.tokens[j].Value == "{" && a.kind[j] == classBracket {
+					add(i+1, a.match[j], false)
+					break
+				}
+			}
+		}
+	}
+
+	// outer scopes start first and end last
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].start < found[j].start || (found[i].start == found[j].start && found[i].end > found[j].end)
+	})
+	ordered := []*scope{root}
+	for _, s := range found {
+		for p := len(ordered) - 1; p >= 0; p-- {
+			if ordered[p].start <= s.start && s.end <= ordered[p].end {
+				s.parent = ordered[p]
+				break
+			}
+		}
+		ordered = append(ordered, s)
+	}
+	return ordered
+}
+
+// arrowEnd returns the end of a function whose parameters end at i
+func (a *analysis) arrowEnd(i int) int {
+	switch {
+	case a.at(i+1).Value == "{":
+		return a.match[i+1]
+	case a.at(i+1).Value == "=>" && a.at(i+2).Value == "{" && a.kind[i+2] == bodyBracket:
+		return a.match[i+2]
+	case a.at(i+1).Value == "=>":
+		return a.exprEnd(i + 2)
+	}
+	return i
+}
+
+// functionName checks if the token at i names a function
+func (a *analysis) functionName(i int) bool {
+	prev := a.at(i - 1)
+	if prev.Value == "*" {
+		prev = a.at(i - 2)
+	}
+	return prev.Type == keyword && prev.Value == "function"
+}
+
+// declaration checks if the function or class that the token at i belongs to is a declaration
+// rather than an expression
+func (a *analysis) declaration(i int) bool {
+	for j := i; j >= 0 && j >= i-3; j-- {
+		if a.tokens[j].Type == keyword && (a.tokens[j].Value == "function" || a.tokens[j].Value == "class") {
+			if a.at(j-1).Value == "async" {
+				j--
+			}
+			return a.statementStart(j)
+		}
+	}
+	return false
+}
+
+// declarations records the names declared in each scope
+func (a *analysis) declarations(scopes []*scope, at []*scope) {
+	function := func(s *scope) *scope {
+		for s.parent != nil && !s.function {
+			s = s.parent
+		}
+		return s
+	}
+	owner := func(i int) *scope {
+		for _, s := range scopes {
+			if s.start == i && s.function {
+				return s
+			}
+		}
+		return nil
+	}
+
+	for i, tok := range a.tokens {
+		switch {
+		case tok.Value == "(" && a.kind[i] == paramsBracket:
+			s := at[i]
+			for j := i + 1; j < a.match[i]; {
+				if a.tokens[j].Value == "..." {
+					j++
+				}
+				names, next := a.pattern(j)
+				for _, name := range names {
+					s.declare(name)
+				}
+				j = next
+				if a.at(j).Value == "=" {
+					j = a.exprEnd(j+1) + 1
+				}
+				if a.at(j).Value != "," {
+					break
+				}
+				j++
+			}
+		case tok.Type == identifier && a.at(i+1).Value == "=>" && at[i].start == i:
+			at[i].declare(tok.Value)
+		case tok.Type == keyword && (tok.Value == "var" || tok.Value == "let" || tok.Value == "const"):
+			s := at[i]
+			if tok.Value == "var" {
+				s = function(s)
+			}
+			for j := i + 1; j < len(a.tokens); {
+				names, next := a.pattern(j)
+				for _, name := range names {
+					s.declare(name)
+				}
+				j = next
+				if a.at(j).Value == "=" {
+					j = a.exprEnd(j+1) + 1
+				}
+				if a.at(j).Value != "," {
+					break
+				}
+				j++
+			}
+		case tok.Type == keyword && (tok.Value == "function" || tok.Value == "class"):
+			j := i + 1
+			if a.at(j).Value == "*" {
+				j++
+			}
+			name := a.at(j)
+			if name.Type != identifier || name.Value == "extends" {
+				continue
+			}
+			switch {
+			case a.declaration(j) && tok.Value == "function":
+				function(at[i]).declare(name.Value)
+			case a.declaration(j):
+				at[i].declare(name.Value)
+			case tok.Value == "function" && owner(j) != nil:
+				owner(j).declare(name.Value)
+			case tok.Value == "class" && at[j].start == j:
+				at[j].declare(name.Value)
+			}
+		case tok.Type == keyword && tok.Value == "catch" && a.at(i+1).Value == "(":
+			names, _ := a.pattern(i + 2)
+			for _, name := range names {
+				at[i+1].declare(name)
+			}
+		}
+	}
+}
+
+// pattern returns the names declared by a name or destructuring pattern at i and the index after it
+func (a *analysis) pattern(i int) ([]string, int) {
+	tok := a.at(i)
+	switch {
+	case tok.Type == identifier:
+		return []string{tok.Value}, i + 1
+	case tok.Value == "{" && a.match[i] > i:
+		names := []string{}
+		for j := i + 1; j < a.match[i]; {
+			start := j
+			switch {
+			case a.tokens[j].Value == "...":
+				sub, next := a.pattern(j + 1)
+				names, j = append(names, sub...), next
+			case a.tokens[j].Value == "[" && a.match[j] > j:
+				j = a.match[j] + 1
+				if a.at(j).Value == ":" {
+					sub, next := a.pattern(j + 1)
+					names, j = append(names, sub...), next
+				}
+			case a.at(j+1).Value == ":":
+				sub, next := a.pattern(j + 2)
+				names, j = append(names, sub...), next
+			default:
+				if a.tokens[j].Type == identifier {
+					names = append(names, a.tokens[j].Value)
+				}
+				j++
+			}
+			if a.at(j).Value == "=" {
+				j = a.exprEnd(j+1) + 1
+			}
+			if a.at(j).Value == "," {
+				j++
+			}
+			if j <= start {
+				j = start + 1
+			}
+		}
+		return names, a.match[i] + 1
+	case tok.Value == "[" && a.match[i] > i:
+		names := []string{}
+		for j := i + 1; j < a.match[i]; {
+			start := j
+			if a.tokens[j].Value == "..." {
+				j++
+			}
+			if a.tokens[j].Value != "," {
+				sub, next := a.pattern(j)
+				names, j = append(names, sub...), next
+			}
+			if a.at(j).Value == "=" {
+				j = a.exprEnd(j+1) + 1
+			}
+			if a.at(j).Value == "," {
+				j++
+			}
+			if j <= start {
+				j = start + 1
+			}
+		}
+		return names, a.match[i] + 1
+	}
+	return nil, i + 1
+}
+
+// keyPosition checks if the token at i is where an object or class member name goes
+func (a *analysis) keyPosition(i int) bool {
+	open := a.parent[i]
+	if open < 0 || (a.kind[open] != objectBracket && a.kind[open] != classBracket) {
+		return false
+	}
+	if i-1 == open {
+		return true
+	}
+	prev := a.tokens[i-1]
+	if a.parent[i-1] != open {
+		return false
+	}
+	switch prev.Value {
+	case ",":
+		return a.kind[open] == objectBracket
+	case ";", "}":
+		return a.kind[open] == classBracket
+	case "*", "get", "set", "async", "static":
+		return a.keyPosition(i - 1)
+	}
+	return false
+}
+
+// key checks if an identifier is a shorthand property, it is both the key and the value
+func (a *analysis) key(i int) bool {
+	if !a.keyPosition(i) || a.kind[a.parent[i]] != objectBracket {
+		return false
+	}
+	switch a.at(i + 1).Value {
+	case ",", "}", "=":
+		return true
+	}
+	return false
+}
+
+// reference checks if an identifier refers to a variable rather than naming a property, member
+// or label
+func (a *analysis) reference(i int) bool {
+	prev, next := a.at(i-1), a.at(i+1)
+	switch {
+	case prev.Value == "." || prev.Value == "?.":
+		return false
+	case prev.Type == keyword && (prev.Value == "break" || prev.Value == "continue"):
+		return false
+	case next.Value == ":" && a.statement[i+1] && prev.Value != "case" && a.statementStart(i):
+		return false
+	case a.keyPosition(i):
+		return a.key(i)
+	}
+	return true
+}
@@ -0,0 +1,386 @@
+package js
+
+import (
+	"fmt"
+)
+
+// ModuleImport is an es module import declaration, a declaration without any names only
+// imports the module for its side effects, a Lazy import is of a module that is not defined yet
+// when the script runs because the two import each other so its names are read when they are used
+type ModuleImport struct {
+	Src   string
+	Names []Binding
+	Lazy  bool
+}
+
+// Binding links a local name to an exported name, the exported name * is the whole module
+type Binding struct {
+	Local  string
+	Export string
+}
+
+// ModuleExport is a name exported by a module, From is set when the name is re-exported from
+// another module and an Export of * re-exports every name from it
+type ModuleExport struct {
+	Binding
+	From string
+}
+
+// DefaultName is the name given to an export default expression
+const DefaultName = "kissDefault"
+
+// cursor walks the tokens of a statement skipping spaces and line breaks
+type cursor struct {
+	tokens []Token
+	pos    int
+}
+
+func (c *cursor) next() Token {
+	for c.pos < len(c.tokens) {
+		tok := c.tokens[c.pos]
+		c.pos++
+		if tok.Type != whiteSpace && tok.Type != newLine {
+			return tok
+		}
+	}
+	return Token{}
+}
+
+func (c *cursor) peek() Token {
+	pos := c.pos
+	tok := c.next()
+	c.pos = pos
+	return tok
+}
+
+// skipSemiColon moves past the semicolon ending a statement if there is one
+func (c *cursor) skipSemiColon() {
+	if c.peek().Value == ";" {
+		c.next()
+	}
+}
+
+// extractModules removes the import and export declarations from the top level of a script and
+// records them on the script, exported declarations are kept without the export keyword
+func extractModules(tokens []Token, script *Script) ([]Token, error) {
+	ret := []Token{}
+	depth := 0
+	start := true
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.Type == whiteSpace || tok.Type == newLine {
+			ret = append(ret, tok)
+			continue
+		}
+
+		if depth == 0 && start && tok.Type == keyword && (tok.Value == "import" || tok.Value == "export") {
+			c := &cursor{tokens: tokens, pos: i + 1}
+			var keep []Token
+			var err error
+			if tok.Value == "import" {
+				// import() and import.meta are expressions
+				if next := c.peek().Value; next == "(" || next == "." {
+					ret = append(ret, tok)
+					start = false
+					continue
+				}
+				err = parseModuleImport(c, script)
+			} else {
+				keep, err = parseModuleExport(c, script)
+			}
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, keep...)
+			for c.pos < len(tokens) && tokens[c.pos].Type == whiteSpace {
+				c.pos++
+			}
+			i = c.pos - 1
+			start = len(keep) == 0
+			continue
+		}
+
+		switch tok.Value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		start = tok.Value == ";" || tok.Value == "}"
+		ret = append(ret, tok)
+	}
+	return ret, nil
+}
+
+// parseModuleImport parses the rest of an import declaration
+func parseModuleImport(c *cursor, script *Script) error {
+	imp := ModuleImport{}
+	tok := c.next()
+	if tok.Type != value {
+		if tok.Type == identifier {
+			imp.Names = append(imp.Names, Binding{Local: tok.Value, Export: "default"})
+			if c.peek().Value == "," {
+				c.next()
+				tok = c.next()
+			} else {
+				tok = Token{}
+			}
+		}
+		switch tok.Value {
+		case "*":
+			if c.next().Value != "as" {
+				return fmt.Errorf("expected as after import *")
+			}
+			name := c.next()
+			if name.Type != identifier {
+				return fmt.Errorf("expected a name after import * as")
+			}
+			imp.Names = append(imp.Names, Binding{Local: name.Value, Export: "*"})
+		case "{":
+			names, err := parseBindings(c)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				imp.Names = append(imp.Names, Binding{Local: name.Export, Export: name.Local})
+			}
+		case "":
+		default:
+			return fmt.Errorf("unexpected %s in import declaration", tok.Value)
+		}
+
+		if c.next().Value != "from" {
+			return fmt.Errorf("expected from in import declaration")
+		}
+		tok = c.next()
+	}
+
+	if tok.Type != value {
+		return fmt.Errorf("expected a module path in import declaration")
+	}
+	imp.Src = tok.Value[1 : len(tok.Value)-1]
+	c.skipSemiColon()
+	script.Modules = append(script.Modules, imp)
+	return nil
+}
+
+// parseModuleExport parses the rest of an export statement and returns the tokens of the
+// declaration it exports
+func parseModuleExport(c *cursor, script *Script) ([]Token, error) {
+	start := c.pos
+	tok := c.next()
+	switch {
+	case tok.Value == "*":
+		exp := ModuleExport{Binding: Binding{Export: "*"}}
+		if c.peek().Value == "as" {
+			c.next()
+			exp.Local = "*"
+			exp.Export = c.next().Value
+		}
+		if c.next().Value != "from" {
+			return nil, fmt.Errorf("expected from after export *")
+		}
+		src := c.next()
+		if src.Type != value {
+			return nil, fmt.Errorf("expected a module path after export * from")
+		}
+		exp.From = src.Value[1 : len(src.Value)-1]
+		c.skipSemiColon()
+		script.Exports = append(script.Exports, exp)
+		return nil, nil
+
+	case tok.Value == "{":
+		names, err := parseBindings(c)
+		if err != nil {
+			return nil, err
+		}
+		from := ""
+		if c.peek().Value == "from" {
+			c.next()
+			src := c.next()
+			if src.Type != value {
+				return nil, fmt.Errorf("expected a module path after export from")
+			}
+			from = src.Value[1 : len(src.Value)-1]
+		}
+		c.skipSemiColon()
+		for _, name := range names {
+			script.Exports = append(script.Exports, ModuleExport{Binding: name, From: from})
+		}
+		return nil, nil
+
+	case tok.Value == "default":
+		name := declarationName(c)
+		if name != "" {
+			script.Exports = append(script.Exports, ModuleExport{Binding: Binding{Local: name, Export: "default"}})
+			return nil, nil
+		}
+		script.Exports = append(script.Exports, ModuleExport{Binding: Binding{Local: DefaultName, Export: "default"}})
+		return []Token{Token{keyword, "var"}, Token{whiteSpace, " "}, Token{identifier, DefaultName}, Token{punctuator, "="}}, nil
+
+	case tok.Value == "var" || tok.Value == "let" || tok.Value == "const":
+		names, err := declaredNames(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			script.Exports = append(script.Exports, ModuleExport{Binding: Binding{Local: name, Export: name}})
+		}
+		c.pos = start
+		return nil, nil
+
+	default:
+		c.pos = start
+		name := declarationName(c)
+		if name == "" {
+			return nil, fmt.Errorf("unexpected %s in export declaration", tok.Value)
+		}
+		script.Exports = append(script.Exports, ModuleExport{Binding: Binding{Local: name, Export: name}})
+		c.pos = start
+		return nil, nil
+	}
+}
+
+// declarationName returns the name of a function or class declaration and leaves the cursor
+// where it started, an empty name means the tokens aren't a named declaration
+func declarationName(c *cursor) string {
+	start := c.pos
+	defer func() { c.pos = start }()
+
+	tok := c.next()
+	if tok.Value == "async" {
+		tok = c.next()
+	}
+	if tok.Value != "function" && tok.Value != "class" {
+		return ""
+	}
+	name := c.next()
+	if name.Value == "*" {
+		name = c.next()
+	}
+	if name.Type != identifier {
+		return ""
+	}
+	return name.Value
+}
+
+// declaredNames returns the names declared by a var, let or const statement
+func declaredNames(c *cursor) ([]string, error) {
+	names := []string{}
+	depth := 0
+	expectName := true
+	for c.pos < len(c.tokens) {
+		tok := c.next()
+		if depth == 0 && expectName {
+			if tok.Type != identifier {
+				return nil, fmt.Errorf("only simple names can be exported from a declaration, found %s", tok.Value)
+			}
+			names = append(names, tok.Value)
+			expectName = false
+			continue
+		}
+		switch tok.Value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		case ",":
+			expectName = depth == 0
+		case ";":
+			if depth == 0 {
+				return names, nil
+			}
+		}
+	}
+	return names, nil
+}
+
+// parseBindings parses a list of names in braces, Local is the name before as and Export the name after it
+func parseBindings(c *cursor) ([]Binding, error) {
+	ret := []Binding{}
+	for {
+		tok := c.next()
+		if tok.Value == "}" {
+			return ret, nil
+		}
+		if tok.Type != identifier && tok.Type != keyword && tok.Type != value {
+			return nil, fmt.Errorf("unexpected %s in module bindings", tok.Value)
+		}
+		name := tok.Value
+		if tok.Type == value {
+			name = name[1 : len(name)-1]
+		}
+		binding := Binding{Local: name, Export: name}
+		if c.peek().Value == "as" {
+			c.next()
+			alias := c.next()
+			binding.Export = alias.Value
+			if alias.Type == value {
+				binding.Export = alias.Value[1 : len(alias.Value)-1]
+			}
+		}
+		ret = append(ret, binding)
+
+		tok = c.next()
+		if tok.Value == "}" {
+			return ret, nil
+		}
+		if tok.Value != "," {
+			return nil, fmt.Errorf("expected , or } in module bindings, found %s", tok.Value)
+		}
+	}
+}
+
+// Link replaces the references to the names in refs with the expressions they map to, it is used
+// for the names of a Lazy import, a name declared inside the script shadows the import and is left
+func (script Script) Link(refs map[string]string) Script {
+	tokens := script.tokens()
+	// the analysis works on the tokens without spaces so pos maps them back to the script
+	stripped, pos := []Token{}, []int{}
+	for i, tok := range tokens {
+		if tok.Type != whiteSpace && tok.Type != newLine {
+			stripped = append(stripped, tok)
+			pos = append(pos, i)
+		}
+	}
+	a := analyze(stripped)
+	root := &scope{start: 0, end: len(stripped) - 1, function: true}
+	scopes := a.scopes(root)
+	at := make([]*scope, len(stripped))
+	for _, s := range scopes {
+		for i := s.start; i <= s.end && i < len(stripped); i++ {
+			at[i] = s
+		}
+	}
+	a.declarations(scopes, at)
+
+	linked := map[int][]Token{}
+	for i, tok := range stripped {
+		ref, ok := refs[tok.Value]
+		if tok.Type != identifier || !ok || !a.reference(i) {
+			continue
+		}
+		shadowed := false
+		for s := at[i]; s != nil && !shadowed; s = s.parent {
+			shadowed = s.declares(tok.Value)
+		}
+		if shadowed {
+			continue
+		}
+		linked[pos[i]] = LexScript(ref)
+		if a.key(i) {
+			linked[pos[i]] = append([]Token{tok, Token{punctuator, ":"}}, linked[pos[i]]...)
+		}
+	}
+
+	ret := []Token{}
+	for i, tok := range tokens {
+		if expr, ok := linked[i]; ok {
+			ret = append(ret, expr...)
+		} else {
+			ret = append(ret, tok)
+		}
+	}
+	script.Lines = splitLines(ret)
+	return script
+}
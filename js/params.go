@@ -0,0 +1,280 @@
+package js
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ParamsName is the object a component script reads its parameters from
+const ParamsName = "$params"
+
+var paramPattern = regexp.MustCompile(`\$[_a-zA-Z][_a-zA-Z0-9]*\$`)
+
+var namePattern = regexp.MustCompile(`^[_$a-zA-Z][_$a-zA-Z0-9]*$`)
+
+var numberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Substitute replaces the $param$ templates of a script with the text lookup returns for them, the
+// text is escaped for where the template is, in a string, template literal or regex it is taken
+// literally and anywhere else an expression is expected it becomes a Value, a template that is
+// part of a name or is a name being declared has to be replaced with a valid name
+func (script *Script) Substitute(lookup func(match string) (string, error)) error {
+	tokens := script.tokens()
+	for i := range tokens {
+		tok := &tokens[i]
+		if !paramPattern.MatchString(tok.Value) {
+			continue
+		}
+
+		prev, next := around(tokens, i)
+		name := tok.Type == identifier || (tok.Type == template && (prev.Value == "." || prev.Value == "?." || declares(prev)))
+		var err error
+		tok.Value = paramPattern.ReplaceAllStringFunc(tok.Value, func(match string) string {
+			val, lookupErr := lookup(match)
+			if lookupErr != nil {
+				err = lookupErr
+				return match
+			}
+			switch {
+			case tok.Type == value:
+				return Quote(val, tok.Value[0])
+			case tok.Type == templateLiteral:
+				return Quote(val, '`')
+			case tok.Type == regex:
+				val = strings.ReplaceAll(regexp.QuoteMeta(val), "/", "\\/")
+				return strings.ReplaceAll(strings.ReplaceAll(val, "\n", "\\n"), "\r", "\\r")
+			case tok.Type == template && !name:
+				return Member(Value(val), next.Value)
+			}
+			return val
+		})
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case name && !IsName(tok.Value):
+			return fmt.Errorf("can not use %q as a name", tok.Value)
+		case name:
+			tok.Type = identifier
+		case tok.Type == template:
+			tok.Type = value
+		}
+	}
+
+	script.Lines = splitLines(tokens)
+	return nil
+}
+
+// Quote escapes text to be used inside a string literal with the given quote, < is escaped as well
+// so a </script> in the text can't end a script that is inlined in html
+func Quote(text string, quote byte) string {
+	ret := strings.Builder{}
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == rune(quote):
+			ret.WriteRune('\\')
+			ret.WriteRune(r)
+		case r == '$' && quote == '`':
+			ret.WriteString("\\$")
+		case r == '\n':
+			ret.WriteString("\\n")
+		case r == '\r':
+			ret.WriteString("\\r")
+		case r == '\u2028':
+			ret.WriteString("\\u2028")
+		case r == '\u2029':
+			ret.WriteString("\\u2029")
+		case r == '<':
+			ret.WriteString("\\x3c")
+		default:
+			ret.WriteRune(r)
+		}
+	}
+	return ret.String()
+}
+
+// Literal is a string literal of the text
+func Literal(text string) string {
+	return "\"" + Quote(text, '"') + "\""
+}
+
+// Value is a literal of the text as the type it reads as, numbers and booleans stay bare so
+// $count$ + 1 still adds and anything else is a string literal
+func Value(text string) string {
+	switch {
+	case text == "true" || text == "false":
+		return text
+	case strings.HasPrefix(text, "-") && numberPattern.MatchString(text):
+		// in brackets so it can't join a - before it into --
+		return "(" + text + ")"
+	case numberPattern.MatchString(text):
+		return text
+	}
+	return Literal(text)
+}
+
+// Member puts a number value in brackets when next reads a property of it e.g. (5).toFixed()
+func Member(val, next string) string {
+	if (next == "." || next == "?.") && numberPattern.MatchString(val) {
+		return "(" + val + ")"
+	}
+	return val
+}
+
+// IsName checks if text can be used as a variable or property name
+func IsName(text string) bool {
+	return namePattern.MatchString(text) && !isReserved(text)
+}
+
+// Params rewrites the $param$ templates of a script into reads from the ParamsName object so one
+// copy of the script can run for every instance of a component, it returns the properties that
+// are read and false if a template is somewhere a read can't replace it e.g. in a regex or a name
+// that is being declared, the script is left unchanged in that case. A template in a string or
+// template literal reads the property name which holds the text of the parameter while a bare
+// template reads name$ which holds it as a Value, the way Substitute would have replaced them
+func (script *Script) Params() ([]string, bool) {
+	tokens := script.tokens()
+	names := []string{}
+	ret := []Token{}
+	for i, tok := range tokens {
+		matches := paramPattern.FindAllStringIndex(tok.Value, -1)
+		if len(matches) == 0 {
+			ret = append(ret, tok)
+			continue
+		}
+		for _, match := range matches {
+			name := tok.Value[match[0]+1 : match[1]-1]
+			if tok.Type == template {
+				name += "$"
+			}
+			names = appendName(names, name)
+		}
+
+		prev, next := around(tokens, i)
+		switch tok.Type {
+		case template:
+			if prev.Value == "." || prev.Value == "?." || declares(prev) {
+				return nil, false
+			}
+			ret = append(ret, paramRead(tok.Value[1:])...)
+
+		case value:
+			parts, ok := splitParams(tok.Value[1:len(tok.Value)-1], matches, 1)
+			if !ok {
+				return nil, false
+			}
+			// a string used as a property name becomes a computed property name
+			open, close := "(", ")"
+			if next.Value == ":" && (prev.Value == "{" || prev.Value == ",") {
+				open, close = "[", "]"
+			}
+			quote := tok.Value[:1]
+			// the parameters read here are strings so the empty text around them can be left out
+			concat := []Token{}
+			for j, part := range parts {
+				if j%2 == 0 && part == "" {
+					continue
+				}
+				if len(concat) > 0 {
+					concat = append(concat, Token{punctuator, "+"})
+				}
+				if j%2 == 0 {
+					concat = append(concat, Token{value, quote + part + quote})
+				} else {
+					concat = append(concat, paramRead(part)...)
+				}
+			}
+			ret = append(append(append(ret, Token{punctuator, open}), concat...), Token{punctuator, close})
+
+		case templateLiteral:
+			if strings.Contains(tok.Value, "${") {
+				return nil, false
+			}
+			parts, ok := splitParams(tok.Value, matches, 0)
+			if !ok {
+				return nil, false
+			}
+			val := ""
+			for j, part := range parts {
+				if j%2 == 0 {
+					val += part
+				} else {
+					val += "${" + ParamsName + "." + part + "}"
+				}
+			}
+			ret = append(ret, Token{templateLiteral, val})
+
+		default:
+			return nil, false
+		}
+	}
+
+	script.Lines = splitLines(ret)
+	return names, true
+}
+
+// splitParams splits a literal into the text between the templates and the names of the
+// templates, matches are the template positions in the token and offset is where the literal
+// starts, it fails if a template follows a backslash since splitting there would break the escape
+func splitParams(literal string, matches [][]int, offset int) ([]string, bool) {
+	ret := []string{}
+	last := 0
+	for _, match := range matches {
+		start, end := match[0]-offset, match[1]-offset
+		text := literal[last:start]
+		if (len(text)-len(strings.TrimRight(text, "\\")))%2 == 1 {
+			return nil, false
+		}
+		ret = append(ret, text, literal[start+1:end-1])
+		last = end
+	}
+	return append(ret, literal[last:]), true
+}
+
+// paramRead is the tokens that read a parameter from the ParamsName object
+func paramRead(name string) []Token {
+	prop := Token{identifier, name}
+	if isReserved(name) {
+		prop.Type = keyword
+	}
+	return []Token{Token{identifier, ParamsName}, Token{punctuator, "."}, prop}
+}
+
+// declares checks if the token is followed by the name of a declaration
+func declares(tok Token) bool {
+	if tok.Type != keyword {
+		return false
+	}
+	switch tok.Value {
+	case "var", "let", "const", "function", "class":
+		return true
+	}
+	return false
+}
+
+// around returns the tokens before and after the token at i skipping spaces and line breaks
+func around(tokens []Token, i int) (Token, Token) {
+	prev := Token{}
+	for j := i - 1; j >= 0; j-- {
+		if tokens[j].Type != whiteSpace && tokens[j].Type != newLine {
+			prev = tokens[j]
+			break
+		}
+	}
+	next := Token{}
+	if tok := nextToken(tokens[i+1:]); tok != nil {
+		next = *tok
+	}
+	return prev, next
+}
+
+func appendName(names []string, name string) []string {
+	for _, check := range names {
+		if check == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
@@ -0,0 +1,241 @@
+package js
+
+import (
+	"regexp"
+	"strings"
+)
+
+// statement is the range of tokens of a top level statement
+type statement struct {
+	start int
+	end   int
+}
+
+// Shake removes the exports that the keep function rejects and then the top level functions,
+// classes and variables that nothing uses any more, variables are only removed when creating
+// them has no side effects, it reports if anything was removed
+func (script *Script) Shake(keep func(name string) bool) bool {
+	changed := false
+	exports := []ModuleExport{}
+	for _, exp := range script.Exports {
+		if exp.Export == "*" || keep(exp.Export) {
+			exports = append(exports, exp)
+			continue
+		}
+		changed = true
+	}
+	script.Exports = exports
+
+	tokens := script.tokens()
+	for removed := true; removed; {
+		removed = false
+		for _, stmt := range statements(tokens) {
+			names := declaredBy(tokens[stmt.start:stmt.end])
+			if len(names) == 0 || script.used(tokens, stmt, names) {
+				continue
+			}
+			tokens = append(tokens[:stmt.start:stmt.start], tokens[stmt.end:]...)
+			removed = true
+			changed = true
+			break
+		}
+	}
+	script.Lines = splitLines(tokens)
+	return changed
+}
+
+// Uses checks if a name is used anywhere in the script
+func (script Script) Uses(name string) bool {
+	return countUses(script.tokens(), name) > 0
+}
+
+// used checks if any of the names declared by a statement are exported or used outside of it
+func (script Script) used(tokens []Token, stmt statement, names []string) bool {
+	for _, name := range names {
+		for _, exp := range script.Exports {
+			if exp.From == "" && exp.Local == name {
+				return true
+			}
+		}
+		if countUses(tokens[:stmt.start], name)+countUses(tokens[stmt.end:], name) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// countUses counts the references to a name, property names after a dot aren't references
+// and template literals are searched since their substitutions aren't split into tokens
+func countUses(tokens []Token, name string) int {
+	count := 0
+	word := regexp.MustCompile(`(^|[^\w$.])` + regexp.QuoteMeta(name) + `($|[^\w$])`)
+	prev := ""
+	for _, tok := range tokens {
+		switch tok.Type {
+		case identifier, template:
+			if tok.Value == name && prev != "." && prev != "?." {
+				count++
+			}
+		case templateLiteral:
+			if word.MatchString(tok.Value) {
+				count++
+			}
+		}
+		if tok.Type != whiteSpace && tok.Type != newLine {
+			prev = tok.Value
+		}
+	}
+	return count
+}
+
+// statements splits tokens into top level statements, function and class declarations end with
+// their body and any other statement ends with a semicolon
+func statements(tokens []Token) []statement {
+	ret := []statement{}
+	i := 0
+	for {
+		for i < len(tokens) && (tokens[i].Type == whiteSpace || tokens[i].Type == newLine) {
+			i++
+		}
+		if i >= len(tokens) {
+			return ret
+		}
+
+		start := i
+		c := &cursor{tokens: tokens, pos: i}
+		decl := declarationName(c) != ""
+		depth := 0
+		params := false
+		for i < len(tokens) {
+			tok := tokens[i]
+			i++
+			switch tok.Value {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			if depth != 0 {
+				continue
+			}
+			if tok.Value == ")" {
+				params = true
+			}
+			if tok.Value == ";" {
+				break
+			}
+			// a class body is the first block, a function body comes after the parameters
+			if decl && tok.Value == "}" && (params || tokens[start].Value == "class") {
+				c.pos = i
+				if c.peek().Value == ";" {
+					c.next()
+					i = c.pos
+				}
+				break
+			}
+		}
+		ret = append(ret, statement{start, i})
+	}
+}
+
+// declaredBy returns the names declared by a statement that can be removed without changing what
+// the script does, nothing is returned for any other statement
+func declaredBy(tokens []Token) []string {
+	c := &cursor{tokens: tokens}
+	if name := declarationName(c); name != "" {
+		return []string{name}
+	}
+
+	kind := c.next().Value
+	if kind != "var" && kind != "let" && kind != "const" {
+		return nil
+	}
+
+	names := []string{}
+	for {
+		name := c.next()
+		if name.Type != identifier {
+			return nil
+		}
+		names = append(names, name.Value)
+
+		tok := c.next()
+		if tok.Value == "=" {
+			init := []Token{}
+			depth := 0
+			for {
+				tok = c.next()
+				switch tok.Value {
+				case "(", "[", "{":
+					depth++
+				case ")", "]", "}":
+					depth--
+				}
+				if depth == 0 && (tok.Value == "," || tok.Value == ";" || tok.Value == "") {
+					break
+				}
+				init = append(init, tok)
+			}
+			if !pure(init) {
+				return nil
+			}
+		}
+
+		switch tok.Value {
+		case ",":
+			continue
+		case ";", "":
+			return names
+		default:
+			return nil
+		}
+	}
+}
+
+// pure checks if evaluating an expression has no side effects, functions and classes are pure
+// since their bodies don't run and anything else must be made of literals and names
+func pure(expr []Token) bool {
+	if len(expr) == 0 {
+		return false
+	}
+	switch expr[0].Value {
+	case "function", "class", "async":
+		return true
+	}
+
+	depth := 0
+	for _, tok := range expr {
+		switch tok.Value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		case "=>":
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+
+	for _, tok := range expr {
+		switch {
+		case tok.Type == templateLiteral && strings.Contains(tok.Value, "${"):
+			return false
+		case tok.Type == keyword && tok.Value != "true" && tok.Value != "false" && tok.Value != "null" && tok.Value != "this":
+			return false
+		case tok.Type == punctuator && !pureOperator(tok.Value):
+			return false
+		}
+	}
+	return true
+}
+
+func pureOperator(op string) bool {
+	switch op {
+	case "[", "]", "{", "}", ",", ":", ".", "?.", "+", "-", "*", "/", "%", "**", "!", "~",
+		"<", ">", "<=", ">=", "==", "!=", "===", "!==", "&&", "||", "??", "?", "&", "|", "^",
+		"<<", ">>", ">>>", "...":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,361 @@
+package js
+
+import (
+	"regexp"
+	"strings"
+)
+
+// reserved are the words that can't be used as names, let, yield and await are included since
+// they change how the statements around them are parsed
+var reserved = []string{
+	"await", "break", "case", "catch", "class", "const", "continue", "debugger", "default",
+	"delete", "do", "else", "export", "extends", "false", "finally", "for", "function", "if",
+	"import", "in", "instanceof", "let", "new", "null", "return", "super", "switch", "this",
+	"throw", "true", "try", "typeof", "var", "void", "while", "with", "yield",
+}
+
+// punctuators are ordered longest first so the longest match is taken
+var punctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--", "+=", "-=", "*=", "/=",
+	"%=", "&=", "|=", "^=", "<<", ">>", "**",
+	"{", "}", "(", ")", "[", "]", ";", ",", "<", ">", "+", "-", "*", "/", "%", "&", "|", "^",
+	"!", "~", "?", ":", "=", ".", "@",
+}
+
+var templatePattern = regexp.MustCompile(`^\$[_a-zA-Z][_a-zA-Z0-9]*\$$`)
+
+// lexer splits a script into tokens following https://tc39.es/ecma262/#sec-ecmascript-language-lexical-grammar,
+// whitespace and comments are dropped but line breaks are kept for semicolon insertion and a
+// single space is kept where it is needed to separate two tokens
+type lexer struct {
+	src     string
+	pos     int
+	tokens  []Token
+	newline bool
+	space   bool
+}
+
+// LexScript lexes a js script and returns a series of tokens
+func LexScript(script string) []Token {
+	l := &lexer{src: script}
+	l.run(false)
+	return l.tokens
+}
+
+// run lexes tokens until the end of the script, inside a template literal substitution
+// it stops at the closing brace
+func (l *lexer) run(substitution bool) {
+	depth := 0
+	for {
+		l.skip()
+		if l.pos >= len(l.src) {
+			return
+		}
+
+		c := l.src[l.pos]
+		start := l.pos
+		switch {
+		case isIdentStart(c):
+			l.pos++
+			for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+				l.pos++
+			}
+			name := l.src[start:l.pos]
+			switch {
+			case templatePattern.MatchString(name):
+				l.emit(template, name)
+			case isReserved(name) && !l.member():
+				l.emit(keyword, name)
+			default:
+				l.emit(identifier, name)
+			}
+		case c == '#' && l.pos+1 < len(l.src) && isIdentStart(l.src[l.pos+1]):
+			l.pos++
+			for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+				l.pos++
+			}
+			l.emit(identifier, l.src[start:l.pos])
+		case isDigit(c) || (c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+			l.number()
+			l.emit(number, l.src[start:l.pos])
+		case c == '"' || c == '\'':
+			l.string(c)
+			l.emit(value, l.src[start:l.pos])
+		case c == '`':
+			l.templateLiteral()
+			l.emit(templateLiteral, l.src[start:l.pos])
+		case c == '/' && l.regexAllowed():
+			l.regex()
+			l.emit(regex, l.src[start:l.pos])
+		default:
+			if c == '}' && substitution && depth == 0 {
+				return
+			}
+			if c == '{' {
+				depth++
+			}
+			if c == '}' {
+				depth--
+			}
+			l.punctuator()
+		}
+	}
+}
+
+// skip moves past whitespace and comments, remembering if they contained a line break
+func (l *lexer) skip() {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		rest := l.src[l.pos:]
+		switch {
+		case c == '\n' || c == '\r':
+			l.newline = true
+			l.pos++
+		case strings.HasPrefix(rest, "\u2028") || strings.HasPrefix(rest, "\u2029"):
+			l.newline = true
+			l.pos += len("\u2028")
+		case c == ' ' || c == '\t' || c == '\v' || c == '\f':
+			l.space = true
+			l.pos++
+		case strings.HasPrefix(rest, "\u00a0"):
+			l.space = true
+			l.pos += len("\u00a0")
+		case strings.HasPrefix(rest, "\ufeff"):
+			l.space = true
+			l.pos += len("\ufeff")
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexAny(rest, "\r\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			l.space = true
+			l.pos += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				end = len(rest) - 4
+			}
+			if strings.ContainsAny(rest[:end+2], "\r\n\u2028\u2029") {
+				l.newline = true
+			}
+			l.space = true
+			l.pos += end + 4
+		default:
+			return
+		}
+	}
+}
+
+// emit adds a token, a line break or space before it is added first when the source had one
+func (l *lexer) emit(tType int, val string) {
+	prev := l.last()
+	if l.newline && prev != nil {
+		l.tokens = append(l.tokens, Token{newLine, "\n"})
+	}
+	if (l.newline || l.space) && prev != nil && needSpace(prev.Value, val) {
+		l.tokens = append(l.tokens, Token{whiteSpace, " "})
+	}
+	l.tokens = append(l.tokens, Token{tType, val})
+	l.newline = false
+	l.space = false
+}
+
+// last returns the last token that is not a line break or space
+func (l *lexer) last() *Token {
+	for i := len(l.tokens) - 1; i >= 0; i-- {
+		if l.tokens[i].Type != newLine && l.tokens[i].Type != whiteSpace {
+			return &l.tokens[i]
+		}
+	}
+	return nil
+}
+
+// member reports if the next token is a property name after . or ?., where reserved words
+// are plain identifiers
+func (l *lexer) member() bool {
+	prev := l.last()
+	return prev != nil && prev.Type == punctuator && (prev.Value == "." || prev.Value == "?.")
+}
+
+func (l *lexer) number() {
+	if l.src[l.pos] == '0' && l.pos+1 < len(l.src) && strings.IndexByte("xXoObB", l.src[l.pos+1]) >= 0 {
+		l.pos += 2
+		for l.pos < len(l.src) && (isHex(l.src[l.pos]) || l.src[l.pos] == '_') {
+			l.pos++
+		}
+	} else {
+		l.digits()
+		if l.pos < len(l.src) && l.src[l.pos] == '.' {
+			l.pos++
+			l.digits()
+		}
+		if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+			l.pos++
+			if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+				l.pos++
+			}
+			l.digits()
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == 'n' {
+		l.pos++
+	}
+}
+
+func (l *lexer) digits() {
+	for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '_') {
+		l.pos++
+	}
+}
+
+// string moves past a string literal, an unescaped line break ends an unterminated string
+func (l *lexer) string(quote byte) {
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '\\' {
+			l.pos += 2
+			continue
+		}
+		if c == '\n' || c == '\r' {
+			return
+		}
+		l.pos++
+		if c == quote {
+			return
+		}
+	}
+	l.pos = len(l.src)
+}
+
+// templateLiteral moves past a template literal, substitutions are lexed so braces, strings
+// and nested templates inside them don't end the literal early
+func (l *lexer) templateLiteral() {
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\\':
+			l.pos += 2
+		case c == '`':
+			l.pos++
+			return
+		case strings.HasPrefix(l.src[l.pos:], "${"):
+			sub := &lexer{src: l.src, pos: l.pos + 2}
+			sub.run(true)
+			l.pos = sub.pos + 1
+		default:
+			l.pos++
+		}
+	}
+	l.pos = len(l.src)
+}
+
+// regex moves past a regular expression literal and its flags
+func (l *lexer) regex() {
+	l.pos++
+	class := false
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '\n' || c == '\r' {
+			return
+		}
+		l.pos++
+		switch {
+		case c == '\\':
+			l.pos++
+		case c == '[':
+			class = true
+		case c == ']':
+			class = false
+		case c == '/' && !class:
+			for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+				l.pos++
+			}
+			return
+		}
+	}
+	l.pos = len(l.src)
+}
+
+// regexAllowed checks if a slash starts a regular expression rather than a division, a
+// division can only follow something that ends an expression, a closing brace is taken to
+// end a block since a division after an object literal is rare
+func (l *lexer) regexAllowed() bool {
+	prev := l.last()
+	if prev == nil {
+		return true
+	}
+	switch prev.Type {
+	case identifier, template, number, value, templateLiteral, regex:
+		return false
+	case keyword:
+		return !endsExpression(*prev)
+	}
+	return prev.Value != ")" && prev.Value != "]"
+}
+
+func (l *lexer) punctuator() {
+	rest := l.src[l.pos:]
+	for _, punc := range punctuators {
+		if !strings.HasPrefix(rest, punc) {
+			continue
+		}
+		// ?. followed by a digit is a conditional e.g. a?.5:1
+		if punc == "?." && len(rest) > 2 && isDigit(rest[2]) {
+			continue
+		}
+		l.pos += len(punc)
+		l.emit(punctuator, punc)
+		return
+	}
+
+	// anything else is passed through so the browser can report it
+	l.pos++
+	l.emit(punctuator, rest[:1])
+}
+
+// needSpace checks if two tokens would run together without a space between them
+func needSpace(prev, next string) bool {
+	a, b := prev[len(prev)-1], next[0]
+	switch {
+	case isIdentPart(a) && (isIdentPart(b) || b == '\\' || b == '#'):
+		return true
+	case isDigit(prev[0]) && b == '.' && !strings.ContainsAny(prev, ".eExX"):
+		return true
+	case (a == '+' || a == '-') && b == a:
+		return true
+	case a == '/' && (b == '/' || b == '*'):
+		return true
+	case a == '<' && b == '!':
+		// <!-- starts a comment in scripts
+		return true
+	}
+	return false
+}
+
+func isReserved(name string) bool {
+	for _, word := range reserved {
+		if word == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c == '\\' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -4,19 +4,27 @@ import (
 	"KISS/js"
 	"fmt"
 	"io/ioutil"
-	"regexp"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/html"
 )
 
-// JSNode is a node for any js script data
+// JSNode is a node for any js script data, a Module node is a file imported with an es module
+// import and ID is the path it is registered under in the bundle, Scope is the class of the
+// component instance the script belongs to and Params are the values it is called with keyed by
+// the property of the parameters object the script reads them from
 type JSNode struct {
 	BaseNode
 	Src    string
 	Script js.Script
 	Remote bool
-	Depth  int
+	Module bool
+	ID     string
+	Scope  string
+	Params map[string]string
 }
 
 // Parse extracts the script information and arguments from the node and then calls parse on all it's children scripts
@@ -46,6 +54,32 @@ func (node *JSNode) Parse(ctx ParseNodeContext) error {
 	}
 	if hasSrc {
 		node.Src = ctx.path + srcAttr.Val
+		hasType, typeAttr := GetAttr(node, "type")
+		node.Module = hasType && typeAttr.Val == "module"
+		node.ID = relPath(ctx.root, node.Src)
+
+		// the scripts being imported are tracked so a script that ends up importing itself is reported,
+		// es modules are allowed to import each other, the module is already being added further up
+		// so it is left out here and the module importing it reads its names once it is defined
+		path := filepath.Clean(node.Src)
+		for i, script := range ctx.scripts {
+			if script == path && node.Module {
+				if parent, ok := node.Parent().(*JSNode); ok {
+					parent.lazy(node.ID)
+				}
+				Detach(node)
+				return nil
+			}
+			if script == path {
+				cycle := []string{}
+				for _, file := range append(ctx.scripts[i:], path) {
+					cycle = append(cycle, relPath(ctx.root, file))
+				}
+				return fmt.Errorf("error at node %s, import cycle %s", node, strings.Join(cycle, " -> "))
+			}
+		}
+		ctx.scripts = append(append([]string{}, ctx.scripts...), path)
+
 		// TODO: OPTIM: it seems slow to re-read the same files over and over, perhaps we should have an abstraction that does some kind of caching
 		scriptBytes, err := ioutil.ReadFile(node.Src)
 		script = string(scriptBytes)
@@ -73,48 +107,263 @@ func (node *JSNode) Parse(ctx ParseNodeContext) error {
 		AppendChild(node, newNode)
 	}
 
-	node.Depth = ctx.depth
-	ctx.depth++
+	// es modules are resolved relative to the script and each file is only added once
+	modules := map[string]bool{}
+	resolve := func(src string) (string, error) {
+		if !strings.HasPrefix(src, "./") && !strings.HasPrefix(src, "../") {
+			return "", fmt.Errorf("error at node %s, can not resolve module %s, only relative paths are supported", node, src)
+		}
+		id := relPath(ctx.root, ctx.path+src)
+		if !modules[id] {
+			modules[id] = true
+			AppendChild(node, NewNode("script", JSType,
+				&html.Attribute{Key: "src", Val: src},
+				&html.Attribute{Key: "type", Val: "module"},
+			))
+		}
+		return id, nil
+	}
+	for i := range node.Script.Modules {
+		id, err := resolve(node.Script.Modules[i].Src)
+		if err != nil {
+			return err
+		}
+		node.Script.Modules[i].Src = id
+	}
+	for i := range node.Script.Exports {
+		if node.Script.Exports[i].From == "" {
+			continue
+		}
+		id, err := resolve(node.Script.Exports[i].From)
+		if err != nil {
+			return err
+		}
+		node.Script.Exports[i].From = id
+	}
+
 	return node.BaseNode.Parse(ctx)
 }
 
-// Instance replaces props in a node with params
+// Instance replaces props in a node with params escaped for where they are used, a component
+// script reads them from a parameters object instead so every instance can share one copy of it
 func (node *JSNode) Instance(ctx InstNodeContext) error {
-	re := regexp.MustCompile(`\$[_a-zA-Z][_a-zA-Z0-9]*\$`)
-	for i := 0; i < len(node.Script.Lines); i++ {
-		line := &node.Script.Lines[i]
-		for j := 0; j < len(line.Value); j++ {
-			tok := &line.Value[j]
-			// TODO: OPTIM: we only need to check template and value types
-			matches := re.FindAll([]byte(tok.Value), -1)
-			for _, match := range matches {
-				val := ""
-				pnode, ok := ctx.Parameters[string(match[1:len(match)-1])]
-				if ok {
-					if len(pnode) == 1 {
-						val = pnode[0].Data()
-					}
-					if len(pnode) > 1 {
-						return fmt.Errorf("error at node %s, tried to replace %s with multiple param nodes", node, match)
-					}
-					if len(pnode) == 1 && pnode[0].Type() != TextType {
-						return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
-					}
+	if !node.Module {
+		node.Scope = ctx.componentScope
+	}
+	if node.Scope != "" {
+		if names, ok := node.Script.Params(); ok {
+			node.Params = map[string]string{}
+			for _, name := range names {
+				val, err := jsParam(node, ctx, "$"+strings.TrimSuffix(name, "$")+"$")
+				if err != nil {
+					return err
 				}
-				tok.Value = strings.ReplaceAll(tok.Value, string(match), val)
+				node.Params[name] = val
 			}
+			return nil
 		}
 	}
 
+	err := node.Script.Substitute(func(match string) (string, error) {
+		return jsParam(node, ctx, match)
+	})
+	if err != nil {
+		return fmt.Errorf("error at node %s, %s", node, err)
+	}
 	return nil
 }
 
-// Render converts a node into a textual representation
+// jsParam looks up the text of a $param$ template, a missing parameter is empty
+func jsParam(node Node, ctx InstNodeContext, match string) (string, error) {
+	pnode, ok := ctx.Parameters[match[1:len(match)-1]]
+	if !ok {
+		return "", nil
+	}
+	if len(pnode) > 1 {
+		return "", fmt.Errorf("error at node %s, tried to replace %s with multiple param nodes", node, match)
+	}
+	if len(pnode) == 1 && pnode[0].Type() != TextType {
+		return "", fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
+	}
+	if len(pnode) == 1 {
+		return pnode[0].Data(), nil
+	}
+	return "", nil
+}
+
+// Render converts a node into a textual representation, modules are wrapped in a function that
+// registers their exports and the names a script imports are read from the modules it uses, a
+// component script runs in a function with the root element of its instance as this and $root
 func (node *JSNode) Render() string {
-	// fmt.Printf("node: %s %p\n", node, node)
-	return "{" + node.Script.String() + "}"
+	imports := node.imports()
+	if !node.Module && node.Scope != "" {
+		root := "document.querySelector(" + strconv.Quote("."+node.Scope) + ")"
+		if node.Params != nil {
+			return "{const kissRoot=" + root + ";" + node.function(imports) + ".call(kissRoot,kissRoot," + node.args() + ")}"
+		}
+		return "{const kissRoot=" + root + ";(function($root){" + imports + node.code() + "}).call(kissRoot,kissRoot)}"
+	}
+	if !node.Module {
+		return "{" + imports + node.code() + "}"
+	}
+
+	getters := []string{}
+	exports := ""
+	for _, exp := range node.Script.Exports {
+		switch {
+		case exp.From != "" && exp.Export == "*":
+			exports += "kissExportAll(exports," + moduleRef(exp.From, "*") + ");"
+		case exp.From != "":
+			getters = append(getters, strconv.Quote(exp.Export)+":()=>"+moduleRef(exp.From, exp.Local))
+		default:
+			getters = append(getters, strconv.Quote(exp.Export)+":()=>"+exp.Local)
+		}
+	}
+	if len(getters) > 0 {
+		exports = "kissExport(exports,{" + strings.Join(getters, ",") + "});" + exports
+	}
+
+	return "kissDefine(" + strconv.Quote(node.ID) + ",function(exports){\"use strict\";" + exports + imports + node.code() + "});"
+}
+
+// Definition declares the function that the instances of a component script call, it is empty
+// for any other script
+func (node *JSNode) Definition() string {
+	if node.Module || node.Scope == "" || node.Params == nil {
+		return ""
+	}
+	imports := node.imports()
+	return "var " + node.function(imports) + "=function($root," + js.ParamsName + "){" + imports + node.code() + "};"
+}
+
+// imports declares the names a script imports from the modules it uses, the names of a lazy
+// import are read where they are used instead
+func (node *JSNode) imports() string {
+	ret := ""
+	for _, mod := range node.Script.Modules {
+		if mod.Lazy {
+			continue
+		}
+		for _, name := range mod.Names {
+			ret += "const " + name.Local + "=" + moduleRef(mod.Src, name.Export) + ";"
+		}
+	}
+	return ret
+}
+
+// function is the name of the function shared by the instances of a component script
+func (node *JSNode) function(imports string) string {
+	return "kissScript" + hashID(8, imports+node.code())
+}
+
+// args builds the parameters object passed to an instance of a component script
+func (node *JSNode) args() string {
+	names := []string{}
+	for name := range node.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	props := []string{}
+	for _, name := range names {
+		val := js.Literal(node.Params[name])
+		if strings.HasSuffix(name, "$") {
+			val = js.Value(node.Params[name])
+		}
+		props = append(props, js.Literal(name)+":"+val)
+	}
+	return "{" + strings.Join(props, ",") + "}"
+}
+
+// bundleJS joins the rendered scripts, the function shared by the instances of a component script
+// is declared before the first instance that calls it, remote scripts are skipped
+func bundleJS(scripts []Node) string {
+	ret := ""
+	declared := map[string]bool{}
+	for _, node := range scripts {
+		jsNode := node.(*JSNode)
+		if jsNode.Remote {
+			continue
+		}
+		if def := jsNode.Definition(); def != "" && !declared[def] {
+			declared[def] = true
+			ret += def
+		}
+		ret += jsNode.Render()
+	}
+	return ret
+}
+
+// downlevelJS rewrites the syntax of a bundle that the browser targets can't parse
+func downlevelJS(bundle string, features js.Feature) (string, error) {
+	if features == 0 || bundle == "" {
+		return bundle, nil
+	}
+	script, err := js.ParseTokens(js.LexScript(bundle))
+	if err != nil {
+		return "", err
+	}
+	err = script.Downlevel(features)
+	if err != nil {
+		return "", err
+	}
+	return script.String(), nil
+}
+
+// lazy marks the imports of the module id as lazy since it is not defined before the script runs
+func (node *JSNode) lazy(id string) {
+	for i := range node.Script.Modules {
+		if node.Script.Modules[i].Src == id {
+			node.Script.Modules[i].Lazy = true
+		}
+	}
+}
+
+// code is the script with the names of its lazy imports read from the modules they come from
+func (node *JSNode) code() string {
+	refs := map[string]string{}
+	for _, mod := range node.Script.Modules {
+		if !mod.Lazy {
+			continue
+		}
+		for _, name := range mod.Names {
+			refs[name.Local] = moduleRef(mod.Src, name.Export)
+		}
+	}
+	if len(refs) == 0 {
+		return node.Script.String()
+	}
+	return node.Script.Link(refs).String()
 }
 
+// moduleRef is the expression for a name exported by a module, * is the whole module
+func moduleRef(id, name string) string {
+	ref := "kissModules[" + strconv.Quote(id) + "]"
+	if name == "*" {
+		return ref
+	}
+	return ref + "[" + strconv.Quote(name) + "]"
+}
+
+// usesModules checks if any of the scripts need the module runtime
+func usesModules(nodes []Node) bool {
+	for _, node := range nodes {
+		if node.(*JSNode).Module || len(node.(*JSNode).Script.Modules) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleLoader is the runtime that links the es modules in a bundle, a module runs once when it is
+// defined and the modules it imports are defined before it unless they import each other, the
+// names are declared with var so lazy bundles can share the registry
+const moduleLoader = `var kissModules=kissModules||{};
+var kissDefine=kissDefine||function(id,fn){if(id in kissModules){return}var exports={};kissModules[id]=exports;fn(exports)};
+var kissExport=kissExport||function(exports,getters){Object.keys(getters).forEach(function(name){Object.defineProperty(exports,name,{enumerable:true,get:getters[name]})})};
+var kissExportAll=kissExportAll||function(exports,mod){Object.keys(mod).forEach(function(name){if(name!=="default"&&!(name in exports)){Object.defineProperty(exports,name,{enumerable:true,get:function(){return mod[name]}})}})};
+`
+
 // Clone creates a clone of the node
 func (node *JSNode) Clone() Node {
 	clone := &JSNode{
@@ -128,6 +377,15 @@ func (node *JSNode) Clone() Node {
 	clone.Src = node.Src
 	clone.Remote = node.Remote
 	clone.Script = node.Script.Clone()
+	clone.Module = node.Module
+	clone.ID = node.ID
+	clone.Scope = node.Scope
+	if node.Params != nil {
+		clone.Params = map[string]string{}
+		for name, val := range node.Params {
+			clone.Params[name] = val
+		}
+	}
 
 	return clone
 }
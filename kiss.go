@@ -1,10 +1,14 @@
 package main
 
 import (
+	"KISS/css"
+	"KISS/js"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/html"
@@ -14,13 +18,19 @@ func main() {
 	args, err := parseArgs(os.Args)
 
 	if err != nil {
-		fmt.Printf("Usage:\n\tkiss entry [-o output] [-g globals] [-v view_location]\n")
+		fmt.Printf("Usage:\n\tkiss entry [-o output] [-g globals] [-v view_location] [-t \"browser version, ...\"] [-s \"class, ...\"] [-c critical_css_bytes] [-a name|hash] [-m off|on]\n")
+		return
+	}
+
+	targets, err := css.ParseTargets(args.targets)
+	if err != nil {
+		fmt.Printf("Unable to parse the browser targets: %s\n", err)
 		return
 	}
 
 	globals := make(map[string][]Node)
 	if args.globals != "" {
-		comps, err := parseComponentFile(args.globals)
+		comps, err := parseComponentFile(args.globals, relPath(getPath(args.entry), args.globals))
 		if err != nil {
 			fmt.Printf("Unable to parse the global args file %s: %s\n", args.globals, err)
 			return
@@ -37,7 +47,10 @@ func main() {
 	}
 
 	pctx := ParseNodeContext{
-		path: getPath(args.entry),
+		path:    getPath(args.entry),
+		root:    getPath(args.entry),
+		file:    args.entry,
+		targets: targets,
 	}
 	err = root.Parse(pctx)
 	if err != nil {
@@ -45,6 +58,7 @@ func main() {
 		return
 	}
 	ictx := InstNodeContext{
+		instances:  make(map[string]int),
 		Parameters: globals,
 	}
 	err = root.Instance(ictx)
@@ -52,8 +66,38 @@ func main() {
 		fmt.Printf("There was an error instancing the structure: %s\n", err)
 		return
 	}
+	lintTemplates(root)
 
-	err = Render(args.output, args.viewLocation, root)
+	opts := RenderOptions{
+		Root:       getPath(args.entry),
+		HashAssets: args.assets == "hash",
+		Minify:     args.minify == "on",
+	}
+	for _, target := range targets {
+		opts.Downlevel |= js.Unsupported(target.Browser, target.Version)
+	}
+	if args.assets != "" && args.assets != "hash" && args.assets != "name" {
+		fmt.Printf("Invalid asset naming %s, it should be name or hash\n", args.assets)
+		return
+	}
+	if args.minify != "" && args.minify != "off" && args.minify != "on" {
+		fmt.Printf("Invalid minify setting %s, it should be off or on\n", args.minify)
+		return
+	}
+	if args.critical != "" {
+		opts.Critical, err = strconv.Atoi(args.critical)
+		if err != nil || opts.Critical < 0 {
+			fmt.Printf("Invalid critical css size %s, it should be a number of bytes\n", args.critical)
+			return
+		}
+	}
+	for _, name := range strings.Split(args.safelist, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			opts.Safelist = append(opts.Safelist, strings.TrimPrefix(name, "."))
+		}
+	}
+
+	err = Render(args.output, args.viewLocation, root, opts)
 	if err != nil {
 		fmt.Printf("There was an error writing the output files, %s", err)
 		return
@@ -79,7 +123,7 @@ func parseEntryFile(file string) (Node, error) {
 	root.SetVisible(false)
 	root = fragmentNodes(root)
 	root = removeWhiteSpace(root)
-	root, err = convertInstanceComponents(root)
+	root, err = convertInstanceComponents(root, removePath(file))
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +136,9 @@ func parseEntryFile(file string) (Node, error) {
 	return root, nil
 }
 
-func parseComponentFile(file string) ([]Node, error) {
+// parseComponentFile parses a component file, the id is used to build stable inline component
+// tags and should be the same between builds
+func parseComponentFile(file, id string) ([]Node, error) {
 	data, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -118,7 +164,7 @@ func parseComponentFile(file string) ([]Node, error) {
 	root := convertNodeTree(nil, htmlRoot[0])
 	root = removeWhiteSpace(root)
 	root = fragmentNodes(root)
-	root, err = convertInstanceComponents(root)
+	root, err = convertInstanceComponents(root, id)
 	if err != nil {
 		return nil, err
 	}
@@ -183,7 +229,7 @@ func hoistImports(root Node) Node {
 	return root
 }
 
-func convertInstanceComponents(root Node) (Node, error) {
+func convertInstanceComponents(root Node, id string) (Node, error) {
 	desc := Descendants(root)
 	for i := 0; i < len(desc); i++ {
 		node := desc[i]
@@ -193,7 +239,7 @@ func convertInstanceComponents(root Node) (Node, error) {
 				continue
 			}
 
-			tagName := "tag-" + randomID(6)
+			tagName := "tag-" + hashID(6, id, strconv.Itoa(i))
 			attrs := node.Attrs()
 			add := NewNode(tagName, BaseType, attrs...)
 			attrs = append(attrs, &html.Attribute{Key: "tag", Val: tagName})
@@ -264,7 +310,7 @@ func removeWhiteSpace(root Node) Node {
 }
 
 func fragmentNodes(root Node) Node {
-	re := regexp.MustCompile(`{[_a-zA-Z][_a-zA-Z0-9]*}`)
+	re := regexp.MustCompile(`{{{[_a-zA-Z][_a-zA-Z0-9]*}}}|{[_a-zA-Z][_a-zA-Z0-9]*}`)
 	for _, node := range Descendants(root) {
 		data := strings.TrimSpace(node.Data())
 		matches := re.FindAllIndex([]byte(data), -1)
@@ -339,8 +385,23 @@ func WriteFile(dest, data string) error {
 	return err
 }
 
+// RenderOptions are the settings that change how the output files are built, Safelist holds the
+// class, id and tag names that unused css pruning should always keep, Critical is the size
+// limit in bytes for css inlined into the head, zero turns inlining off, Root is the project
+// directory, HashAssets adds a content hash to the names of copied assets, Minify shortens the
+// local scripts and Downlevel is the js syntax the browser targets can't parse that the bundles are
+// rewritten without
+type RenderOptions struct {
+	Safelist   []string
+	Critical   int
+	Root       string
+	HashAssets bool
+	Minify     bool
+	Downlevel  js.Feature
+}
+
 // Render takes a node and renders the full tree into an array of files
-func Render(outputDir, viewLocation string, root Node) error {
+func Render(outputDir, viewLocation string, root Node, opts RenderOptions) error {
 	var head, body Node
 	for _, desc := range Descendants(root) {
 		if desc.Data() == "head" {
@@ -359,20 +420,78 @@ func Render(outputDir, viewLocation string, root Node) error {
 		os.Mkdir(outputDir, 0700)
 	}
 
+	// prune before lazy components are split out so their elements are still in the tree
+	pruneCSS(root, opts.Safelist)
+	shakeJS(root)
+	if opts.Minify {
+		for _, node := range FindNodes(root, JSType) {
+			if jsNode := node.(*JSNode); !jsNode.Remote {
+				jsNode.Script.Minify(jsNode.Scope != "")
+			}
+		}
+	}
+
+	files := newAssets(outputDir, viewLocation, opts)
+	for _, node := range FindNodes(root, CSSType) {
+		if node.(*CSSNode).Remote {
+			continue
+		}
+		err := node.(*CSSNode).copyAssets(files)
+		if err != nil {
+			return err
+		}
+	}
+	err := copyAttrAssets(root, files)
+	if err != nil {
+		return err
+	}
+
+	lazyCount, err := renderLazy(outputDir, viewLocation, root, head, body, opts.Downlevel)
+	if err != nil {
+		return err
+	}
+
 	cssNodes := FindNodes(root, CSSType)
-	var cssBundle string
+	localCSS := []*CSSNode{}
 	for _, node := range cssNodes {
 		cssNode := node.(*CSSNode)
 		if !cssNode.Remote {
-			cssBundle += node.Render()
+			localCSS = append(localCSS, cssNode)
 		} else {
 			AppendChild(head,
 				NewNode("link", BaseType, &html.Attribute{Key: "rel", Val: "stylesheet"}, &html.Attribute{Key: "href", Val: cssNode.Href}))
 		}
 		Detach(node)
 	}
-	if len(cssNodes) > 0 {
-		err := WriteFile(outputDir+"/bundle.css", cssBundle)
+	if len(cssNodes) > 0 && opts.Critical > 0 {
+		critical, rest := criticalCSS(localCSS, opts.Critical)
+		if critical != "" {
+			style := NewNode("style", BaseType)
+			AppendChild(style, NewNode(critical, TextType))
+			AppendChild(head, style)
+		}
+		if rest != "" {
+			err := WriteFile(outputDir+"/bundle.css", rest)
+			if err != nil {
+				return err
+			}
+
+			// load the rest of the css without blocking the first paint
+			href := &html.Attribute{Key: "href", Val: viewLocation + "/bundle.css"}
+			AppendChild(head,
+				NewNode("link", BaseType,
+					&html.Attribute{Key: "rel", Val: "preload"},
+					&html.Attribute{Key: "as", Val: "style"},
+					href,
+					&html.Attribute{Key: "onload", Val: "this.onload=null;this.rel='stylesheet'"},
+				),
+			)
+			noscript := NewNode("noscript", BaseType)
+			AppendChild(noscript, NewNode("link", BaseType, &html.Attribute{Key: "rel", Val: "stylesheet"}, href))
+			AppendChild(head, noscript)
+		}
+	} else if len(cssNodes) > 0 {
+		err := WriteFile(outputDir+"/bundle.css", bundleCSS(localCSS))
 		if err != nil {
 			return err
 		}
@@ -381,52 +500,33 @@ func Render(outputDir, viewLocation string, root Node) error {
 		)
 	}
 
-	var jsBundle string
 	jsNodes := FindNodes(root, JSType)
-	maxDepth := 0
-	for _, node := range jsNodes {
-		depth := node.(*JSNode).Depth
-		if depth > maxDepth {
-			maxDepth = depth
-		}
-	}
-
-	sorted := []Node{}
-	for i := maxDepth; i >= 0; i-- {
-		for ii := 0; ii < len(jsNodes); ii++ {
-			if jsNodes[ii].(*JSNode).Depth == i {
-				sorted = append(sorted, jsNodes[ii])
-			}
-		}
+	scripts, err := orderJS(jsNodes)
+	if err != nil {
+		return err
 	}
-	jsNodes = sorted
-
-	done := []string{}
-	for _, node := range jsNodes {
-		jsNode := node.(*JSNode)
-		if jsNode.Remote {
+	for _, node := range scripts {
+		if jsNode := node.(*JSNode); jsNode.Remote {
 			AppendChild(body,
 				NewNode("script", BaseType, &html.Attribute{Key: "src", Val: jsNode.Src}))
-			Detach(node)
-			continue
 		}
-
-		src := node.Render()
-		new := true
-		for _, check := range done {
-			if check == src {
-				new = false
-			}
-		}
-		if new {
-			jsBundle = jsBundle + src
-			done = append(done, src)
-		}
-
+	}
+	jsBundle := bundleJS(scripts)
+	for _, node := range jsNodes {
 		Detach(node)
 	}
-	if len(jsNodes) > 0 {
-		err := WriteFile(outputDir+"/bundle.js", jsBundle)
+	if usesModules(jsNodes) {
+		jsBundle = moduleLoader + jsBundle
+	}
+	if lazyCount > 0 {
+		jsBundle = lazyLoader + jsBundle
+	}
+	if len(jsNodes) > 0 || lazyCount > 0 {
+		jsBundle, err := downlevelJS(jsBundle, opts.Downlevel)
+		if err != nil {
+			return fmt.Errorf("error in bundle.js, %s", err)
+		}
+		err = WriteFile(outputDir+"/bundle.js", jsBundle)
 		if err != nil {
 			return err
 		}
@@ -435,7 +535,7 @@ func Render(outputDir, viewLocation string, root Node) error {
 
 	var tsBundle string
 	tsNodes := FindNodes(root, TSType)
-	maxDepth = 0
+	maxDepth := 0
 	for _, node := range tsNodes {
 		depth := node.(*TSNode).Depth
 		if depth > maxDepth {
@@ -443,7 +543,7 @@ func Render(outputDir, viewLocation string, root Node) error {
 		}
 	}
 
-	sorted = []Node{}
+	sorted := []Node{}
 	for i := maxDepth; i >= 0; i-- {
 		for ii := 0; ii < len(tsNodes); ii++ {
 			if tsNodes[ii].(*TSNode).Depth == i {
@@ -453,7 +553,7 @@ func Render(outputDir, viewLocation string, root Node) error {
 	}
 	tsNodes = sorted
 
-	done = []string{}
+	done := []string{}
 	for _, node := range tsNodes {
 		src := node.Render()
 		new := true
@@ -474,13 +574,13 @@ func Render(outputDir, viewLocation string, root Node) error {
 			return err
 		}
 	}
-	if len(jsNodes) > 0 || len(tsNodes) > 0 {
+	if len(jsNodes) > 0 || len(tsNodes) > 0 || lazyCount > 0 {
 		AppendChild(body,
 			NewNode("script", BaseType, &html.Attribute{Key: "src", Val: viewLocation + "/bundle.js"}),
 		)
 	}
 
-	err := WriteFile(outputDir+"/index.html", root.Render())
+	err = WriteFile(outputDir+"/index.html", root.Render())
 	if err != nil {
 		return err
 	}
@@ -488,6 +588,59 @@ func Render(outputDir, viewLocation string, root Node) error {
 	return nil
 }
 
+// orderJS orders js nodes so every script comes after the scripts it imports, cycles are found
+// by path, a file is deduplicated by its path and its rendered source rather than its path alone
+// since the script of a component renders once for every instance, each with its own root and
+// parameters, so keying on the path would only run it for the first instance, inline scripts
+// have no path and are included once for each source
+func orderJS(jsNodes []Node) ([]Node, error) {
+	ordered := []Node{}
+	done := map[string][]string{}
+	importing := []string{}
+
+	var visit func(node *JSNode) error
+	visit = func(node *JSNode) error {
+		path, src := node.Src, node.Src
+		if !node.Remote {
+			src = node.Render()
+			if path != "" {
+				path = filepath.Clean(path)
+			}
+		}
+		for i, check := range importing {
+			if path != "" && check == path {
+				return fmt.Errorf("error at node %s, import cycle %s", node, strings.Join(append(importing[i:], path), " -> "))
+			}
+		}
+		for _, check := range done[path] {
+			if check == src {
+				return nil
+			}
+		}
+
+		importing = append(importing, path)
+		for _, child := range Children(node) {
+			if dep, ok := child.(*JSNode); ok {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		importing = importing[:len(importing)-1]
+
+		done[path] = append(done[path], src)
+		ordered = append(ordered, node)
+		return nil
+	}
+
+	for _, node := range jsNodes {
+		if err := visit(node.(*JSNode)); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
 func getPath(fileName string) string {
 	last := strings.LastIndex(fileName, "/")
 	if last < -1 {
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"KISS/js"
+	"fmt"
+	"os"
+
+	"golang.org/x/net/html"
+)
+
+// lazyLoader is the runtime that fetches lazy components once their placeholder is shown or scrolled into view
+const lazyLoader = `{let kissLazyLoad=(elm)=>{
+elm.removeAttribute("data-kiss-lazy");
+fetch(elm.getAttribute("data-kiss-src"),{method:"GET"}).
+then(resp=>resp.text()).
+then(resp=>{
+elm.innerHTML=resp;
+let css=elm.getAttribute("data-kiss-css");
+if(css){let tag=document.createElement("link");tag.setAttribute("rel","stylesheet");tag.setAttribute("href",css);document.head.appendChild(tag)}
+let js=elm.getAttribute("data-kiss-js");
+if(js){let tag=document.createElement("script");tag.setAttribute("src",js);document.body.appendChild(tag)}
+kissLazyWatch(elm);
+});
+};
+let kissLazyObserver=null;
+if("IntersectionObserver" in window){
+kissLazyObserver=new IntersectionObserver((entries)=>{
+entries.forEach((entry)=>{
+if(entry.isIntersecting){kissLazyObserver.unobserve(entry.target);kissLazyLoad(entry.target)}
+});
+});
+}
+var kissLazyWatch=(root)=>{
+root.querySelectorAll("[data-kiss-lazy]").forEach((elm)=>{
+if(kissLazyObserver){kissLazyObserver.observe(elm)}else{kissLazyLoad(elm)}
+});
+};
+kissLazyWatch(document);}`
+
+// renderLazy splits every lazy component out of the tree into its own html, css and js files
+// and replaces it with a placeholder that the lazy loader fetches on demand, it returns the
+// number of components that were split out, the js of a component is rewritten without the
+// downlevel features
+func renderLazy(outputDir, viewLocation string, root, head, body Node, downlevel js.Feature) (int, error) {
+	lazy := []*ComponentNode{}
+	for _, node := range FindNodes(root, ComponentType) {
+		if node.(*ComponentNode).Lazy {
+			lazy = append(lazy, node.(*ComponentNode))
+		}
+	}
+	if len(lazy) == 0 {
+		return 0, nil
+	}
+
+	lazyDir := outputDir + "/lazy"
+	if _, err := os.Stat(lazyDir); os.IsNotExist(err) {
+		os.Mkdir(lazyDir, 0700)
+	}
+
+	// work from the deepest component out so nested lazy components are
+	// already placeholders by the time their parent is rendered
+	for i := len(lazy) - 1; i >= 0; i-- {
+		comp := lazy[i]
+		name := "/lazy/" + comp.Scope
+
+		localCSS := []*CSSNode{}
+		for _, node := range FindNodes(comp, CSSType) {
+			if node.(*CSSNode).Remote {
+				AppendChild(head, Detach(node))
+				continue
+			}
+			localCSS = append(localCSS, node.(*CSSNode))
+			Detach(node)
+		}
+		cssBundle := bundleCSS(localCSS)
+
+		jsNodes := FindNodes(comp, JSType)
+		scripts, err := orderJS(jsNodes)
+		if err != nil {
+			return 0, err
+		}
+		for _, node := range scripts {
+			if node.(*JSNode).Remote {
+				AppendChild(body, node.Clone())
+			}
+		}
+		jsBundle := bundleJS(scripts)
+		for _, node := range jsNodes {
+			Detach(node)
+		}
+		if jsBundle != "" && usesModules(scripts) {
+			jsBundle = moduleLoader + jsBundle
+		}
+		jsBundle, err = downlevelJS(jsBundle, downlevel)
+		if err != nil {
+			return 0, fmt.Errorf("error in %s.js, %s", name, err)
+		}
+
+		for _, node := range FindNodes(comp, TSType) {
+			AppendChild(body, Detach(node))
+		}
+
+		attrs := []*html.Attribute{
+			&html.Attribute{Key: "data-kiss-lazy", Val: "true"},
+			&html.Attribute{Key: "data-kiss-src", Val: viewLocation + name + ".html"},
+		}
+		if cssBundle != "" {
+			err := WriteFile(outputDir+name+".css", cssBundle)
+			if err != nil {
+				return 0, err
+			}
+			attrs = append(attrs, &html.Attribute{Key: "data-kiss-css", Val: viewLocation + name + ".css"})
+		}
+		if jsBundle != "" {
+			err := WriteFile(outputDir+name+".js", jsBundle)
+			if err != nil {
+				return 0, err
+			}
+			attrs = append(attrs, &html.Attribute{Key: "data-kiss-js", Val: viewLocation + name + ".js"})
+		}
+
+		err = WriteFile(outputDir+name+".html", comp.Render())
+		if err != nil {
+			return 0, err
+		}
+
+		placeholder := NewNode("div", BaseType, attrs...)
+		err = InsertBefore(comp.Parent(), comp, placeholder)
+		if err != nil {
+			return 0, err
+		}
+		Detach(comp)
+	}
+
+	return len(lazy), nil
+}
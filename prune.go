@@ -0,0 +1,189 @@
+package main
+
+import (
+	"KISS/css"
+	"regexp"
+	"strings"
+)
+
+// pruneCSS removes the css rules that can't match any element in the final document, names in
+// the safelist or used in string literals in the local scripts are always kept since they may
+// be added at runtime, a trailing * in the safelist matches any name with that prefix
+func pruneCSS(root Node, safelist []string) {
+	tags, names := scriptNames(root)
+	tags = append(tags, safelist...)
+	names = append(names, safelist...)
+
+	elements := []Node{}
+	for _, node := range Descendants(root) {
+		if node.Type() == BaseType && node.Visible() {
+			elements = append(elements, node)
+		}
+	}
+
+	keep := func(sel []css.Selector) bool {
+		compounds := []css.Compound{}
+		for _, part := range sel {
+			compound := part.Compound()
+			if isSafe(compound, tags, names) {
+				return true
+			}
+			compounds = append(compounds, compound)
+		}
+
+		for _, elm := range elements {
+			if matchSelector(elm, compounds, sel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, node := range FindNodes(root, CSSType) {
+		cssNode := node.(*CSSNode)
+		if cssNode.Remote {
+			continue
+		}
+		cssNode.Script.Prune(keep)
+		cssNode.InstScript.Prune(keep)
+	}
+}
+
+var stringPattern = regexp.MustCompile("\"[^\"]*\"|'[^']*'|`[^`]*`")
+var namePattern = regexp.MustCompile(`-?[_a-zA-Z][_a-zA-Z0-9-]*`)
+
+// scriptNames finds the names in the string literals of the local scripts, any word could be a
+// class or id but only strings that are a single name are treated as tags e.g. createElement("li")
+func scriptNames(root Node) ([]string, []string) {
+	tags, names := []string{}, []string{}
+	scripts := append(FindNodes(root, JSType), FindNodes(root, TSType)...)
+	for _, node := range scripts {
+		if node.Type() == JSType && node.(*JSNode).Remote {
+			continue
+		}
+		for _, str := range stringPattern.FindAllString(node.Render(), -1) {
+			words := namePattern.FindAllString(str, -1)
+			if len(words) == 1 && words[0] == str[1:len(str)-1] {
+				tags = append(tags, strings.ToLower(words[0]))
+			}
+			names = append(names, words...)
+		}
+	}
+	return tags, names
+}
+
+func isSafe(compound css.Compound, tags, names []string) bool {
+	if compound.Tag != "" && inSafelist(compound.Tag, tags) {
+		return true
+	}
+	for _, name := range append(compound.IDs, compound.Classes...) {
+		if inSafelist(name, names) {
+			return true
+		}
+	}
+	return false
+}
+
+func inSafelist(name string, safelist []string) bool {
+	for _, safe := range safelist {
+		if safe == name || (strings.HasSuffix(safe, "*") && strings.HasPrefix(name, safe[:len(safe)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSelector checks if an element matches a complex selector working from the last compound
+// selector back through the combinators, pseudo classes are assumed to match since they
+// depend on the state of the page
+func matchSelector(elm Node, compounds []css.Compound, sel []css.Selector) bool {
+	last := len(compounds) - 1
+	if !matchCompound(elm, compounds[last]) {
+		return false
+	}
+	if last == 0 {
+		return true
+	}
+
+	rest, restSel := compounds[:last], sel[:last]
+	switch sel[last].Comb {
+	case ">":
+		parent := elementParent(elm)
+		return parent != nil && matchSelector(parent, rest, restSel)
+	case "+":
+		prev := elementSiblings(elm)
+		return len(prev) > 0 && matchSelector(prev[len(prev)-1], rest, restSel)
+	case "~":
+		for _, prev := range elementSiblings(elm) {
+			if matchSelector(prev, rest, restSel) {
+				return true
+			}
+		}
+		return false
+	default:
+		for parent := elementParent(elm); parent != nil; parent = elementParent(parent) {
+			if matchSelector(parent, rest, restSel) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchCompound(elm Node, compound css.Compound) bool {
+	if compound.Tag != "" && compound.Tag != strings.ToLower(elm.Data()) {
+		return false
+	}
+
+	for _, id := range compound.IDs {
+		ok, attr := GetAttr(elm, "id")
+		if !ok || attr.Val != id {
+			return false
+		}
+	}
+
+	classes := []string{}
+	if ok, attr := GetAttr(elm, "class"); ok {
+		classes = strings.Fields(attr.Val)
+	}
+	for _, class := range compound.Classes {
+		found := false
+		for _, check := range classes {
+			if check == class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// elementParent finds the closest ancestor that is rendered as an element
+func elementParent(elm Node) Node {
+	for parent := elm.Parent(); parent != nil; parent = parent.Parent() {
+		if parent.Type() == BaseType && parent.Visible() {
+			return parent
+		}
+	}
+	return nil
+}
+
+// elementSiblings finds the elements rendered before this one in the same parent
+func elementSiblings(elm Node) []Node {
+	parent := elementParent(elm)
+	if parent == nil {
+		return []Node{}
+	}
+
+	ret := []Node{}
+	for _, sibling := range hostNodes(parent) {
+		if sibling == elm {
+			return ret
+		}
+		ret = append(ret, sibling)
+	}
+	return ret
+}
@@ -0,0 +1,108 @@
+package main
+
+// shakeJS removes the exports of es modules that no script imports, along with the functions
+// and variables that were only used by them, a module imported as a namespace is kept whole
+func shakeJS(root Node) {
+	modules := map[string][]*JSNode{}
+	scripts := []*JSNode{}
+	for _, node := range FindNodes(root, JSType) {
+		jsNode := node.(*JSNode)
+		if jsNode.Remote {
+			continue
+		}
+		scripts = append(scripts, jsNode)
+		if jsNode.Module {
+			modules[jsNode.ID] = append(modules[jsNode.ID], jsNode)
+		}
+	}
+
+	// removing code can make more exports unused so repeat until nothing changes
+	for changed := true; changed; {
+		changed = false
+		used, all := usedExports(scripts, modules)
+		for id, nodes := range modules {
+			if all[id] {
+				continue
+			}
+			for _, node := range nodes {
+				if node.Script.Shake(func(name string) bool { return used[id][name] }) {
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// usedExports finds the names that are imported from each module, re-exports pass the names
+// used from one module on to the module they come from
+func usedExports(scripts []*JSNode, modules map[string][]*JSNode) (map[string]map[string]bool, map[string]bool) {
+	used := map[string]map[string]bool{}
+	all := map[string]bool{}
+	use := func(id, name string) bool {
+		if used[id] == nil {
+			used[id] = map[string]bool{}
+		}
+		if used[id][name] {
+			return false
+		}
+		used[id][name] = true
+		return true
+	}
+
+	for _, node := range scripts {
+		for _, mod := range node.Script.Modules {
+			for _, name := range mod.Names {
+				if !node.Script.Uses(name.Local) {
+					continue
+				}
+				if name.Export == "*" {
+					all[mod.Src] = true
+					continue
+				}
+				use(mod.Src, name.Export)
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for id, nodes := range modules {
+			for _, exp := range nodes[0].Script.Exports {
+				switch {
+				case exp.From == "":
+				case exp.Export == "*":
+					if all[id] {
+						changed = changed || !all[exp.From]
+						all[exp.From] = true
+						continue
+					}
+					for name := range used[id] {
+						if !exportsName(nodes[0], name) && use(exp.From, name) {
+							changed = true
+						}
+					}
+				case exp.Local == "*":
+					if (all[id] || used[id][exp.Export]) && !all[exp.From] {
+						all[exp.From] = true
+						changed = true
+					}
+				default:
+					if (all[id] || used[id][exp.Export]) && use(exp.From, exp.Local) {
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	return used, all
+}
+
+// exportsName checks if a module exports a name itself rather than through export *
+func exportsName(node *JSNode, name string) bool {
+	for _, exp := range node.Script.Exports {
+		if exp.Export == name {
+			return true
+		}
+	}
+	return false
+}
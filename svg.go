@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// svgPrefixes are the namespace prefixes kept in svg components, anything else belongs to the
+// editor that made the file e.g. inkscape:, sodipodi: or sketch:
+var svgPrefixes = []string{"", "xlink", "xml"}
+
+// svgMetadata are the elements that only hold information for editors
+var svgMetadata = []string{"metadata"}
+
+// parseSVGFile parses an svg component file as xml so the case of tags and attributes and the
+// namespaces are kept, the prolog, comments and editor metadata are removed, currentColor
+// replaces the fill and stroke colors so the icon follows the text color and optimize
+// shortens the path data with a precision that suits the size of the drawing
+func parseSVGFile(file string, currentColor, optimize bool) ([]Node, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+
+	root := NewNode("root", BaseType)
+	root.SetVisible(false)
+	parent := root
+	skip := 0
+	// the path data is only rounded when optimize is set, to a precision set by the root element
+	decimals := -1
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse svg %s, %s", file, err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 || !svgPrefix(tok.Name.Space) || inList(tok.Name.Local, svgMetadata) {
+				skip++
+				continue
+			}
+			if optimize && parent == root {
+				decimals = svgDecimals(tok.Attr)
+			}
+			node := NewNode(xmlName(tok.Name), BaseType, svgAttrs(tok.Attr, currentColor, decimals)...)
+			AppendChild(parent, node)
+			parent = node
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if parent == root {
+				return nil, fmt.Errorf("unable to parse svg %s, unexpected closing tag %s", file, xmlName(tok.Name))
+			}
+			parent = parent.Parent()
+		case xml.CharData:
+			if skip > 0 || len(strings.TrimSpace(string(tok))) == 0 {
+				continue
+			}
+			AppendChild(parent, NewNode(string(tok), TextType))
+		}
+	}
+
+	if root.FirstChild() == nil || root.FirstChild().Data() != "svg" {
+		return nil, fmt.Errorf("unable to parse svg %s, the root element must be svg", file)
+	}
+
+	return Children(root), nil
+}
+
+// svgAttrs keeps the svg attributes of an element, the path data is optimized when decimals is
+// the number of decimal places to round it to rather than -1
+func svgAttrs(attrs []xml.Attr, currentColor bool, decimals int) []*html.Attribute {
+	ret := []*html.Attribute{}
+	for _, attr := range attrs {
+		if attr.Name.Space == "xmlns" && attr.Value != "http://www.w3.org/1999/xlink" {
+			continue
+		}
+		if attr.Name.Space != "xmlns" && !svgPrefix(attr.Name.Space) {
+			continue
+		}
+
+		val := attr.Value
+		if currentColor && (attr.Name.Local == "fill" || attr.Name.Local == "stroke") && isPaintColor(val) {
+			val = "currentColor"
+		}
+		if decimals >= 0 && attr.Name.Local == "d" && attr.Name.Space == "" {
+			val = optimizePath(val, decimals)
+		}
+		ret = append(ret, &html.Attribute{Namespace: attr.Name.Space, Key: attr.Name.Local, Val: val})
+	}
+	return ret
+}
+
+func svgPrefix(prefix string) bool {
+	return inList(prefix, svgPrefixes)
+}
+
+func inList(val string, list []string) bool {
+	for _, check := range list {
+		if check == val {
+			return true
+		}
+	}
+	return false
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// isPaintColor checks if a fill or stroke is a plain color, none, gradients and parameters are left alone
+func isPaintColor(val string) bool {
+	val = strings.ToLower(strings.TrimSpace(val))
+	return val != "" && val != "none" && val != "currentcolor" && val != "inherit" &&
+		!strings.HasPrefix(val, "url(") && !strings.Contains(val, "{")
+}
+
+// svgDecimals is the number of decimal places that path data can be rounded to without a visible
+// change, the error is kept under a ten thousandth of the size of the viewBox, or the width and
+// height without one, and a drawing with neither is rounded to 3 places
+func svgDecimals(attrs []xml.Attr) int {
+	size := 0.0
+	for _, attr := range attrs {
+		if attr.Name.Space != "" {
+			continue
+		}
+		switch attr.Name.Local {
+		case "viewBox":
+			box := strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ' ' || r == ',' })
+			if len(box) == 4 {
+				width, errW := strconv.ParseFloat(box[2], 64)
+				height, errH := strconv.ParseFloat(box[3], 64)
+				if errW == nil && errH == nil {
+					return decimalsFor(math.Max(width, height))
+				}
+			}
+		case "width", "height":
+			if val, err := strconv.ParseFloat(strings.TrimSuffix(attr.Value, "px"), 64); err == nil {
+				size = math.Max(size, val)
+			}
+		}
+	}
+	return decimalsFor(size)
+}
+
+func decimalsFor(size float64) int {
+	if size <= 0 || math.IsInf(size, 0) || math.IsNaN(size) {
+		return 3
+	}
+	decimals := int(math.Ceil(4 - math.Log10(size)))
+	if decimals < 0 {
+		return 0
+	}
+	if decimals > 10 {
+		return 10
+	}
+	return decimals
+}
+
+var pathNumPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?`)
+
+// pathArgs are the number of arguments each path command takes
+var pathArgs = map[byte]int{'m': 2, 'l': 2, 'h': 1, 'v': 1, 'c': 6, 's': 4, 'q': 4, 't': 2, 'a': 7, 'z': 0}
+
+// optimizePath rounds the numbers in path data to the given decimal places and removes the
+// separators and repeated commands that are not needed, the original is returned if it can't be parsed
+func optimizePath(d string, decimals int) string {
+	ret := ""
+	prevCmd := byte(0)
+	prevNum := ""
+	i := 0
+	skipSpace := func() {
+		for i < len(d) && strings.IndexByte(" \t\r\n,", d[i]) >= 0 {
+			i++
+		}
+	}
+
+	skipSpace()
+	for i < len(d) {
+		cmd := d[i]
+		count, ok := pathArgs[cmd|0x20]
+		if !ok {
+			return d
+		}
+		i++
+
+		for {
+			if cmd != prevCmd || cmd == 'M' || cmd == 'm' {
+				ret += string(cmd)
+				prevNum = ""
+			}
+			prevCmd = cmd
+
+			for arg := 0; arg < count; arg++ {
+				skipSpace()
+				num := ""
+				if (cmd|0x20) == 'a' && (arg == 3 || arg == 4) {
+					if i >= len(d) || (d[i] != '0' && d[i] != '1') {
+						return d
+					}
+					num = d[i : i+1]
+					i++
+				} else {
+					match := pathNumPattern.FindString(d[i:])
+					if match == "" {
+						return d
+					}
+					i += len(match)
+					num = formatPathNum(match, decimals)
+				}
+
+				if prevNum != "" && num[0] != '-' && !(num[0] == '.' && strings.Contains(prevNum, ".")) {
+					ret += " "
+				}
+				ret += num
+				prevNum = num
+			}
+
+			// the arguments of a command can repeat without repeating the command letter
+			skipSpace()
+			if count == 0 || i >= len(d) {
+				break
+			}
+			if _, next := pathArgs[d[i]|0x20]; next {
+				break
+			}
+			if cmd == 'M' {
+				cmd = 'L'
+			}
+			if cmd == 'm' {
+				cmd = 'l'
+			}
+		}
+		skipSpace()
+	}
+	return ret
+}
+
+func formatPathNum(num string, decimals int) string {
+	val, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return num
+	}
+	scale := math.Pow10(decimals)
+	val = math.Round(val*scale) / scale
+	ret := strconv.FormatFloat(val, 'f', -1, 64)
+	if ret == "-0" {
+		ret = "0"
+	}
+	if strings.HasPrefix(ret, "0.") {
+		ret = ret[1:]
+	}
+	if strings.HasPrefix(ret, "-0.") {
+		ret = "-" + ret[2:]
+	}
+	return ret
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOptimizePath(t *testing.T) {
+	type test struct {
+		d        string
+		decimals int
+		check    string
+	}
+
+	tests := []test{
+		test{
+			d:        "M 10.123456,20.98765 L 30.5,40 L 50 , 60 Z",
+			decimals: 3,
+			check:    "M10.123 20.988L30.5 40 50 60Z",
+		},
+		test{
+			d:        "m 0.5,0.25 l -0.125,0.0625 c 0.3333333,0 0.6666667,0.5 1,0.5",
+			decimals: 4,
+			check:    "m.5.25l-.125.0625c.3333 0 .6667.5 1 .5",
+		},
+		test{
+			d:        "M 1234.56 789.01 H 1500.4",
+			decimals: 0,
+			check:    "M1235 789H1500",
+		},
+		test{
+			d:        "M 10 10 A 5 5 0 1 0 20 20 L -0.0001 0",
+			decimals: 3,
+			check:    "M10 10A5 5 0 1 0 20 20L0 0",
+		},
+		test{
+			d:        "M 10 10 X 20",
+			decimals: 3,
+			check:    "M 10 10 X 20",
+		},
+	}
+
+	for i, run := range tests {
+		d := optimizePath(run.d, run.decimals)
+		if d != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, d)
+		}
+	}
+}
+
+func TestSVGDecimals(t *testing.T) {
+	type test struct {
+		svg   string
+		check int
+	}
+
+	tests := []test{
+		test{svg: `<svg viewBox="0 0 24 24"></svg>`, check: 3},
+		test{svg: `<svg viewBox="0 0 1 1"></svg>`, check: 4},
+		test{svg: `<svg viewBox="0,0,0.01,0.02"></svg>`, check: 6},
+		test{svg: `<svg viewBox="0 0 2000 1000"></svg>`, check: 1},
+		test{svg: `<svg width="100px" height="50px"></svg>`, check: 2},
+		test{svg: `<svg></svg>`, check: 3},
+	}
+
+	for i, run := range tests {
+		tok, err := xml.NewDecoder(strings.NewReader(run.svg)).Token()
+		if err != nil {
+			t.Errorf("(%d) there was an error parsing the svg %s", i, err)
+			continue
+		}
+		if decimals := svgDecimals(tok.(xml.StartElement).Attr); decimals != run.check {
+			t.Errorf("(%d) Expected %d decimals, got %d", i, run.check, decimals)
+		}
+	}
+}
+
+func TestParseSVGFile(t *testing.T) {
+	type test struct {
+		svg          string
+		currentColor bool
+		optimize     bool
+		check        string
+		err          bool
+	}
+
+	tests := []test{
+		test{
+			svg: `<?xml version="1.0" encoding="UTF-8"?>
+<!-- made in an editor -->
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" viewBox="0 0 24 24" inkscape:version="1.0">
+	<metadata><title>icon</title></metadata>
+	<path fill="#000" d="M 1.23456 2 L 3 4" inkscape:label="line"/>
+</svg>`,
+			currentColor: true,
+			optimize:     true,
+			check:        `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path fill="currentColor" d="M1.235 2L3 4"></path></svg>`,
+		},
+		test{
+			svg:      `<svg viewBox="0 0 1 1"><path d="M 0.12345 0.5 L 0.98765 0.5"/></svg>`,
+			optimize: true,
+			check:    `<svg viewBox="0 0 1 1"><path d="M.1235.5L.9877.5"></path></svg>`,
+		},
+		test{
+			svg:   `<svg viewBox="0 0 24 24"><linearGradient id="g"/><path fill="url(#g)" d="M 1.23456 2"/></svg>`,
+			check: `<svg viewBox="0 0 24 24"><linearGradient id="g"></linearGradient><path fill="url(#g)" d="M 1.23456 2"></path></svg>`,
+		},
+		test{
+			svg: `<div></div>`,
+			err: true,
+		},
+		test{
+			svg: `<svg></svg></svg>`,
+			err: true,
+		},
+	}
+
+	for i, run := range tests {
+		nodes, err := parseTestSVG(t, run.svg, run.currentColor, run.optimize)
+		if (err != nil) != run.err {
+			t.Errorf("(%d) Expected error to be %t, got %v", i, run.err, err)
+			continue
+		}
+		if run.err {
+			continue
+		}
+		out := ""
+		for _, node := range nodes {
+			out += node.Render()
+		}
+		if out != run.check {
+			t.Errorf("(%d) Expected %s, got %s", i, run.check, out)
+		}
+	}
+}
+
+// parseTestSVG writes the svg to a temporary file and parses it
+func parseTestSVG(t *testing.T, svg string, currentColor, optimize bool) ([]Node, error) {
+	dir, err := ioutil.TempDir("", "kiss-svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "icon.svg")
+	err = ioutil.WriteFile(file, []byte(svg), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseSVGFile(file, currentColor, optimize)
+}
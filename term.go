@@ -9,6 +9,11 @@ type kissArgs struct {
 	entry        string
 	globals      string
 	viewLocation string
+	targets      string
+	safelist     string
+	critical     string
+	assets       string
+	minify       string
 }
 
 func validArgs(args []string) bool {
@@ -44,8 +49,8 @@ func validArgs(args []string) bool {
 			// args should be in the form -O
 			return false
 		}
-		if arg[1] != 'o' && arg[1] != 'g' && arg[1] != 'v' {
-			// only -o, -g, and -v allowed
+		if arg[1] != 'o' && arg[1] != 'g' && arg[1] != 'v' && arg[1] != 't' && arg[1] != 's' && arg[1] != 'c' && arg[1] != 'a' && arg[1] != 'm' {
+			// only -o, -g, -v, -t, -s, -c, -a and -m allowed
 			return false
 		}
 	}
@@ -71,6 +76,21 @@ func parseArgs(args []string) (kissArgs, error) {
 		if arg == "-v" {
 			ret.viewLocation = args[i+1]
 		}
+		if arg == "-t" {
+			ret.targets = args[i+1]
+		}
+		if arg == "-s" {
+			ret.safelist = args[i+1]
+		}
+		if arg == "-c" {
+			ret.critical = args[i+1]
+		}
+		if arg == "-a" {
+			ret.assets = args[i+1]
+		}
+		if arg == "-m" {
+			ret.minify = args[i+1]
+		}
 	}
 	return ret, nil
 }
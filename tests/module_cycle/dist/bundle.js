@@ -0,0 +1,5 @@
+var kissModules=kissModules||{};
+var kissDefine=kissDefine||function(id,fn){if(id in kissModules){return}var exports={};kissModules[id]=exports;fn(exports)};
+var kissExport=kissExport||function(exports,getters){Object.keys(getters).forEach(function(name){Object.defineProperty(exports,name,{enumerable:true,get:getters[name]})})};
+var kissExportAll=kissExportAll||function(exports,mod){Object.keys(mod).forEach(function(name){if(name!=="default"&&!(name in exports)){Object.defineProperty(exports,name,{enumerable:true,get:function(){return mod[name]}})}})};
+kissDefine("lib/b.js",function(exports){"use strict";kissExport(exports,{"b":()=>b,"twice":()=>twice});function b(){return'b'};function twice(){let name='shadow';return kissModules["lib/a.js"]["a"]()+kissModules["lib/a.js"]["a"]()+name+kissModules["lib/a.js"].name+({name}).name};});kissDefine("lib/a.js",function(exports){"use strict";kissExport(exports,{"a":()=>a,"name":()=>name});const b=kissModules["lib/b.js"]["b"];const twice=kissModules["lib/b.js"]["twice"];function a(){return'a'+b()};const name='A';console.log('a',a(),twice());});
\ No newline at end of file
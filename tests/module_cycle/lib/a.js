@@ -0,0 +1,4 @@
+import { b, twice } from './b.js'
+export function a() { return 'a' + b() }
+export const name = 'A'
+console.log('a', a(), twice())
@@ -0,0 +1,4 @@
+import { a, name } from './a.js'
+import * as all from './a.js'
+export function b() { return 'b' }
+export function twice() { let name = 'shadow'; return a() + a() + name + all.name + ({name}).name }
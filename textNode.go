@@ -4,12 +4,20 @@ import (
 	"strings"
 )
 
-// TextNode contains text that does not appear in an xml tag
+// TextNode contains text that does not appear in an xml tag, Raw text is trusted html that is
+// rendered without escaping
 type TextNode struct {
 	BaseNode
+	Raw bool
 }
 
-// Instance takes parameters from the node context and replaces template parameteres
+// rawTextElements are the elements whose text the html parser doesn't decode
+var rawTextElements = []string{"script", "style", "xmp", "iframe", "noembed", "noframes", "noscript", "plaintext"}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Instance takes parameters from the node context and replaces template parameteres, a text
+// parameter in triple braces e.g. {{{content}}} is inserted as raw html
 func (node *TextNode) Instance(ctx InstNodeContext) error {
 	if node.Visible() {
 		data := strings.TrimSpace(node.Data())
@@ -17,10 +25,20 @@ func (node *TextNode) Instance(ctx InstNodeContext) error {
 			return nil
 		}
 
-		paramNodes, ok := ctx.Parameters[data[1:len(data)-1]]
+		name := data[1 : len(data)-1]
+		raw := strings.HasPrefix(data, "{{{") && strings.HasSuffix(data, "}}}")
+		if raw {
+			name = data[3 : len(data)-3]
+		}
+
+		paramNodes, ok := ctx.Parameters[name]
 		if ok {
 			for _, paramNode := range paramNodes {
-				AppendChild(node, paramNode.Clone())
+				clone := paramNode.Clone()
+				if text, ok := clone.(*TextNode); ok {
+					text.Raw = raw
+				}
+				AppendChild(node, clone)
 			}
 		}
 
@@ -30,11 +48,16 @@ func (node *TextNode) Instance(ctx InstNodeContext) error {
 	return node.BaseNode.Instance(ctx)
 }
 
-// Render returns the text on the data
+// Render returns the text on the data escaped for html, text inside elements like script and style
+// isn't escaped since the browser doesn't decode it
 func (node *TextNode) Render() string {
 	var ret string
 	if node.Visible() {
-		ret += node.Data()
+		if node.Raw || inRawText(node) {
+			ret += node.Data()
+		} else {
+			ret += textEscaper.Replace(node.Data())
+		}
 	}
 
 	for _, child := range Children(node) {
@@ -43,3 +66,24 @@ func (node *TextNode) Render() string {
 
 	return ret
 }
+
+// inRawText checks if the text is inside an element whose text isn't decoded, text nodes that
+// hold parameters are skipped over to find the element
+func inRawText(node Node) bool {
+	parent := node.Parent()
+	for parent != nil && parent.Type() == TextType {
+		parent = parent.Parent()
+	}
+	if parent == nil {
+		return false
+	}
+	return inList(strings.ToLower(parent.Data()), rawTextElements)
+}
+
+// Clone creates a deep copy of a node, but does not copy over the connections to the original parent and siblings
+func (node *TextNode) Clone() Node {
+	clone := node.BaseNode.Clone().(*TextNode)
+	clone.Raw = node.Raw
+	clone.dir = node.dir
+	return clone
+}
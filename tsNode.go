@@ -1,6 +1,7 @@
 package main
 
 import (
+	"KISS/js"
 	"KISS/ts"
 	"fmt"
 	"io/ioutil"
@@ -68,35 +69,80 @@ func (node *TSNode) Parse(ctx ParseNodeContext) error {
 	return node.BaseNode.Parse(ctx)
 }
 
-// Instance replaces props in a node with params
+// Instance replaces props in a node with params escaped for where they are used, in a string they
+// are escaped for its quotes and anywhere else they become a number, boolean or string literal
+// unless they are part of a name
 func (node *TSNode) Instance(ctx InstNodeContext) error {
 	re := regexp.MustCompile(`\$[_a-zA-Z][_a-zA-Z0-9]*\$`)
 	for i := 0; i < len(node.Script.Tokens); i++ {
-		tok := node.Script.Tokens[i]
-		if tok.Type == ts.Value {
-			matches := re.FindAll([]byte(tok.Value), -1)
-			for _, match := range matches {
-				val := ""
-				pnode, ok := ctx.Parameters[string(match[1:len(match)-1])]
-				if ok {
-					if len(pnode) == 1 {
-						val = pnode[0].Data()
-					}
-					if len(pnode) > 1 {
-						return fmt.Errorf("error at node %s, tried to replace %s with multiple param nodes", node, match)
-					}
-					if len(pnode) == 1 && pnode[0].Type() != TextType {
-						return fmt.Errorf("error at node %s, tried to replace %s with a non-text parameter", node, match)
-					}
+		tok := &node.Script.Tokens[i]
+		if tok.Type != ts.Value {
+			continue
+		}
+
+		quoted := strings.ContainsAny(tok.Value[:1], "'\"`")
+		name := !quoted && tsName(node.Script.Tokens, i)
+		var err error
+		tok.Value = re.ReplaceAllStringFunc(tok.Value, func(match string) string {
+			val, paramErr := jsParam(node, ctx, match)
+			if paramErr != nil {
+				err = paramErr
+				return match
+			}
+			switch {
+			case quoted:
+				return js.Quote(val, tok.Value[0])
+			case name:
+				if !js.IsName(val) {
+					err = fmt.Errorf("error at node %s, can not use %q as a name", node, val)
+				}
+				return val
+			}
+			next := ""
+			for j := i + 1; j < len(node.Script.Tokens) && next == ""; j++ {
+				if node.Script.Tokens[j].Type != ts.WhiteSpace {
+					next = node.Script.Tokens[j].Value
 				}
-				tok.Value = strings.ReplaceAll(tok.Value, string(match), val)
 			}
+			return js.Member(js.Value(val), next)
+		})
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// tsName checks if the template at i is part of a name, a property name or a name that is being
+// declared, characters that aren't part of another token are lexed one at a time
+func tsName(tokens []ts.Token, i int) bool {
+	namePart := func(j int) bool {
+		if j < 0 || j >= len(tokens) || tokens[j].Type != ts.Any {
+			return false
+		}
+		c := tokens[j].Value[0]
+		return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+	}
+	if namePart(i-1) || namePart(i+1) || (i > 0 && tokens[i-1].Value == ".") {
+		return true
+	}
+
+	j := i - 1
+	for j >= 0 && tokens[j].Type == ts.WhiteSpace {
+		j--
+	}
+	word := ""
+	for ; namePart(j); j-- {
+		word = tokens[j].Value + word
+	}
+	switch word {
+	case "var", "let", "const", "function", "class":
+		return true
+	}
+	return false
+}
+
 // Render converts a node into a textual representation
 func (node *TSNode) Render() string {
 	return "{\n" + node.Script.String() + "\n}\n"